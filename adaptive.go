@@ -0,0 +1,142 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+const (
+	// Allocations, after which PlaceAuto reconsiders the strategy.
+	adaptWindow = 256
+	
+	// PlaceAuto leaves first-fit for next-fit, if an allocation probes this many full chunks on average.
+	adaptProbesHigh = 4
+	
+	// PlaceAuto uses best-fit, if one of this many allocations fails, while enough blocks are free.
+	adaptFailures = 64
+	
+	// The fraction of free blocks, below which a failure is put down to the lack of space.
+	adaptFreeFraction = 0.125
+	
+	// Windows without such failures, before PlaceAuto leaves best-fit.
+	adaptCalmWindows = 4
+	
+	// PlaceAuto returns from next-fit to first-fit, once the usage dropped by this much.
+	adaptUsageDrop = 0.1
+)
+
+// State of the next-fit and adaptive placement.
+type adaptState struct{
+	// The strategy PlaceAuto currently uses.
+	current Placement
+	// The chunk of the previous allocation.
+	next int
+	// Counted within the current window.
+	allocs, probes, failures int64
+	calm int
+	// The usage, when next-fit was chosen.
+	usage float64
+}
+
+// Returns the strategy in effect: Placement, or the choice of PlaceAuto.
+func (pa *PageAllocator) EffectivePlacement() Placement {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	return pa.strategy()
+}
+
+func (pa *PageAllocator) strategy() Placement {
+	if pa.compactor.lowest { return PlaceLowest }
+	if pa.Placement!=PlaceAuto { return pa.Placement }
+	return pa.adapt.current
+}
+
+// Finds lng free blocks in a chunk, according to the strategy in effect.
+func (pa *PageAllocator) findFree(lng int64) (i int, pos int64, ok bool) {
+	n := len(pa.allocators)
+	switch pa.strategy() {
+	case PlaceBestFit:
+		return pa.findBestFit(lng)
+	case PlaceNextFit:
+		start := pa.adapt.next
+		if start>=n { start = 0 }
+		for k := 0; k<n; k++ {
+			i = (start+k)%n
+			if pos,ok = pa.findInChunk(i,lng); ok { return }
+			pa.adapt.probes++
+		}
+	default:
+		for i = 0; i<n; i++ {
+			if pos,ok = pa.findInChunk(i,lng); ok { return }
+			pa.adapt.probes++
+		}
+	}
+	return
+}
+
+// Finds the smallest free run of at least lng blocks, the lowest one among equals.
+func (pa *PageAllocator) findBestFit(lng int64) (i int, pos int64, ok bool) {
+	best := int64(-1)
+	for j := range pa.allocators {
+		a := &pa.allocators[j]
+		pa.op.chunks++
+		if !pa.chunkState(j).allocatable() {
+			pa.adapt.probes++
+			continue
+		}
+		if a.lazy {
+			if a.sum.largest<lng { continue }
+			pa.touch(j)
+		}
+		if a.index.valid {
+			if _,fit,scan := a.index.find(lng); !fit && !scan {
+				pa.adapt.probes++
+				continue
+			}
+		}
+		bitmap.ForEachFreeRun(a.buffer,func(p, l int64) bool {
+			if l<lng || (best>=0 && l>=best) { return true }
+			p,fit := pa.acceptRun(j,p,l,lng)
+			if !fit { return true }
+			i,pos,ok,best = j,p,true,l
+			return l>lng
+		})
+		if best==lng { return }
+	}
+	return
+}
+
+// Records the outcome of an allocation of lng blocks for PlaceAuto.
+func (pa *PageAllocator) observe(i int, lng int64, ok bool) {
+	if ok {
+		pa.adapt.next = i
+		pa.adapt.allocs++
+	} else if 1-pa.usage()>=adaptFreeFraction {
+		// Enough blocks are free, but not contiguous.
+		pa.adapt.failures++
+	}
+	if pa.Placement!=PlaceAuto || pa.adapt.allocs<adaptWindow { return }
+	s := &pa.adapt
+	next := s.current
+	if s.failures*adaptFailures>=s.allocs {
+		next = PlaceBestFit
+		s.calm = 0
+	} else {
+		switch s.current {
+		case PlaceBestFit:
+			if s.calm++; s.calm>=adaptCalmWindows { next = PlaceDefault }
+		case PlaceNextFit:
+			if pa.usage()<=s.usage-adaptUsageDrop { next = PlaceDefault }
+		default:
+			if s.probes>=adaptProbesHigh*s.allocs { next = PlaceNextFit }
+		}
+	}
+	s.allocs,s.probes,s.failures = 0,0,0
+	if next==s.current { return }
+	s.current = next
+	s.usage = pa.usage()
+	pa.emit(Event{Kind: EventPlacement, Placement: next})
+}
@@ -10,16 +10,22 @@ package filealloc
 import (
 	"io"
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 	"github.com/byte-mug/filealloc/bitmap"
 )
 
 // The existing chunks have been exthausted. Allocation impossible without growth.
+// Allocations fail with an *ExhaustedError, that matches it.
 var EXTHAUSTED = errors.New("EXTHAUSTED")
 
 // Size exceeds the whole chunk size. There can't be so many contiguous blocks in the file.
 var EXCEEDMAX = errors.New("EXCEEDMAX")
 
-var outOfBounds = errors.New("OUT_OF_BOUNDS")
+// The chunk doesn't exist.
+var OUTOFBOUNDS = errors.New("OUT_OF_BOUNDS")
 
 // A file. *os.File implements it.
 type Storage interface{
@@ -29,6 +35,35 @@ type Storage interface{
 	Sync() error
 }
 
+// Optional interface of a Storage, that can change its size. *os.File implements it.
+type Truncater interface{
+	Truncate(size int64) error
+}
+
+/*
+Optional interface of a Storage, that supports advisory whole-file locks, like flock(2).
+See the osfile package for an implementation for *os.File.
+*/
+type FileLocker interface{
+	// Blocks until the exclusive lock is acquired.
+	LockFile() error
+	UnlockFile() error
+}
+
+// Optional interface of a Storage, that can submit several writes at once.
+// The writes never overlap. See the uring package for an implementation.
+type BatchWriter interface{
+	WriteAtBatch(bufs [][]byte, offs []int64) error
+}
+
+/*
+Optional interface of a Storage, that can deallocate a range of a file, so that it reads as zeros.
+Returns UNSUPPORTED, if the file system can't. See the osfile package for an implementation.
+*/
+type HolePuncher interface{
+	PunchHole(off, size int64) error
+}
+
 // A file MMAP interface to a file.
 type MemMapper interface{
 	MemmapAt(lng int, off int64) ([]byte,error)
@@ -36,6 +71,25 @@ type MemMapper interface{
 	MemUnmap(mm []byte)
 }
 
+/*
+Optional interface of a MemMapper, that can msync the range [off,off+lng) of a mapping.
+Then only the modified blocks of a mmapped bitmap are flushed. See the stdmmap package.
+*/
+type RangeFlusher interface{
+	FlushRange(mm []byte, off, lng int) error
+}
+
+/*
+Optional interface of a MemMapper, whose mappings may lie in persistent memory (DAX, mapped with MAP_SYNC).
+For those, FlushMap and FlushRange must make the stores durable by flushing the CPU caches (CLWB and a fence),
+as a pmem library does, instead of msyncing. The allocator then flushes such bitmaps after every operation,
+whatever the SyncPolicy, as this takes no system call and no fsync.
+*/
+type PersistentMapper interface{
+	// Reports, whether mm, a mapping returned by MemmapAt, lies in persistent memory.
+	IsPersistent(mm []byte) bool
+}
+
 func castMemMapper(s Storage) MemMapper {
 	mm,_ := s.(MemMapper)
 	return mm
@@ -68,9 +122,74 @@ type FormatConfig struct{
 	
 	// On non-mmapped areas: don't fsync
 	DontFsync bool
+	
+	// Accept configurations, that never make the bitmaps durable. See CheckDurability.
+	AllowUnsafe bool
+	
+	// Write every bitmap to a scratch area first, so that a torn write can be repaired by Open().
+	// This is a format feature: it needs a superblock (see Create) and PrefixBlocks >= 2+BitmapBlocks.
+	// Implies DontUseMmap.
+	Doublewrite bool
+	
+	// Keep a copy of the superblock in the second prefix block, that Open() falls back to,
+	// if the superblock is broken. A format feature: it needs PrefixBlocks >= 2 (more with Doublewrite).
+	SuperblockBackup bool
+	
+	// Fail Create() and Open() with LOCKED, while another allocator has the file open with this set.
+	// Needs a Storage implementing ExclusiveLocker. Contradicts MultiProcess.
+	ExclusiveOpen bool
+	
+	// Cooperate with other processes, that have the same file open with MultiProcess set.
+	// Needs a superblock (see Create) and a Storage implementing FileLocker.
+	MultiProcess bool
+	
+	// When opening a file, that was not closed cleanly: mark the missing part
+	// of incomplete bitmaps as used, rather than as free.
+	Reconstruct bool
+	
+	// Open files with lost bitmaps: a chunk, whose bitmap can't be read or fails its checksums, is
+	// taken as fully used and read-only (ChunkSalvaged), so that the data still referenced can be read.
+	// Implies DontUseMmap. See RecoveryReport.Salvaged.
+	Salvage bool
+	
+	// End every bitmap block in a trailer with the chunk's generation and a checksum, so that torn
+	// bitmap writes and writes by others (CONCURRENTMODIFICATION) are detected.
+	// Reduces the blocks per chunk. Implies DontUseMmap.
+	Trailers bool
+	
+	// The representation of the bitmaps in the file, for interoperation with other formats.
+	// Implies DontUseMmap, unless zero.
+	BitmapEncoding bitmap.Encoding
+	
+	// The algorithm of the trailer, doublewrite and superblock checksums. A format feature.
+	Checksum Checksum
+	
+	// Deallocate the data of freed blocks in the file, if the Storage is a HolePuncher.
+	PunchOnFree bool
+	
+	// Zero the data of allocated blocks, by punching a hole or by writing zeros.
+	ZeroOnAllocate bool
+	
+	// Debugging aid: surround every allocation with a poisoned block on each side, and
+	// check them on free. Damaged redzones are reported with a *RedzoneError, and the
+	// extent is not freed. Only whole allocations can be freed: next to a part of one,
+	// there is no redzone. Must not change while blocks are allocated.
+	Redzones bool
+	
+	// Make placement depend on the bitmaps only, so that the same sequence of operations
+	// always yields the same allocations. The free-run index is then used to skip chunks, but
+	// not to choose the position. See StateHash.
+	Deterministic bool
+	
+	// For image generators: the same sequence of operations yields the same file, byte for byte.
+	// Implies Deterministic. Create zeroes the prefix blocks and records no random FileID and no
+	// time (see WithReproducible). Write-backs on a timer (SyncGroupCommit, AllocateBlocksAsync)
+	// and the compactor depend on timing and must not be used.
+	// Call Canonicalize before shipping the file.
+	Reproducible bool
 }
 func (f *FormatConfig) BlockSize() int { return 1 << f.BlockSizeLog }
-func (f *FormatConfig) RunSizeInBlocks() int64 { return int64(f.BitmapBlocks)<<(f.BlockSizeLog+3) }
+func (f *FormatConfig) RunSizeInBlocks() int64 { return int64(f.bitmapBytes())<<3 }
 func (f *FormatConfig) ChunkSizeInBlocks() int64 { return f.RunSizeInBlocks() + int64(f.BitmapBlocks) }
 func (f *FormatConfig) BreakAddress(blk int64) (chunk, pos int64,ok bool) {
 	blk -= int64(f.PrefixBlocks)
@@ -103,131 +222,649 @@ type bitmapBuffer struct{
 	buffer  []byte
 	rawoff  int64
 	mmapped bool
+	dirty   bool
+	// Modified bitmap blocks, one bit per block.
+	segs    []byte
+	shared  bool
+	index   runIndex
+	// Number of write-backs (see Trailers).
+	gen     uint64
+	// Why the bitmap is not mmapped.
+	fallback mapFallback
+	// The bitmap was lost (see Salvage).
+	salvaged bool
+	// The mapping lies in persistent memory (see PersistentMapper).
+	persistent bool
+	// Modified by an operation, that awaits the group commit.
+	urgent  bool
+	// Not loaded yet: only the summary of the chunk is known (see Summary).
+	lazy    bool
+	sum     chunkSummary
 }
 
 // A page allocator.
 type PageAllocator struct{
 	Storage
 	FormatConfig
+	
+	// Optional side file, that persists the largest free runs of each chunk.
+	// Lets the allocator skip full chunks without scanning their bitmaps.
+	RunIndex Storage
+	
+	// Number of free runs per chunk kept in the RunIndex. Defaults to 8.
+	RunIndexSize int
+	
+	// Optional side file, that records the owner of each extent. See AllocateOwned.
+	OwnerTable Storage
+	
+	/*
+	Optional side file, that Close writes a summary of the chunks to: their free blocks, their
+	largest free runs and the StateHash. Open reads it for a file, that was closed cleanly, instead
+	of the bitmaps, and loads each bitmap, when its chunk is first used. See WithSummary.
+	*/
+	Summary Storage
+	
+	// Optional side file, that persists the leases, so that they survive a restart. See Lease.
+	LeaseTable Storage
+	
+	// Called after the file grew by a new chunk, before the chunk is used for allocation.
+	// data is the chunk's data region. If it returns an error, the growth is rolled back
+	// (and the file truncated, if the Storage is a Truncater).
+	OnGrow func(chunk int64, data Extent) error
+	
+	// Where allocations are placed.
+	Placement Placement
+	
+	// If set, vetoes candidate placements. See PlacementFilter.
+	PlacementFilter PlacementFilter
+	
+	// If the file can't grow, because the device is full, release the blocks in quarantine
+	// and retry the allocation without growth, before failing with a NoSpaceError.
+	RetryWithoutGrowth bool
+	
+	/*
+	The fraction of the blocks of the existing chunks, that only AllocatePrivileged may use, like the
+	reserved blocks of ext4. Other allocations treat the reserve as full: they grow the file or fail.
+	*/
+	ReservedFraction float64
+	
+	// If positive, bitmaps are mmapped up to this many bytes in total. The others are heap-backed.
+	MaxMmapBytes int64
+	
+	// If positive, the file doesn't grow beyond this many chunks. Allocations, that would need
+	// another one, fail with EXTHAUSTED.
+	MaxChunks int
+	
+	// The period of history, over which Stats forecasts the exhaustion. Defaults to 10 minutes.
+	ForecastWindow time.Duration
+	
+	// If positive, EventExhaustion is emitted, once the forecast exhaustion is closer than this.
+	ForecastAlert time.Duration
+	
+	// If positive, the allocations and frees are counted over this sliding window, by chunk and
+	// by HeatmapRegions regions of each chunk (default 1). See Heatmap.
+	HeatmapWindow time.Duration
+	HeatmapRegions int
+	
+	// When modified bitmaps are written back. MultiProcess mode always uses SyncEachOp.
+	SyncPolicy SyncPolicy
+	
+	// The longest time, SyncGroupCommit holds back a modification. Defaults to 5ms.
+	CommitInterval time.Duration
+	
+	// Fractions of used blocks, at which EventHighWatermark and EventLowWatermark are emitted.
+	// Zero disables them. LowWatermark defaults to HighWatermark.
+	HighWatermark, LowWatermark float64
+	
+	// If positive, allocations, that continue the previous one, are followed by a read-ahead hint
+	// for this many blocks, if the Storage is a ReadAdviser.
+	ReadAheadOnAllocate int64
+	
+	/*
+	Blocks freed by FreeBlocks are not reused, until QuarantineFlushes calls of Flush()
+	and QuarantineTime have passed (the latter is checked on Flush() as well), so that
+	use-after-free bugs of the caller read stale data rather than another owner's.
+	Quarantined extents are not persisted: after a crash, they remain allocated. Close() frees them.
+	Under Deterministic, QuarantineTime is ignored.
+	*/
+	QuarantineFlushes int
+	QuarantineTime time.Duration
+	
+	// If set, every allocation and free is recorded. See Replay.
+	Trace *TraceWriter
+	
+	// If set, every allocation and free is appended to this log. It is synced before the bitmaps
+	// are written back, except for mmapped ones, that the kernel may write back at any time.
+	// An allocation, whose record can not be appended, fails and is undone. A free is carried out
+	// all the same, and returns the error. Write errors of the log are sticky (see AuditLog.Err).
+	Audit *AuditLog
+	
+	// Bitmap bytes per second, that Scrub reads at most. Zero means unlimited.
+	ScrubRate int64
+	
+	/*
+	If positive, bounds the wall-clock time of operations like allocations, frees and flushes:
+	the wait for the allocator fails with TIMEOUT after this long, and so does an allocation, that
+	is still growing the file after it. Storage calls can't be interrupted, unless the Storage is a
+	DeadlineSetter: then it gets the deadline, and its deadline errors are reported as TIMEOUT.
+	Change it with Reconfigure (see WithOpTimeout), once the allocator is initialized.
+	*/
+	OpTimeout time.Duration
+	
+	// If positive, the latency of operations is tracked (see Latency), and OnSlowOp is called
+	// for each operation, that took this long or longer, after the allocator is unlocked.
+	SlowOpThreshold time.Duration
+	OnSlowOp func(r SlowOp)
+	
+	// Limits on the size of a single allocation, below the structural EXCEEDMAX. 0 means no limit.
+	// Allocations of more than SoftLimitBlocks proceed, but OnSoftLimit is called with their length,
+	// after the allocator is unlocked. Allocations of more than HardLimitBlocks fail with a *LimitError.
+	// AllocateBatch checks each extent, AllocateScatter the total. Privileged allocations
+	// (AllocatePrivileged, the tables of the allocator) and moves are exempt.
+	SoftLimitBlocks, HardLimitBlocks int64
+	OnSoftLimit func(lng int64)
+	
+	// Consulted after each allocation and free, to run housekeeping in the background.
+	Maintenance MaintenancePolicy
+	
+	// Called in the background for MaintainCompact. It should move allocations out of the tail of the file.
+	OnCompact func(pa *PageAllocator) error
+	
+	// Guards everything below. The allocator is safe for concurrent use.
+	mu sync.Mutex
+	commit commitState
+	chunkLocks []*sync.RWMutex
+	subscribers []chan Event
+	// Callers of AllocateBlocksWait, in order.
+	spaceWaiters []chan struct{}
+	// Called with every Op. See Record.
+	recorders []*opRecorder
+	// Changed with the allocator locked, read without. See UsedBlocks.
+	usedBlocks atomic.Int64
+	aboveHigh bool
+	
 	mmapper MemMapper
+	super superblock
+	hasSuper bool
+	dwSeq uint64
+	recovery RecoveryReport
+	changed bool
+	// The superblock has updates, that wait for the next write-back. See deferSuperblock.
+	superPending bool
+	locker FileLocker
+	exclusive ExclusiveLocker
 	bitmapSize int
+	// Owner of the allocation in progress, for the audit log.
+	owner OwnerTag
+	// The Storage returned UNSUPPORTED from PunchHole.
+	noPunch bool
+	// End of the last allocation, to detect sequential allocations.
+	streamEnd int64
+	waste WasteStats
 	allocators []bitmapBuffer
+	pending []pendingFree
+	quarantined []quarantined
+	// Number of calls to flush().
+	flushes uint64
+	epochs epochState
+	adapt adaptState
+	history usageHistory
+	// Bitmaps are written back at the end of a batch. See AllocateBatch.
+	batching bool
+	// The allocation in progress may use the reserve. See AllocatePrivileged.
+	privileged bool
+	// The allocation in progress is exempt from the size limits: a move, or a part of a checked request.
+	unlimited bool
+	// The operation in progress writes back according to class, rather than the SyncPolicy.
+	classed bool
+	class SyncPolicy
+	limits limitState
+	heat heatState
+	lazy lazyState
+	leases leaseState
+	// Told about extents moved by MoveBlocks.
+	relocators []relocator
+	op opStats
+	latency [numOpClasses]LatencyStats
+	maint maintState
+	compactor compactorState
+	// Counts the operations, so that the compactor can tell, whether others are running.
+	opSeq uint64
+	// Deadline of the operation in progress. See OpTimeout.
+	deadline time.Time
+	// OpTimeout, for lock(), which reads it before pa.mu is held.
+	opTimeout atomic.Int64
+	// Recorded by Create, if Reproducible. See WithReproducible.
+	repro reproducibleIdentity
 }
 
 // Initializes the page allocator after construction.
 func (pa *PageAllocator) Init() {
-	pa.bitmapSize = int(pa.BitmapBlocks)<<pa.BlockSizeLog
-	if pa.DontUseMmap {
-		pa.mmapper = nil
-	} else {
+	pa.bitmapSize = pa.bitmapBytes()
+	if pa.Reproducible { pa.Deterministic = true }
+	pa.opTimeout.Store(int64(pa.OpTimeout))
+	if !pa.hasSuper { pa.Doublewrite, pa.MultiProcess = false,false }
+	if pa.wantsMmap() {
 		pa.mmapper = getMemMapper(pa.Storage)
+	} else {
+		pa.mmapper = nil
 	}
-	buf := make([]byte,pa.bitmapSize)
-	
 	pos := int64(pa.PrefixBlocks)
 	stride := pa.ChunkSizeInBlocks()
 	
-	i := 0
-	for {
-		n,_ := pa.ReadAt(buf,pos<<pa.BlockSizeLog)
-		if n<=0 { break }
-		i++
-		pos += stride
-	}
+	sums := pa.lazy.pending
+	pa.lazy.pending = nil
+	i := len(sums)
+	if sums==nil { i = pa.countChunks() }
 	
 	if i==0 {
-		for j := range buf { buf[j] = 0 }
-		pa.WriteAt(buf,pos<<pa.BlockSizeLog)
+		pa.WriteAt(pa.rawBitmap(make([]byte,pa.bitmapSize),pos<<pa.BlockSizeLog,0),pos<<pa.BlockSizeLog)
 		i++
 	}
 	
 	pa.allocators = make([]bitmapBuffer,i)
 	
-	pos = int64(pa.PrefixBlocks)
 	for j := range pa.allocators {
-		pa.allocators[j] = pa.getAllocator(pos)
+		if sums!=nil {
+			pa.allocators[j] = bitmapBuffer{rawoff: pos<<pa.BlockSizeLog, lazy: true, sum: sums[j]}
+		} else {
+			pa.allocators[j] = pa.getAllocator(pos)
+		}
+		pos += stride
+	}
+	pa.lazy.chunks = len(sums)
+	
+	if pa.RunIndex!=nil {
+		for j := range pa.allocators {
+			if !pa.allocators[j].lazy { pa.loadRunIndex(j) }
+		}
+	}
+	// The states of chunks, that Shrink removed before a crash.
+	if pa.dropChunkStates(len(pa.allocators)) { pa.deferSuperblock() }
+	for _,s := range pa.super.states {
+		if s.state==ChunkSealed { pa.drop(int(s.chunk)) }
+	}
+	if pa.LeaseTable!=nil { pa.loadLeases() }
+	pa.countUsed()
+}
+
+// Counts the chunks in the file, by probing for their bitmaps.
+func (pa *PageAllocator) countChunks() (i int) {
+	buf := make([]byte,pa.rawBitmapBytes())
+	pos := int64(pa.PrefixBlocks)
+	stride := pa.ChunkSizeInBlocks()
+	for {
+		n,_ := pa.ReadAt(buf,pos<<pa.BlockSizeLog)
+		if n<=0 { return }
+		i++
 		pos += stride
 	}
 }
 
 // Returns the number of chunks.
-func (pa *PageAllocator) ChunksN() int { return len(pa.allocators) }
+func (pa *PageAllocator) ChunksN() int {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	return len(pa.allocators)
+}
 
 // Closes the allocator and the underlying file. Frees all associated resources.
 func (pa *PageAllocator) Close() error {
+	pa.StopCompactor()
+	pa.maint.wg.Wait()
+	if err := pa.enter(); err!=nil { return err }
+	pa.maint.closed = true
+	pa.commit.stop()
+	// The quarantine ends with the allocator.
+	pa.releaseQuarantine(true)
+	w,err := pa.flush()
+	if err==nil && pa.hasSuper && !pa.MultiProcess {
+		// Tells the next Open, whether the summary belongs to this state.
+		pa.super.changes++
+		if pa.Summary!=nil { err = pa.writeSummary() }
+	}
+	if err==nil && pa.hasSuper && !pa.MultiProcess {
+		pa.super.flags &^= flagDirty
+		err = pa.writeSuperblock()
+	}
+	pa.leave(&err)
+	notify(w,err)
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
 	for i := range pa.allocators {
 		if pa.allocators[i].mmapped {
 			pa.mmapper.MemUnmap(pa.allocators[i].buffer)
 			pa.allocators[i].buffer = nil
 			pa.allocators[i].mmapped = false
+			pa.allocators[i].persistent = false
 		}
 	}
 	pa.allocators = nil
+	if pa.RunIndex!=nil { pa.RunIndex.Close() }
+	if pa.OwnerTable!=nil { pa.OwnerTable.Close() }
+	if pa.Summary!=nil { pa.Summary.Close() }
+	if pa.LeaseTable!=nil { pa.LeaseTable.Close() }
+	pa.unlockExclusive()
 	pa.Storage.Close()
 	return nil
 }
 
 func (pa *PageAllocator) getAllocator(off int64) (b bitmapBuffer) {
 	b.rawoff = off<<pa.BlockSizeLog
-	if pa.mmapper!=nil {
-		buf,err := pa.mmapper.MemmapAt(pa.bitmapSize, b.rawoff)
-		if err==nil && len(buf)>=pa.bitmapSize {
-			b.buffer = buf
-			b.mmapped = true
-		}
-	}
+	chunk,_,_ := pa.BreakAddress(off+int64(pa.BitmapBlocks))
+	pa.mapBitmap(&b,chunk)
 	if !b.mmapped {
 		b.buffer = make([]byte,pa.bitmapSize)
+		if pa.Salvage {
+			pa.salvageBitmap(&b,chunk)
+			return
+		}
 		// Initial read.
-		pa.ReadAt(b.buffer,b.rawoff)
+		var ok bool
+		if b.gen,ok = pa.readBitmap(b.buffer,b.rawoff); !ok {
+			// Rewrite the torn blocks.
+			pa.markDirty0(&b,0,int64(pa.bitmapSize)<<3)
+		}
 	}
 	return
 }
 func (pa *PageAllocator) appendAllocator() (err error) {
 	var b bitmapBuffer
+	if pa.MaxChunks>0 && len(pa.allocators)>=pa.MaxChunks { return EXTHAUSTED }
+	if _,err = pa.chunkEnd(int64(len(pa.allocators))); err!=nil { return }
 	off := pa.MakeAddress(int64(len(pa.allocators)),-int64(pa.BitmapBlocks))
 	b.rawoff = off<<pa.BlockSizeLog
 	b.buffer = make([]byte,pa.bitmapSize)
-	_,err = pa.WriteAt(b.buffer,b.rawoff)
-	if err!=nil { return }
-	if pa.mmapper!=nil {
-		buf,err2 := pa.mmapper.MemmapAt(pa.bitmapSize, b.rawoff)
-		if err2==nil && len(buf)>=pa.bitmapSize {
-			b.buffer = buf
-			b.mmapped = true
+	_,err = pa.WriteAt(pa.rawBitmap(b.buffer,b.rawoff,0),b.rawoff)
+	if err!=nil {
+		// The bitmap may have been written in part.
+		pa.rollbackGrowth(&b)
+		return pa.noSpace(err)
+	}
+	pa.mapBitmap(&b,int64(len(pa.allocators)))
+	if pa.OnGrow!=nil {
+		chunk := int64(len(pa.allocators))
+		err = pa.OnGrow(chunk,Extent{pa.MakeAddress(chunk,0),pa.RunSizeInBlocks()})
+		if err!=nil {
+			pa.rollbackGrowth(&b)
+			return pa.noSpace(err)
 		}
 	}
 	pa.allocators = append(pa.allocators,b)
+	pa.changed = true
+	pa.op.grew++
+	pa.record(Op{Kind: OpKindGrow, Chunk: int64(len(pa.allocators)-1)})
+	pa.emit(Event{Kind: EventGrow, Chunk: int64(len(pa.allocators)-1)})
+	pa.checkWatermarks()
+	if pa.RunIndex!=nil {
+		i := len(pa.allocators)-1
+		pa.allocators[i].index.compute(b.buffer,pa.runIndexSize())
+		err = pa.storeRunIndex(i)
+	}
 	return
 }
 
-// msyncs the chunk's bitmap, if it is mmapped.
+// Undoes appendAllocator for a chunk, that was not added to pa.allocators.
+func (pa *PageAllocator) rollbackGrowth(b *bitmapBuffer) {
+	if b.mmapped {
+		pa.mmapper.MemUnmap(b.buffer)
+		b.mmapped,b.persistent = false,false
+	}
+	if t,ok := pa.Storage.(Truncater); ok { t.Truncate(b.rawoff) }
+}
+
+/*
+Makes the chunk's bitmap durable: mmapped bitmaps are msynced, heap-backed ones are written
+back and fsynced. This is done even if DontMsync or DontFsync is set.
+*/
+func (pa *PageAllocator) FlushChunk(chunk int64) (err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if chunk<0 || int64(len(pa.allocators)) <= chunk { return OUTOFBOUNDS }
+	i := int(chunk)
+	if err = pa.flushChunk(i); err!=nil { return }
+	if pa.allocators[i].mmapped {
+		if pa.DontMsync { err = pa.msync(&pa.allocators[i]) }
+	} else if pa.DontFsync {
+		err = pa.Sync()
+	}
+	return
+}
+
+/*
+msyncs the chunk's bitmap, if it is mmapped.
+
+Deprecated: use FlushChunk, which handles heap-backed bitmaps as well.
+*/
 func (pa *PageAllocator) MemSyncIfMmapped(chunk int64) (err error, mmapped bool) {
-	if int64(len(pa.allocators)) <= chunk { err = outOfBounds; return }
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if int64(len(pa.allocators)) <= chunk { err = OUTOFBOUNDS; return }
 	if !pa.allocators[chunk].mmapped { return }
 	mmapped = true
 	err = pa.mmapper.FlushMap(pa.allocators[chunk].buffer)
 	return
 }
 
-func (pa *PageAllocator) doAllocate(lng int64) (blk int64, ok bool,err error) {
-	for i := range pa.allocators {
-		blk,ok = bitmap.AllocateBitmap(pa.allocators[i].buffer,lng)
-		if !ok { continue }
-		blk = pa.MakeAddress(int64(i),blk)
-		if !pa.allocators[i].mmapped {
-			_,err = pa.WriteAt(pa.allocators[i].buffer,pa.allocators[i].rawoff)
-			if !pa.DontFsync { pa.Sync() }
-		} else if !pa.DontMsync {
-			err = pa.mmapper.FlushMap(pa.allocators[i].buffer)
+// msyncs the modified blocks of a mmapped bitmap, or all of it, if the MemMapper is no RangeFlusher.
+func (pa *PageAllocator) msync(a *bitmapBuffer) (err error) {
+	rf,ok := pa.mmapper.(RangeFlusher)
+	if !ok {
+		err = pa.mmapper.FlushMap(a.buffer)
+	} else {
+		bitmap.ForEachUsedRun(a.segs,func(pos, lng int64) bool {
+			if pos>=int64(pa.BitmapBlocks) { return false }
+			if end := int64(pa.BitmapBlocks); pos+lng>end { lng = end-pos }
+			err = rf.FlushRange(a.buffer,int(pos<<pa.BlockSizeLog),int(lng<<pa.BlockSizeLog))
+			return err==nil
+		})
+	}
+	if err==nil { for j := range a.segs { a.segs[j] = 0 } }
+	return
+}
+
+// Records the modification of the bitmap range [pos,pos+lng).
+func (pa *PageAllocator) markDirty(i int, pos, lng int64) { pa.markDirty0(&pa.allocators[i],pos,lng) }
+func (pa *PageAllocator) markDirty0(a *bitmapBuffer, pos, lng int64) {
+	a.dirty = true
+	pa.lazy.hashValid = false
+	if lng<=0 { return }
+	if a.segs==nil { a.segs = make([]byte,(int(pa.BitmapBlocks)+7)>>3) }
+	pl := int64(pa.bitmapPayload())
+	first := (pos>>3)/pl
+	last := ((pos+lng-1)>>3)/pl
+	bitmap.WriteInUse(a.segs,first,last-first+1)
+}
+
+// Writes the chunk's bitmap back to the file.
+func (pa *PageAllocator) flushChunk(i int) error { return pa.flushChunks([]int{i}) }
+
+/*
+Writes the chunks' bitmaps back to the file.
+
+Of heap-backed bitmaps, only the modified blocks are written. If the Storage is a BatchWriter,
+they are submitted at once, unless the doublewrite area forces them one chunk at a time.
+Of mmapped bitmaps, only the modified blocks are msynced, if the MemMapper is a RangeFlusher.
+*/
+func (pa *PageAllocator) flushChunks(chunks []int) (err error) {
+	defer func() {
+		if err!=nil { pa.emit(Event{Kind: EventWriteFailed, Err: err}) }
+	}()
+	// The audit records go first: no bitmap may show an allocation, that is not on record.
+	if pa.Audit!=nil && !pa.DontFsync {
+		if err = pa.Audit.Sync(); err!=nil { return }
+	}
+	var bufs [][]byte
+	var offs []int64
+	var bumped []int
+	defer func() {
+		if err==nil { return }
+		// Take up the generation, that made it to the file.
+		for _,i := range bumped {
+			a := &pa.allocators[i]
+			if gen,ok := pa.diskGeneration(a.rawoff); ok { a.gen = gen }
+		}
+	}()
+	// Nothing is written, unless all generations match.
+	for _,i := range chunks {
+		a := &pa.allocators[i]
+		if !pa.Trailers || a.lazy || a.mmapped { continue }
+		if gen,ok := pa.diskGeneration(a.rawoff); !ok || gen!=a.gen {
+			a.dirty = true
+			return fmt.Errorf("%w: chunk %d: generation %d in the file, %d expected",CONCURRENTMODIFICATION,i,gen,a.gen)
+		}
+	}
+	// A chunk is marked clean, once its blocks are written and synced.
+	clean := func(l []int) {
+		for _,i := range l {
+			a := &pa.allocators[i]
+			a.dirty,a.urgent = false,false
+			for j := range a.segs { a.segs[j] = 0 }
 		}
-		return
 	}
-	blk = 0
-	err = EXTHAUSTED
+	var queued []int
+	for _,i := range chunks {
+		a := &pa.allocators[i]
+		// Not loaded, so not modified.
+		if a.lazy { continue }
+		pa.changed = true
+		if a.mmapped { continue }
+		if pa.Trailers {
+			a.gen++
+			// The first block carries the generation.
+			if a.segs==nil { a.segs = make([]byte,(int(pa.BitmapBlocks)+7)>>3) }
+			a.segs[0] |= 0x80
+			bumped = append(bumped,i)
+		}
+		var raw []byte
+		if pa.Doublewrite { raw = pa.rawBitmap(a.buffer,a.rawoff,a.gen) }
+		bitmap.ForEachUsedRun(a.segs,func(pos, lng int64) bool {
+			if pos>=int64(pa.BitmapBlocks) { return false }
+			if end := int64(pa.BitmapBlocks); pos+lng>end { lng = end-pos }
+			from,to := pos<<pa.BlockSizeLog,(pos+lng)<<pa.BlockSizeLog
+			switch {
+			case raw!=nil: bufs = append(bufs,raw[from:to])
+			case pa.Trailers: bufs = append(bufs,pa.encodeBlocks(a.buffer,a.rawoff,a.gen,int(pos),int(lng)))
+			case pa.BitmapEncoding!=0:
+				b := append([]byte(nil),a.buffer[from:to]...)
+				pa.BitmapEncoding.Encode(b)
+				bufs = append(bufs,b)
+			default: bufs = append(bufs,a.buffer[from:to])
+			}
+			offs = append(offs,a.rawoff+from)
+			return true
+		})
+		if !pa.Doublewrite {
+			queued = append(queued,i)
+			continue
+		}
+		// The in-place write must be durable, before the next chunk reuses the doublewrite area.
+		if err = pa.writeDoublewrite(i,raw); err!=nil { return }
+		if err = pa.writeBatch(bufs,offs); err!=nil { return }
+		if !pa.DontFsync {
+			if err = pa.Sync(); err!=nil { return }
+		}
+		clean([]int{i})
+		bufs,offs = bufs[:0],offs[:0]
+	}
+	if len(queued)>0 {
+		if err = pa.writeBatch(bufs,offs); err!=nil { return }
+		if !pa.DontFsync {
+			if err = pa.Sync(); err!=nil { return }
+		}
+		clean(queued)
+	}
+	for _,i := range chunks {
+		a := &pa.allocators[i]
+		if a.lazy || !a.mmapped { continue }
+		if !pa.DontMsync {
+			if err = pa.msync(a); err!=nil { return }
+		}
+		a.dirty,a.urgent = false,false
+	}
+	if pa.RunIndex!=nil {
+		for _,i := range chunks {
+			if pa.allocators[i].lazy { continue }
+			if err = pa.storeRunIndex(i); err!=nil { return }
+		}
+	}
+	// In MultiProcess mode, leave() writes it.
+	if pa.superPending && !pa.MultiProcess { err = pa.writeSuperblock() }
 	return
 }
 
+func (pa *PageAllocator) writeBatch(bufs [][]byte, offs []int64) (err error) {
+	if len(bufs)==0 { return }
+	for _,b := range bufs { pa.op.written += int64(len(b)) }
+	if bw,ok := pa.Storage.(BatchWriter); ok { return bw.WriteAtBatch(bufs,offs) }
+	for i,b := range bufs {
+		if _,err = pa.WriteAt(b,offs[i]); err!=nil { return }
+	}
+	return
+}
+
+func (pa *PageAllocator) findInChunk(i int, lng int64) (pos int64, ok bool) {
+	pa.op.chunks++
+	if !pa.chunkState(i).allocatable() { return }
+	a := &pa.allocators[i]
+	if a.lazy {
+		if a.sum.largest<lng { return }
+		pa.touch(i)
+	}
+	if a.index.valid {
+		var scan bool
+		pos,ok,scan = a.index.find(lng)
+		if !ok && !scan { return }
+		if ok && pa.strategy()!=PlaceLowest && !pa.Deterministic && pa.accepts(i,pos,lng) { return }
+	}
+	return pa.findAccepted(i,a.buffer,lng)
+}
+
+func (pa *PageAllocator) doAllocate(lng int64, async bool) (blk int64, ok bool,err error) {
+	if lng==pa.RunSizeInBlocks() { return pa.allocateChunk(async) }
+	i,blk,ok := pa.findFree(lng)
+	pa.observe(i,lng,ok)
+	if !ok { return 0,false,EXTHAUSTED }
+	if err = bitmap.WriteInUseE(pa.writable(i),blk,lng); err!=nil {
+		// The position came from a damaged free-run index.
+		pa.allocators[i].index.valid = false
+		return 0,false,fmt.Errorf("%w: chunk %d: %v",INCONSISTENT,i,err)
+	}
+	pa.usedBlocks.Add(lng)
+	pa.checkWatermarks()
+	pa.markDirty(i,blk,lng)
+	if pa.allocators[i].index.valid { pa.allocators[i].index.allocated(blk,lng,pa.runIndexSize()) }
+	blk = pa.MakeAddress(int64(i),blk)
+	err = pa.commitChunk(i,async)
+	return
+}
+
+// Claims the data region of an empty chunk as a whole, without scanning for free runs.
+func (pa *PageAllocator) allocateChunk(async bool) (blk int64, ok bool, err error) {
+	n := pa.RunSizeInBlocks()
+	for i := range pa.allocators {
+		pa.op.chunks++
+		a := &pa.allocators[i]
+		if !pa.chunkState(i).allocatable() { continue }
+		if a.lazy {
+			if a.sum.free<n { continue }
+			pa.touch(i)
+		}
+		if a.index.valid && (len(a.index.runs)==0 || a.index.runs[0].Len<n) { continue }
+		if !isZero(a.buffer) || !pa.accepts(i,0,n) { continue }
+		bm := pa.writable(i)
+		for j := range bm { bm[j] = 0xff }
+		pa.usedBlocks.Add(n)
+		pa.checkWatermarks()
+		pa.markDirty(i,0,n)
+		if a.index.valid { a.index.allocated(0,n,pa.runIndexSize()) }
+		pa.observe(i,n,true)
+		return pa.MakeAddress(int64(i),0),true,pa.commitChunk(i,async)
+	}
+	pa.observe(0,n,false)
+	return 0,false,EXTHAUSTED
+}
+
 // Allocates a series of contiguous blocks.
 // set grow = true, if the file should add a new chunk if needed.
 func (pa *PageAllocator) AllocateBlocks(lng int64, grow bool) (blk int64, ok bool, err error) {
@@ -235,32 +872,160 @@ func (pa *PageAllocator) AllocateBlocks(lng int64, grow bool) (blk int64, ok boo
 		err = EXCEEDMAX
 		return
 	}
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	return pa.allocate(lng,grow,false)
+}
+
+func (pa *PageAllocator) allocate(lng int64, grow, async bool) (blk int64, ok bool, err error) {
+	pa.opClass(OpAllocate)
+	switch {
+	case lng<0: return 0,false,&RangeError{0,lng,FaultLength}
+	// An empty extent needs no blocks. It is placed at the first data block, freeing it is a no-op.
+	case lng==0: return pa.MakeAddress(0,0),true,nil
+	}
+	if err = pa.checkLimits(lng); err!=nil { return }
+	if pa.Audit!=nil && !pa.batching {
+		// The bitmap is written back after the audit record.
+		pa.batching = true
+		defer func() {
+			pa.batching = false
+			if !ok { return }
+			c,_,_ := pa.BreakAddress(blk)
+			if e := pa.commitChunk(int(c),async); err==nil { err = e }
+		}()
+	}
+	defer func() {
+		if ok {
+			if e := pa.audit(AuditAllocate,blk,lng,pa.owner); e!=nil {
+				if pa.Redzones {
+					pa.applyFreeRaw(blk-1,lng+2)
+				} else {
+					pa.applyFreeRaw(blk,lng)
+				}
+				blk,ok,err = 0,false,e
+			}
+		}
+		pa.traceAllocate(lng,grow,blk,ok)
+		if ok { pa.record(Op{Kind: OpKindAlloc, Extent: Extent{blk,lng}}) }
+		pa.maintain()
+	}()
+	if !pa.Redzones { return pa.place(lng,grow,async) }
+	if lng>pa.RunSizeInBlocks()-2 { return 0,false,EXCEEDMAX }
+	blk,ok,err = pa.place(lng+2,grow,async)
+	if !ok { return }
+	if err = pa.poison(blk,lng); err!=nil {
+		pa.freeRaw(blk,lng+2)
+		return 0,false,err
+	}
+	return blk+1,true,err
+}
+
+// Allocates lng blocks, growing the file if allowed.
+func (pa *PageAllocator) place(lng int64, grow, async bool) (blk int64, ok bool, err error) {
+	defer func() {
+		if err==EXTHAUSTED { err = pa.exhausted(lng) }
+	}()
 	for {
-		blk,ok,err = pa.doAllocate(lng)
+		if pa.intoReserve(lng) {
+			blk,ok,err = 0,false,EXTHAUSTED
+		} else {
+			blk,ok,err = pa.doAllocate(lng,async)
+		}
+		if ok && pa.ZeroOnAllocate {
+			if err = pa.zeroData(blk,lng); err!=nil {
+				pa.freeRaw(blk,lng)
+				return 0,false,err
+			}
+		}
+		if ok && pa.ReadAheadOnAllocate>0 { pa.readAhead(blk,lng) }
 		if ok || err != EXTHAUSTED || !grow { return }
+		if err = pa.expired(); err!=nil { return }
 		err = pa.appendAllocator()
-		if err!=nil { return }
+		if err==nil { continue }
+		if !pa.RetryWithoutGrowth || !errors.Is(err,NOSPACE) || len(pa.quarantined)==0 { return }
+		// Retry once with the blocks, that are held back in quarantine.
+		nerr := err
+		if err = pa.releaseQuarantine(true); err!=nil { return }
+		blk,ok,err = pa.place(lng,false,async)
+		if !ok && errors.Is(err,EXTHAUSTED) { err = nerr }
+		return
 	}
-	panic("...")
+}
+
+/*
+Frees the blocks in the chunk's bitmap without writing it back.
+With Redzones, the redzones are checked first, and freed as well. If the check fails, nothing is freed.
+If the audit record can not be appended, the blocks are freed all the same, and the error is returned.
+*/
+func (pa *PageAllocator) applyFree(blk int64, lng int64) (i int, ok bool, err error) {
+	pa.opClass(OpFree)
+	if pa.Redzones {
+		if err = pa.checkRedzones(blk,lng); err!=nil { return }
+	}
+	pa.traceFree(blk,lng)
+	aerr := pa.audit(AuditFree,blk,lng,0)
+	pa.record(Op{Kind: OpKindFree, Extent: Extent{blk,lng}})
+	defer func() {
+		if err==nil { err = aerr }
+	}()
+	if !pa.Redzones { return pa.applyFreeRaw(blk,lng) }
+	return pa.applyFreeRaw(blk-1,lng+2)
+}
+
+func (pa *PageAllocator) applyFreeRaw(blk int64, lng int64) (i int, ok bool, err error) {
+	c, pos, ok := pa.BreakAddress(blk)
+	if !ok || int64(len(pa.allocators))<=c { return 0,false,nil }
+	i = int(c)
+	if pa.readOnly(i) { return i,false,pa.readOnlyChunk(c) }
+	pa.touch(i)
+	if max := int64(pa.bitmapSize)<<3 - pos; lng>max { lng = max }
+	if pa.OwnerTable!=nil && lng>0 { err = pa.clearOwners(c,pos,lng) }
+	used := bitmap.CountInUse(pa.allocators[i].buffer,pos,lng)
+	if e := bitmap.WriteFreeE(pa.writable(i),pos,lng); e!=nil { return i,false,fmt.Errorf("%w: %v",BADRANGE,e) }
+	pa.usedBlocks.Add(-used)
+	pa.checkWatermarks()
+	if pa.PunchOnFree && lng>0 { pa.punchHole(pa.MakeAddress(c,pos),lng) }
+	pa.markDirty(i,pos,lng)
+	pa.allocators[i].index.valid = false
+	pa.maint.undiscarded += lng
+	if lng>0 { pa.spaceFreed() }
+	pa.maintain()
+	return
 }
 
 func (pa *PageAllocator) doFree(blk int64, lng int64) (err error) {
-	i, pos, ok := pa.BreakAddress(blk)
-	if !ok { return }
-	if int64(len(pa.allocators))>i {
-		bitmap.FreeBitmap(pa.allocators[i].buffer,pos,lng)
-		if !pa.allocators[i].mmapped {
-			_, err = pa.WriteAt(pa.allocators[i].buffer,pa.allocators[i].rawoff)
-			if !pa.DontFsync { pa.Sync() }
-		} else if !pa.DontMsync {
-			err = pa.mmapper.FlushMap(pa.allocators[i].buffer)
-		}
+	i, ok, err := pa.applyFree(blk,lng)
+	if ok {
+		if e := pa.commitChunk(i,false); err==nil { err = e }
 	}
 	return
 }
 
-// Free's a contiguous range of blocks.
+// Frees blocks, that were not handed out to the caller.
+func (pa *PageAllocator) freeRaw(blk int64, lng int64) {
+	if i,ok,_ := pa.applyFreeRaw(blk,lng); ok { pa.commitChunk(i,false) }
+}
+
+// Free's a contiguous range of blocks. Ranges outside the data region of a chunk are rejected with a *RangeError,
+// leased ones (see Lease) with LEASED.
 func (pa *PageAllocator) FreeBlocks(blk int64, lng int64) (err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	return pa.free(blk,lng)
+}
+
+func (pa *PageAllocator) free(blk int64, lng int64) (err error) {
+	if _,_,err = pa.checkRange(blk,lng); err!=nil || lng==0 { return }
+	if err = pa.checkLeases(blk,lng); err!=nil { return }
+	if pa.quarantineOn() {
+		// Checked now, rather than on release.
+		if pa.Redzones {
+			if err = pa.checkRedzones(blk,lng); err!=nil { return }
+		}
+		pa.quarantine(blk,lng)
+		return
+	}
 	return pa.doFree(blk,lng)
 }
 
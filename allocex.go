@@ -0,0 +1,31 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+// The result of AllocateEx.
+type Allocation struct{
+	Extent
+	// Chunks added to the file for the allocation. Zero, if it fit into the existing ones.
+	Grew int
+	// The first added chunk, if Grew is positive.
+	FirstNewChunk int64
+}
+
+/*
+Allocates contiguous blocks like AllocateBlocks, and reports, whether the file grew for it.
+Fails with EXTHAUSTED, rather than returning ok = false. The growth is reported even then.
+*/
+func (pa *PageAllocator) AllocateEx(lng int64, grow bool) (a Allocation, err error) {
+	if lng>pa.RunSizeInBlocks() { return a,EXCEEDMAX }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	n := len(pa.allocators)
+	blk,ok,err := pa.allocate(lng,grow,false)
+	if a.Grew = len(pa.allocators)-n; a.Grew>0 { a.FirstNewChunk = int64(n) }
+	if err==nil && !ok { err = EXTHAUSTED }
+	if err!=nil { return }
+	a.Extent = Extent{blk,lng}
+	return
+}
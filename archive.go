@@ -0,0 +1,146 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// Not an archive written by Export, or a damaged one.
+var BADARCHIVE = errors.New("BADARCHIVE")
+
+const archiveMagic = "FAARCHV1"
+
+/*
+An archive is the magic, followed by a gzip stream of:
+	a superblock describing the format, marked clean (for files without one: the format only)
+	8 bytes, 1 if the file has a superblock
+	8 bytes, the number of chunks (little endian)
+	the prefix blocks
+	for each chunk: its bitmap, as stored in the file, then the data of its allocated blocks
+*/
+const archiveHeader = superblockSize+16
+
+/*
+Writes the file to w as a compressed archive for Import: the prefix blocks, the bitmaps, and the
+data of the allocated blocks only. Free blocks are skipped, so that sparse files stay small.
+The allocator is locked, while the archive is written. The archive records the bitmaps as they
+are in memory, with the superblock marked clean.
+*/
+func (pa *PageAllocator) Export(w io.Writer) (err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if _,err = io.WriteString(w,archiveMagic); err!=nil { return }
+	zw := gzip.NewWriter(w)
+	if err = pa.export(zw); err!=nil { return }
+	return zw.Close()
+}
+
+func (pa *PageAllocator) export(w io.Writer) (err error) {
+	sb := pa.super
+	if !pa.hasSuper {
+		sb = superblock{blockSizeLog: pa.BlockSizeLog, bitmapBlocks: pa.BitmapBlocks, prefixBlocks: pa.PrefixBlocks, encoding: uint8(pa.BitmapEncoding), features: pa.features()}
+	}
+	sb.flags &^= flagDirty
+	var hdr [archiveHeader]byte
+	copy(hdr[:],sb.encode())
+	if pa.hasSuper { hdr[superblockSize] = 1 }
+	binary.LittleEndian.PutUint64(hdr[superblockSize+8:],uint64(len(pa.allocators)))
+	if _,err = w.Write(hdr[:]); err!=nil { return }
+	
+	prefix := make([]byte,int64(pa.PrefixBlocks)<<pa.BlockSizeLog)
+	if err = pa.readZeroFilled(prefix,0); err!=nil { return }
+	if pa.hasSuper {
+		copy(prefix,hdr[:superblockSize])
+		if sb.features&featureBackup!=0 { copy(prefix[1<<pa.BlockSizeLog:],hdr[:superblockSize]) }
+	}
+	if _,err = w.Write(prefix); err!=nil { return }
+	
+	buf := make([]byte,64<<pa.BlockSizeLog)
+	for i := range pa.allocators {
+		pa.touch(i)
+		a := &pa.allocators[i]
+		if _,err = w.Write(pa.rawBitmap(a.buffer,a.rawoff,a.gen)); err!=nil { return }
+		bitmap.ForEachUsedRun(a.buffer,func(pos, lng int64) bool {
+			off := pa.MakeAddress(int64(i),pos)<<pa.BlockSizeLog
+			for end := off+lng<<pa.BlockSizeLog; off<end && err==nil; off += int64(len(buf)) {
+				if int64(len(buf))>end-off { buf = buf[:end-off] }
+				if err = pa.readZeroFilled(buf,off); err==nil { _,err = w.Write(buf) }
+			}
+			buf = buf[:cap(buf)]
+			return err==nil
+		})
+		if err!=nil { return }
+	}
+	return
+}
+
+// Reads len(b) bytes at off. What lies beyond the end of the file reads as zeros.
+func (pa *PageAllocator) readZeroFilled(b []byte, off int64) error {
+	n,err := pa.ReadAt(b,off)
+	if err==io.EOF {
+		for i := n; i<len(b); i++ { b[i] = 0 }
+		err = nil
+	}
+	return err
+}
+
+/*
+Reconstructs the file of an archive written by Export in dst, which should be empty, and opens it.
+Files with a superblock are opened with Open, the others with Init.
+*/
+func Import(r io.Reader, dst Storage) (pa *PageAllocator, err error) {
+	magic := make([]byte,len(archiveMagic))
+	if _,err = io.ReadFull(r,magic); err!=nil || string(magic)!=archiveMagic { return nil,BADARCHIVE }
+	zr,err := gzip.NewReader(r)
+	if err!=nil { return nil,fmt.Errorf("%w: %v",BADARCHIVE,err) }
+	var hdr [archiveHeader]byte
+	var sb superblock
+	if _,err = io.ReadFull(zr,hdr[:]); err!=nil || !sb.decode(hdr[:]) { return nil,BADARCHIVE }
+	pa = &PageAllocator{Storage: dst}
+	sb.format(&pa.FormatConfig)
+	if err = pa.Validate(); err!=nil { return nil,fmt.Errorf("%w: %v",BADARCHIVE,err) }
+	pa.bitmapSize = pa.bitmapBytes()
+	
+	buf := make([]byte,64<<pa.BlockSizeLog)
+	copyIn := func(off, size int64) (err error) {
+		for end := off+size; off<end && err==nil; off += int64(len(buf)) {
+			b := buf
+			if int64(len(b))>end-off { b = b[:end-off] }
+			if _,err = io.ReadFull(zr,b); err!=nil { return fmt.Errorf("%w: %v",BADARCHIVE,err) }
+			_,err = dst.WriteAt(b,off)
+		}
+		return
+	}
+	if err = copyIn(0,int64(pa.PrefixBlocks)<<pa.BlockSizeLog); err!=nil { return nil,err }
+	n := int64(binary.LittleEndian.Uint64(hdr[superblockSize+8:]))
+	bm := make([]byte,pa.bitmapSize)
+	for c := int64(0); c<n; c++ {
+		if _,err = pa.chunkEnd(c); err!=nil { return nil,BADARCHIVE }
+		rawoff := pa.MakeAddress(c,-int64(pa.BitmapBlocks))<<pa.BlockSizeLog
+		if err = copyIn(rawoff,int64(pa.rawBitmapBytes())); err!=nil { return nil,err }
+		var torn []int64
+		if torn,_,err = pa.decodeBitmap(bm,rawoff); err!=nil { return nil,err }
+		if len(torn)>0 { return nil,fmt.Errorf("%w: chunk %d: torn bitmap",BADARCHIVE,c) }
+		bitmap.ForEachUsedRun(bm,func(pos, lng int64) bool {
+			err = copyIn(pa.MakeAddress(c,pos)<<pa.BlockSizeLog,lng<<pa.BlockSizeLog)
+			return err==nil
+		})
+		if err!=nil { return nil,err }
+	}
+	// Read up to the end, so that gzip checks its checksum.
+	if k,e := zr.Read(buf[:1]); k>0 || e!=io.EOF { return nil,BADARCHIVE }
+	if err = dst.Sync(); err!=nil { return nil,err }
+	
+	if hdr[superblockSize]!=0 { return Open(dst,FormatConfig{}) }
+	pa = &PageAllocator{Storage: dst, FormatConfig: pa.FormatConfig}
+	pa.Init()
+	return
+}
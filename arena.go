@@ -0,0 +1,81 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"sync"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+var ARENACLOSED = errors.New("ARENA_CLOSED")
+
+/*
+A contiguous region, reserved from a PageAllocator, that is sub-allocated in memory.
+
+Allocations inside an Arena are neither written back nor synced. If the process crashes,
+the region as a whole remains allocated in the file.
+*/
+type Arena struct{
+	Extent
+	pa     *PageAllocator
+	mu     sync.Mutex
+	bm     []byte
+	used   int64
+	closed bool
+}
+
+// Allocates a region of blocks contiguous blocks, growing the file if needed, and returns it as an Arena.
+func (pa *PageAllocator) ReserveArena(blocks int64) (a *Arena, err error) {
+	blk,ok,err := pa.AllocateBlocks(blocks,true)
+	if err==nil && !ok { err = EXTHAUSTED }
+	if err!=nil { return }
+	a = &Arena{Extent: Extent{blk,blocks}, pa: pa, bm: make([]byte,(blocks+7)>>3)}
+	// Block the padding bits.
+	err = bitmap.WriteInUseE(a.bm,blocks,int64(len(a.bm))<<3-blocks)
+	return
+}
+
+// Allocates a series of contiguous blocks inside the arena.
+func (a *Arena) Allocate(lng int64) (blk int64, ok bool, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed { err = ARENACLOSED; return }
+	if lng>a.Len { err = EXCEEDMAX; return }
+	pos,ok,err := bitmap.FindFreeSpotE(a.bm,lng)
+	if !ok || err!=nil { return 0,false,err }
+	bitmap.WriteInUse(a.bm,pos,lng)
+	a.used += lng
+	return a.Start+pos,true,nil
+}
+
+// Frees a range of blocks inside the arena.
+func (a *Arena) Free(blk, lng int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed { return ARENACLOSED }
+	if blk<a.Start || lng<0 || blk+lng>a.End() { return OUTOFBOUNDS }
+	pos := blk-a.Start
+	a.used -= bitmap.CountInUse(a.bm,pos,lng)
+	bitmap.FreeBitmap(a.bm,pos,lng)
+	return nil
+}
+
+// Returns the number of blocks allocated inside the arena.
+func (a *Arena) Used() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.used
+}
+
+// Returns the whole region to the allocator. Allocations inside the arena become invalid.
+func (a *Arena) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed { return ARENACLOSED }
+	a.closed = true
+	a.bm = nil
+	return a.pa.FreeBlocks(a.Start,a.Len)
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+// The kind of an audited operation.
+type AuditOp uint8
+
+const (
+	AuditAllocate AuditOp = iota+1
+	AuditFree
+)
+
+// An entry of the audit log.
+type AuditRecord struct{
+	Time  time.Time
+	Op    AuditOp
+	Extent
+	// The owner given to AllocateOwned or AllocateTemp. Zero otherwise.
+	Owner OwnerTag
+}
+
+/*
+Layout of an audit record (little endian):
+	0  time, in unix nanoseconds
+	8  operation
+	16 first block
+	24 number of blocks
+	32 owner tag
+	40 sequence number
+	44 crc32 of the preceding bytes
+*/
+const auditRecord = 48
+
+func (r *AuditRecord) encode(b []byte, seq uint32) {
+	binary.LittleEndian.PutUint64(b,uint64(r.Time.UnixNano()))
+	for i := 8; i<16; i++ { b[i] = 0 }
+	b[8] = byte(r.Op)
+	binary.LittleEndian.PutUint64(b[16:],uint64(r.Start))
+	binary.LittleEndian.PutUint64(b[24:],uint64(r.Len))
+	binary.LittleEndian.PutUint64(b[32:],uint64(r.Owner))
+	binary.LittleEndian.PutUint32(b[40:],seq)
+	binary.LittleEndian.PutUint32(b[44:],crc32.ChecksumIEEE(b[:44]))
+}
+
+func (r *AuditRecord) decode(b []byte) (seq uint32, ok bool) {
+	if binary.LittleEndian.Uint32(b[44:])!=crc32.ChecksumIEEE(b[:44]) { return }
+	r.Time = time.Unix(0,int64(binary.LittleEndian.Uint64(b)))
+	r.Op = AuditOp(b[8])
+	r.Start = int64(binary.LittleEndian.Uint64(b[16:]))
+	r.Len = int64(binary.LittleEndian.Uint64(b[24:]))
+	r.Owner = OwnerTag(binary.LittleEndian.Uint64(b[32:]))
+	return binary.LittleEndian.Uint32(b[40:]),true
+}
+
+/*
+An append-only log of allocations and frees, with a checksum per record (see PageAllocator.Audit).
+
+If MaxSize is set, the log is rotated before it grows beyond: Rotate is called with the
+full Storage and returns the next one. Write errors are sticky and returned by Err().
+*/
+type AuditLog struct{
+	MaxSize int64
+	Rotate  func(full Storage) (Storage, error)
+	
+	mu  sync.Mutex
+	s   Storage
+	off int64
+	seq uint32
+	err error
+}
+
+// Opens an audit log. New records are appended after the last valid one.
+func OpenAuditLog(s Storage) (l *AuditLog, err error) {
+	l = &AuditLog{s: s}
+	err = scanAudit(s,func(off int64, seq uint32, r AuditRecord) bool {
+		l.off,l.seq = off+auditRecord,seq+1
+		return true
+	})
+	return
+}
+
+// Calls fn for each record of s, until the first torn or corrupt one, or until fn returns false.
+func scanAudit(s Storage, fn func(off int64, seq uint32, r AuditRecord) bool) error {
+	buf := make([]byte,auditRecord)
+	for off := int64(0); ; off += auditRecord {
+		n,err := s.ReadAt(buf,off)
+		if n<auditRecord {
+			if err==io.EOF { err = nil }
+			return err
+		}
+		var r AuditRecord
+		seq,ok := r.decode(buf)
+		if !ok || seq!=uint32(off/auditRecord) { return nil }
+		if !fn(off,seq,r) { return nil }
+	}
+}
+
+// Reads the records of an audit log, in order, until fn returns false.
+func ReadAuditLog(s Storage, fn func(r AuditRecord) bool) error {
+	return scanAudit(s,func(_ int64, _ uint32, r AuditRecord) bool { return fn(r) })
+}
+
+// Appends a record.
+func (l *AuditLog) Append(r AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err!=nil { return l.err }
+	if l.MaxSize>0 && l.off+auditRecord>l.MaxSize && l.Rotate!=nil {
+		var next Storage
+		if next,l.err = l.Rotate(l.s); l.err!=nil { return l.err }
+		l.s,l.off,l.seq = next,0,0
+	}
+	var b [auditRecord]byte
+	r.encode(b[:],l.seq)
+	if _,l.err = l.s.WriteAt(b[:],l.off); l.err!=nil { return l.err }
+	l.off += auditRecord
+	l.seq++
+	return nil
+}
+
+// Returns the first write error.
+func (l *AuditLog) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *AuditLog) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.s.Sync()
+}
+
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.s.Close()
+}
+
+func (pa *PageAllocator) audit(op AuditOp, blk, lng int64, owner OwnerTag) error {
+	if pa.Audit==nil { return nil }
+	return pa.Audit.Append(AuditRecord{time.Now(),op,Extent{blk,lng},owner})
+}
@@ -10,6 +10,11 @@ The last bit of a byte is assumed to be the LSB.
 */
 package bitmap
 
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
 
 func findFreeSpot8(bm []byte, lng uint) (pos int64,ok bool) {
 	B := byte(0xff<<(8-lng))
@@ -26,8 +31,9 @@ func findFreeSpot8(bm []byte, lng uint) (pos int64,ok bool) {
 		if i>=lng {
 			return int64(j<<3) | int64(8-i) , true
 		} else if i>0 && j<len(bm)-1 {
+			// The other lng-i slots are the first ones of the next byte.
 			b = B
-			b <<= (8-i)
+			b <<= i
 			c = bm[j+1]
 			if (c & b)==0 {
 				return int64(j<<3) | int64(8-i) , true
@@ -53,7 +59,7 @@ func matchAligned(bm []byte, bipos int64, lng int64) bool {
 	return false
 }
 
-// Finds a range of free slots inside of a bitmap.
+// Finds a range of free slots inside of a bitmap. panics if lng<0. See FindFreeSpotE.
 func FindFreeSpot(bm []byte, lng int64) (int64,bool) {
 	if lng<0 { panic("illegal arg") }
 	if lng<=8 {
@@ -78,7 +84,7 @@ func FindFreeSpot(bm []byte, lng int64) (int64,bool) {
 }
 
 // Allocates a range of slots inside of a bitmap.
-// panics if pos+len > len(bm)*8
+// panics if pos+len > len(bm)*8. See WriteInUseE.
 func WriteInUse(bm []byte, pos, lng int64) {
 	if pos<0 || lng<0 { panic("illegal arg") }
 	n := pos&7
@@ -109,7 +115,7 @@ func WriteInUse(bm []byte, pos, lng int64) {
 }
 
 // Frees a range of slots inside of a bitmap.
-// panics if pos+len > len(bm)*8
+// panics if pos+len > len(bm)*8. See WriteFreeE.
 func WriteFree(bm []byte, pos, lng int64) {
 	if pos<0 || lng<0 { panic("illegal arg") }
 	n := pos&7
@@ -153,3 +159,218 @@ func FreeBitmap(bm []byte, pos, lng int64) {
 	if lng > 0 { WriteFree(bm,pos,lng) }
 }
 
+
+// A range of slots inside of a bitmap.
+type Extent struct{
+	Pos, Len int64
+}
+
+// Calls fn for every maximal run of free slots, in ascending order.
+// Stops, if fn returns false.
+func ForEachFreeRun(bm []byte, fn func(pos, lng int64) bool) {
+	forEachRun(bm,0,fn)
+}
+
+// Calls fn for every maximal run of occupied slots, in ascending order.
+// Stops, if fn returns false.
+func ForEachUsedRun(bm []byte, fn func(pos, lng int64) bool) {
+	forEachRun(bm,0xff,fn)
+}
+
+func forEachRun(bm []byte, inv byte, fn func(pos, lng int64) bool) {
+	start := int64(-1)
+	for j,c := range bm {
+		c ^= inv
+		base := int64(j)<<3
+		if c==0 {
+			if start<0 { start = base }
+			continue
+		}
+		if c==0xff {
+			if start>=0 {
+				if !fn(start,base-start) { return }
+				start = -1
+			}
+			continue
+		}
+		for i := int64(0); i<8; i++ {
+			if (c & byte(0x80>>uint(i)))==0 {
+				if start<0 { start = base+i }
+			} else if start>=0 {
+				if !fn(start,base+i-start) { return }
+				start = -1
+			}
+		}
+	}
+	if start>=0 { fn(start,(int64(len(bm))<<3)-start) }
+}
+
+// Returns up to k of the largest free runs, largest first.
+// Runs of equal length are ordered by position.
+func LargestFreeRuns(bm []byte, k int) (runs []Extent) {
+	if k<=0 { return }
+	runs = make([]Extent,0,k)
+	ForEachFreeRun(bm,func(pos, lng int64) bool {
+		if len(runs)==k && runs[k-1].Len>=lng { return true }
+		if len(runs)<k { runs = append(runs,Extent{}) }
+		i := len(runs)-1
+		for ; i>0 && runs[i-1].Len<lng; i-- { runs[i] = runs[i-1] }
+		runs[i] = Extent{pos,lng}
+		return true
+	})
+	return
+}
+
+// Counts the occupied slots in the range [pos,pos+lng).
+func CountInUse(bm []byte, pos, lng int64) (n int64) {
+	if pos<0 || lng<=0 { return }
+	end := pos+lng
+	for pos<end && pos&7!=0 {
+		if bm[pos>>3]&byte(0x80>>uint(pos&7))!=0 { n++ }
+		pos++
+	}
+	for pos+8<=end {
+		n += int64(bits.OnesCount8(bm[pos>>3]))
+		pos += 8
+	}
+	for pos<end {
+		if bm[pos>>3]&byte(0x80>>uint(pos&7))!=0 { n++ }
+		pos++
+	}
+	return
+}
+
+/*
+Describes a foreign bitmap representation. The zero value is the native one:
+1-bits denote occupied slots, the first slot of a byte is its MSB.
+*/
+type Encoding uint8
+
+const (
+	// 1-bits denote free slots.
+	Invert Encoding = 1<<iota
+	
+	// The first slot of a byte is its LSB, as in ext2 block bitmaps.
+	LSBFirst
+	
+	encodingMask = Invert|LSBFirst
+)
+
+// Reports, whether e only consists of known flags.
+func (e Encoding) Valid() bool { return e&^encodingMask==0 }
+
+// Converts bm from the native representation to e, in place.
+func (e Encoding) Encode(bm []byte) { e.convert(bm) }
+
+// Converts bm from e to the native representation, in place.
+func (e Encoding) Decode(bm []byte) { e.convert(bm) }
+
+// Both conversions are involutions, so they are their own inverse.
+func (e Encoding) convert(bm []byte) {
+	if e&encodingMask==0 { return }
+	for i,c := range bm {
+		if e&LSBFirst!=0 { c = bits.Reverse8(c) }
+		if e&Invert!=0 { c = ^c }
+		bm[i] = c
+	}
+}
+
+// Copies src, which is in the encoding from, to dst in the encoding to. Returns the number of bytes copied.
+func Convert(dst, src []byte, from, to Encoding) int {
+	n := copy(dst,src)
+	(from^to).convert(dst[:n])
+	return n
+}
+
+// Sorts a copy of the extents by position and merges overlapping and adjacent ones.
+func coalesce(l []Extent) []Extent {
+	l = append([]Extent(nil),l...)
+	sort.Slice(l,func(i, j int) bool { return l[i].Pos<l[j].Pos })
+	out := l[:0]
+	for _,e := range l {
+		if e.Len<=0 { continue }
+		if n := len(out); n>0 && e.Pos<=out[n-1].Pos+out[n-1].Len {
+			if end := e.Pos+e.Len; end>out[n-1].Pos+out[n-1].Len { out[n-1].Len = end-out[n-1].Pos }
+			continue
+		}
+		out = append(out,e)
+	}
+	return out
+}
+
+var ones = [64]byte{
+	0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,
+	0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,
+	0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,
+	0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,
+}
+var zeros [64]byte
+
+// Sets the slots of the extents, with whole bytes copied from fill in between the edges.
+func stampExtents(bm []byte, l []Extent, fill *[64]byte, stamp func(bm []byte, pos, lng int64)) {
+	for _,e := range coalesce(l) {
+		pos,end := e.Pos,e.Pos+e.Len
+		first,last := (pos+7)&^7,end&^7
+		if first>=last {
+			stamp(bm,pos,e.Len)
+			continue
+		}
+		if pos<first { stamp(bm,pos,first-pos) }
+		for b := bm[first>>3:last>>3]; len(b)>0; b = b[copy(b,fill[:]):] {}
+		if last<end { stamp(bm,last,end-last) }
+	}
+}
+
+/*
+Marks the slots of all extents as occupied. The extents may overlap and come in any order:
+they are sorted and merged first, so that every byte is written once.
+panics if an extent exceeds the bitmap.
+*/
+func WriteInUseExtents(bm []byte, l []Extent) { stampExtents(bm,l,&ones,WriteInUse) }
+
+// Marks the slots of all extents as free, like WriteInUseExtents.
+func WriteFreeExtents(bm []byte, l []Extent) { stampExtents(bm,l,&zeros,WriteFree) }
+
+// Reports, whether the bitmaps have the same length and contents. Compares 8 bytes at a time.
+func Equal(a, b []byte) bool {
+	if len(a)!=len(b) { return false }
+	for len(a)>=8 {
+		if binary.LittleEndian.Uint64(a)!=binary.LittleEndian.Uint64(b) { return false }
+		a,b = a[8:],b[8:]
+	}
+	for i := range a {
+		if a[i]!=b[i] { return false }
+	}
+	return true
+}
+
+/*
+Returns the maximal ranges of slots, in which a and b disagree, in ascending order.
+If their lengths differ, the shorter one is taken as padded with free slots.
+*/
+func Diff(a, b []byte) (d []Extent) {
+	if len(a)<len(b) { a,b = b,a }
+	at := func(j int) byte {
+		if j<len(b) { return a[j]^b[j] }
+		return a[j]
+	}
+	start := int64(-1)
+	for j := 0; j<len(a); j++ {
+		if start<0 && j+8<=len(b) && binary.LittleEndian.Uint64(a[j:])==binary.LittleEndian.Uint64(b[j:]) {
+			j += 7
+			continue
+		}
+		x := at(j)
+		base := int64(j)<<3
+		for i := int64(0); i<8; i++ {
+			if x&byte(0x80>>uint(i))!=0 {
+				if start<0 { start = base+i }
+			} else if start>=0 {
+				d = append(d,Extent{start,base+i-start})
+				start = -1
+			}
+		}
+	}
+	if start>=0 { d = append(d,Extent{start,(int64(len(a))<<3)-start}) }
+	return
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package bitmap
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+// The first position of lng free slots, slot by slot.
+func naiveFreeSpot(bm []byte, lng int64) (int64, bool) {
+	for pos := int64(0); pos+lng<=int64(len(bm))<<3; pos++ {
+		if CountInUse(bm,pos,lng)==0 { return pos,true }
+	}
+	return 0,false
+}
+
+// A free run, that starts in the last slots of a byte and continues into the next one.
+func TestFindFreeSpotStraddle(t *testing.T) {
+	for _,c := range []struct{
+		bm  []byte
+		lng int64
+		pos int64
+		ok  bool
+	}{
+		{[]byte{0xfc,0x3f},4,6,true},
+		{[]byte{0xfc,0xff},4,0,false},
+		{[]byte{0xfc,0x7f},4,0,false},
+		{[]byte{0xfe,0x00},8,7,true},
+		{[]byte{0xfe,0x01},8,7,true},
+		{[]byte{0xfe,0x03},8,0,false},
+		{[]byte{0xff,0xfe,0x3f},3,15,true},
+	}{
+		pos,ok := FindFreeSpot(c.bm,c.lng)
+		if ok!=c.ok || (ok && pos!=c.pos) { t.Errorf("FindFreeSpot(%x,%d) = %d,%v, want %d,%v",c.bm,c.lng,pos,ok,c.pos,c.ok) }
+	}
+}
+
+func TestFindFreeSpotSmall(t *testing.T) {
+	bm := make([]byte,2)
+	for v := 0; v<1<<16; v++ {
+		bm[0],bm[1] = byte(v>>8),byte(v)
+		for lng := int64(1); lng<=8; lng++ {
+			pos,ok := FindFreeSpot(bm,lng)
+			want,wok := naiveFreeSpot(bm,lng)
+			if ok!=wok || (ok && CountInUse(bm,pos,lng)!=0) { t.Fatalf("FindFreeSpot(%x,%d) = %d,%v, want %d,%v",bm,lng,pos,ok,want,wok) }
+		}
+	}
+}
+
+// The ranges, in which a and b disagree, slot by slot. The shorter one is padded with free slots.
+func naiveDiff(a, b []byte) (d []Extent) {
+	n := len(a)
+	if len(b)>n { n = len(b) }
+	bit := func(bm []byte, i int64) bool { return i>>3<int64(len(bm)) && bm[i>>3]&byte(0x80>>uint(i&7))!=0 }
+	start := int64(-1)
+	for i := int64(0); i<int64(n)<<3; i++ {
+		if bit(a,i)!=bit(b,i) {
+			if start<0 { start = i }
+		} else if start>=0 {
+			d = append(d,Extent{start,i-start})
+			start = -1
+		}
+	}
+	if start>=0 { d = append(d,Extent{start,int64(n)<<3-start}) }
+	return
+}
+
+func naiveEqual(a, b []byte) bool {
+	return len(a)==len(b) && len(naiveDiff(a,b))==0
+}
+
+func sameExtents(a, b []Extent) bool {
+	if len(a)!=len(b) { return false }
+	for i := range a {
+		if a[i]!=b[i] { return false }
+	}
+	return true
+}
+
+func TestEqualDiff(t *testing.T) {
+	for _,c := range []struct{
+		a, b []byte
+		d    []Extent
+	}{
+		{nil,nil,nil},
+		{[]byte{},nil,nil},
+		{[]byte{0},nil,nil},
+		{[]byte{0x80},nil,[]Extent{{0,1}}},
+		{nil,[]byte{0,0x01},[]Extent{{15,1}}},
+		// Starts and ends inside a byte.
+		{[]byte{0x3c},[]byte{0},[]Extent{{2,4}}},
+		// Crosses a byte boundary, unaligned on both ends.
+		{[]byte{0x07,0xe0},[]byte{0,0},[]Extent{{5,6}}},
+		// Crosses the 8-byte words.
+		{[]byte{0,0,0,0,0,0,0,0x01,0x80,0},make([]byte,10),[]Extent{{63,2}}},
+		{[]byte{0,0,0,0,0,0,0,0,0,0x40},make([]byte,10),[]Extent{{73,1}}},
+		{[]byte{0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff},[]byte{0xff,0xff,0xff,0xff,0xff,0xff,0xff,0xff},[]Extent{{64,8}}},
+		{[]byte{0xaa},[]byte{0x55},[]Extent{{0,8}}},
+		{[]byte{0xa5},[]byte{0xa4,0xff},[]Extent{{7,9}}},
+	}{
+		if d := Diff(c.a,c.b); !sameExtents(d,c.d) { t.Errorf("Diff(%x,%x) = %v, want %v",c.a,c.b,d,c.d) }
+		if d := Diff(c.b,c.a); !sameExtents(d,c.d) { t.Errorf("Diff(%x,%x) = %v, want %v",c.b,c.a,d,c.d) }
+		if eq := Equal(c.a,c.b); eq!=naiveEqual(c.a,c.b) { t.Errorf("Equal(%x,%x) = %v",c.a,c.b,eq) }
+	}
+}
+
+// Random bitmaps at unaligned offsets of a buffer, of all lengths up to 3 words, against the naive reference.
+func TestEqualDiffRandom(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1,2))
+	bufA,bufB := make([]byte,40),make([]byte,40)
+	for k := 0; k<20000; k++ {
+		for i := range bufA { bufA[i] = byte(rnd.Uint32()) }
+		// Mostly equal, with a few flipped slots.
+		copy(bufB,bufA)
+		for n := rnd.IntN(4); n>0; n-- { bufB[rnd.IntN(len(bufB))] ^= byte(1<<rnd.IntN(8)) }
+		oa,ob := rnd.IntN(8),rnd.IntN(8)
+		la := rnd.IntN(25)
+		lb := la
+		if rnd.IntN(4)==0 { lb = rnd.IntN(25) }
+		a,b := bufA[oa:oa+la],bufB[ob:ob+lb]
+		if oa==ob && rnd.IntN(2)==0 { b = bufB[oa:oa+lb] }
+		if d,want := Diff(a,b),naiveDiff(a,b); !sameExtents(d,want) { t.Fatalf("Diff(%x,%x) = %v, want %v",a,b,d,want) }
+		if eq := Equal(a,b); eq!=naiveEqual(a,b) { t.Fatalf("Equal(%x,%x) = %v",a,b,eq) }
+	}
+}
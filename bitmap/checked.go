@@ -0,0 +1,44 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package bitmap
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The slots are out of the range of the bitmap, or the length is negative. See WriteInUseE.
+var OUTOFRANGE = errors.New("OUT_OF_RANGE")
+
+func checkRange(bm []byte, pos, lng int64) error {
+	if pos<0 || lng<0 || pos>int64(len(bm))<<3-lng {
+		return fmt.Errorf("%w: slots %d+%d of %d",OUTOFRANGE,pos,lng,int64(len(bm))<<3)
+	}
+	return nil
+}
+
+/*
+Like WriteInUse, but fails with OUTOFRANGE instead of panicking, if the range exceeds the bitmap.
+For ranges, that are not checked before, like those read from a file.
+*/
+func WriteInUseE(bm []byte, pos, lng int64) error {
+	if err := checkRange(bm,pos,lng); err!=nil || lng==0 { return err }
+	WriteInUse(bm,pos,lng)
+	return nil
+}
+
+// Like WriteFree, but fails with OUTOFRANGE instead of panicking, if the range exceeds the bitmap.
+func WriteFreeE(bm []byte, pos, lng int64) error {
+	if err := checkRange(bm,pos,lng); err!=nil || lng==0 { return err }
+	WriteFree(bm,pos,lng)
+	return nil
+}
+
+// Like FindFreeSpot, but fails with OUTOFRANGE instead of panicking, if lng is negative.
+func FindFreeSpotE(bm []byte, lng int64) (pos int64, ok bool, err error) {
+	if lng<0 { return 0,false,fmt.Errorf("%w: length %d",OUTOFRANGE,lng) }
+	pos,ok = FindFreeSpot(bm,lng)
+	return
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package bitmap
+
+import (
+	"hash/crc32"
+	"io"
+)
+
+const defaultWindow = 1<<16
+
+// The result of Scan.
+type Summary struct{
+	// Slots scanned, and the occupied ones among them.
+	Slots, Used int64
+	FreeRuns, UsedRuns int64
+	LargestFreeRun int64
+	// crc32 (IEEE) of the bitmap bytes read.
+	CRC32 uint32
+}
+
+/*
+Reads a bitmap from r, window bytes at a time, and calls fn for every maximal run of free
+or occupied slots, in ascending order. Runs spanning windows are reported once.
+Stops, if fn returns false; the Summary then covers the slots up to the end of that run.
+fn may be nil. window defaults to 64 KiB.
+
+The bitmap is never held in memory as a whole, so that bitmaps beyond a memory budget can be inspected.
+*/
+func Scan(r io.Reader, window int, fn func(e Extent, used bool) bool) (s Summary, err error) {
+	if window<=0 { window = defaultWindow }
+	buf := make([]byte,window)
+	start,used := int64(0),false
+	pos := int64(0)
+	stop := false
+	// Reports the current run, which ends at pos.
+	end := func() {
+		l := pos-start
+		if l==0 { return }
+		if used {
+			s.UsedRuns++
+			s.Used += l
+		} else {
+			s.FreeRuns++
+			if l>s.LargestFreeRun { s.LargestFreeRun = l }
+		}
+		if fn!=nil && !fn(Extent{start,l},used) { stop = true }
+		start = pos
+	}
+	flip := func(u bool) {
+		if u==used || stop { return }
+		end()
+		used = u
+	}
+	for !stop {
+		n,e := io.ReadFull(r,buf)
+		s.CRC32 = crc32.Update(s.CRC32,crc32.IEEETable,buf[:n])
+		for _,c := range buf[:n] {
+			switch c {
+			case 0x00, 0xff:
+				flip(c!=0)
+				pos += 8
+			default:
+				for i := uint(0); i<8; i++ {
+					flip(c&(0x80>>i)!=0)
+					pos++
+				}
+			}
+			if stop { break }
+		}
+		if stop { break }
+		if e==io.EOF || e==io.ErrUnexpectedEOF { break }
+		if e!=nil { return s,e }
+	}
+	if !stop { end() }
+	s.Slots = start
+	return
+}
+
+/*
+Writes a bitmap given as a sequence of runs to w, window bytes at a time.
+Call Close to write the last, partial window. The slots of the last byte beyond the runs are free.
+*/
+type RunWriter struct{
+	w     io.Writer
+	buf   []byte
+	// Slots in buf.
+	n     int64
+	total int64
+	err   error
+}
+
+// Creates a RunWriter. window defaults to 64 KiB.
+func NewRunWriter(w io.Writer, window int) *RunWriter {
+	if window<=0 { window = defaultWindow }
+	return &RunWriter{w: w, buf: make([]byte,window)}
+}
+
+// Appends lng slots, that are occupied or free.
+func (rw *RunWriter) WriteRun(lng int64, used bool) error {
+	if lng<0 { panic("illegal arg") }
+	size := int64(len(rw.buf))<<3
+	for lng>0 && rw.err==nil {
+		k := size-rw.n
+		if k>lng { k = lng }
+		if used { WriteInUse(rw.buf,rw.n,k) }
+		rw.n += k
+		rw.total += k
+		lng -= k
+		if rw.n==size { rw.flush() }
+	}
+	return rw.err
+}
+
+// Returns the number of slots written.
+func (rw *RunWriter) Slots() int64 { return rw.total }
+
+func (rw *RunWriter) flush() {
+	if rw.n==0 || rw.err!=nil { return }
+	b := rw.buf[:(rw.n+7)>>3]
+	_,rw.err = rw.w.Write(b)
+	for i := range b { b[i] = 0 }
+	rw.n = 0
+}
+
+// Writes the buffered slots. It doesn't close the underlying writer.
+func (rw *RunWriter) Close() error {
+	rw.flush()
+	return rw.err
+}
+
+type encodingReader struct{
+	r io.Reader
+	e Encoding
+}
+
+func (er encodingReader) Read(p []byte) (n int, err error) {
+	n,err = er.r.Read(p)
+	er.e.Decode(p[:n])
+	return
+}
+
+// Returns a reader, that decodes the bitmap read from r, which is in the encoding e, to the native representation.
+func (e Encoding) Reader(r io.Reader) io.Reader {
+	if e&encodingMask==0 { return r }
+	return encodingReader{r,e}
+}
+
+type encodingWriter struct{
+	w   io.Writer
+	e   Encoding
+	buf []byte
+}
+
+func (ew *encodingWriter) Write(p []byte) (n int, err error) {
+	for len(p)>0 {
+		k := copy(ew.buf,p)
+		ew.e.Encode(ew.buf[:k])
+		m,err := ew.w.Write(ew.buf[:k])
+		n += m
+		if err!=nil { return n,err }
+		p = p[k:]
+	}
+	return
+}
+
+// Returns a writer, that encodes the native bitmap written to it in the encoding e and passes it to w.
+func (e Encoding) Writer(w io.Writer) io.Writer {
+	if e&encodingMask==0 { return w }
+	return &encodingWriter{w: w, e: e, buf: make([]byte,4096)}
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+// Internal fragmentation of the allocations made with AllocateBytes.
+type WasteStats struct{
+	// Live allocations.
+	Allocations int64
+	
+	// Bytes requested by the callers, and the bytes of the blocks handed out for them.
+	RequestedBytes, AllocatedBytes int64
+}
+
+// Returns the bytes lost to rounding up to whole blocks.
+func (w WasteStats) Waste() int64 { return w.AllocatedBytes-w.RequestedBytes }
+
+// Returns the waste as a fraction of the allocated bytes.
+func (w WasteStats) Ratio() float64 {
+	if w.AllocatedBytes==0 { return 0 }
+	return float64(w.Waste())/float64(w.AllocatedBytes)
+}
+
+// Returns the number of blocks, that hold size bytes.
+func (f *FormatConfig) BlocksFor(size int64) int64 {
+	return (size+int64(f.BlockSize())-1)>>f.BlockSizeLog
+}
+
+/*
+Allocates contiguous blocks for size bytes, like AllocateBlocks, and accounts the rounding in WasteStats.
+Free the extent with FreeBytes.
+
+The statistics are kept in memory only. They start at zero, whenever the allocator is opened.
+*/
+func (pa *PageAllocator) AllocateBytes(size int64, grow bool) (e Extent, err error) {
+	lng := pa.BlocksFor(size)
+	blk,ok,err := pa.AllocateBlocks(lng,grow)
+	if err==nil && !ok { err = EXTHAUSTED }
+	if err!=nil { return }
+	pa.mu.Lock()
+	pa.waste.Allocations++
+	pa.waste.RequestedBytes += size
+	pa.waste.AllocatedBytes += lng<<pa.BlockSizeLog
+	pa.mu.Unlock()
+	return Extent{blk,lng},nil
+}
+
+// Frees an extent allocated by AllocateBytes for size bytes.
+func (pa *PageAllocator) FreeBytes(blk int64, size int64) (err error) {
+	lng := pa.BlocksFor(size)
+	if err = pa.FreeBlocks(blk,lng); err!=nil { return }
+	pa.mu.Lock()
+	pa.waste.Allocations--
+	pa.waste.RequestedBytes -= size
+	pa.waste.AllocatedBytes -= lng<<pa.BlockSizeLog
+	pa.mu.Unlock()
+	return
+}
+
+// Returns the internal fragmentation statistics.
+func (pa *PageAllocator) WasteStats() WasteStats {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	return pa.waste
+}
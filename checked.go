@@ -0,0 +1,38 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"math"
+)
+
+// An address or file offset doesn't fit into an int64.
+var OVERFLOW = errors.New("OVERFLOW")
+
+// Like MakeAddress, but fails with OVERFLOW instead of wrapping around.
+func (f *FormatConfig) MakeAddressChecked(chunk, pos int64) (blk int64, err error) {
+	if chunk<0 { return 0,OUTOFBOUNDS }
+	base := int64(f.PrefixBlocks)+int64(f.BitmapBlocks)
+	chunksiz := f.ChunkSizeInBlocks()
+	if chunk>(math.MaxInt64-base)/chunksiz { return 0,OVERFLOW }
+	blk = base+chunk*chunksiz
+	if pos>0 && blk>math.MaxInt64-pos { return 0,OVERFLOW }
+	return blk+pos,nil
+}
+
+// Returns the file offset of the block, or OVERFLOW.
+func (f *FormatConfig) BlockOffset(blk int64) (off int64, err error) {
+	if blk<0 { return 0,OUTOFBOUNDS }
+	if blk>math.MaxInt64>>f.BlockSizeLog { return 0,OVERFLOW }
+	return blk<<f.BlockSizeLog,nil
+}
+
+// Returns the file offset just after the chunk, or OVERFLOW, if the chunk can't exist.
+func (f *FormatConfig) chunkEnd(chunk int64) (off int64, err error) {
+	blk,err := f.MakeAddressChecked(chunk,f.RunSizeInBlocks())
+	if err!=nil { return }
+	return f.BlockOffset(blk)
+}
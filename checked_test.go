@@ -0,0 +1,86 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMakeAddressChecked(t *testing.T) {
+	f := NewFormatConfig(9)
+	base := int64(f.PrefixBlocks)+int64(f.BitmapBlocks)
+	size := f.ChunkSizeInBlocks()
+	last := (math.MaxInt64-base)/size
+	top := base+last*size
+	for _,c := range []struct{
+		chunk, pos, blk int64
+		err error
+	}{
+		{0,0,base,nil},
+		{1,5,base+size+5,nil},
+		{0,-1,base-1,nil},
+		{-1,0,0,OUTOFBOUNDS},
+		{math.MinInt64,0,0,OUTOFBOUNDS},
+		{last,0,top,nil},
+		{last,math.MaxInt64-top,math.MaxInt64,nil},
+		{last,math.MaxInt64-top-1,math.MaxInt64-1,nil},
+		{last,math.MaxInt64-top+1,0,OVERFLOW},
+		{last,math.MaxInt64,0,OVERFLOW},
+		{last+1,0,0,OVERFLOW},
+		{math.MaxInt64-1,0,0,OVERFLOW},
+		{math.MaxInt64,0,0,OVERFLOW},
+	}{
+		blk,err := f.MakeAddressChecked(c.chunk,c.pos)
+		if err!=c.err || (err==nil && blk!=c.blk) { t.Errorf("MakeAddressChecked(%d,%d) = %d,%v, want %d,%v",c.chunk,c.pos,blk,err,c.blk,c.err) }
+		if err==nil && blk!=f.MakeAddress(c.chunk,c.pos) { t.Errorf("MakeAddressChecked(%d,%d) = %d, MakeAddress %d",c.chunk,c.pos,blk,f.MakeAddress(c.chunk,c.pos)) }
+	}
+}
+
+func TestBlockOffset(t *testing.T) {
+	for _,c := range []struct{
+		log uint8
+		blk, off int64
+		err error
+	}{
+		{9,0,0,nil},
+		{9,3,3<<9,nil},
+		{9,math.MaxInt64>>9,(math.MaxInt64>>9)<<9,nil},
+		{9,math.MaxInt64>>9+1,0,OVERFLOW},
+		{9,math.MaxInt64-1,0,OVERFLOW},
+		{9,math.MaxInt64,0,OVERFLOW},
+		{9,-1,0,OUTOFBOUNDS},
+		{9,math.MinInt64,0,OUTOFBOUNDS},
+		{0,math.MaxInt64-1,math.MaxInt64-1,nil},
+		{0,math.MaxInt64,math.MaxInt64,nil},
+		{1,math.MaxInt64>>1,math.MaxInt64-1,nil},
+		{1,math.MaxInt64>>1+1,0,OVERFLOW},
+		{62,1,1<<62,nil},
+		{62,2,0,OVERFLOW},
+	}{
+		f := FormatConfig{BlockSizeLog: c.log}
+		off,err := f.BlockOffset(c.blk)
+		if err!=c.err || off!=c.off { t.Errorf("2^%d: BlockOffset(%d) = %d,%v, want %d,%v",c.log,c.blk,off,err,c.off,c.err) }
+	}
+}
+
+func TestChunkEnd(t *testing.T) {
+	f := NewFormatConfig(9)
+	size := f.ChunkSizeInBlocks()
+	off,err := f.chunkEnd(0)
+	if want := f.MakeAddress(1,-int64(f.BitmapBlocks))<<f.BlockSizeLog; err!=nil || off!=want { t.Errorf("chunkEnd(0) = %d,%v, want %d",off,err,want) }
+	last := (math.MaxInt64>>f.BlockSizeLog)/size
+	for _,c := range []struct{
+		chunk int64
+		err error
+	}{
+		{last-2,nil},
+		{last+1,OVERFLOW},
+		{math.MaxInt64,OVERFLOW},
+		{-1,OUTOFBOUNDS},
+	}{
+		if _,err := f.chunkEnd(c.chunk); err!=c.err { t.Errorf("chunkEnd(%d): %v, want %v",c.chunk,err,c.err) }
+	}
+}
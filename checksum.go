@@ -0,0 +1,133 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+)
+
+/*
+The algorithm of the checksums in the file: those of the bitmap trailers (see Trailers),
+which the scrubber checks, of the doublewrite area and of the superblock.
+It is a format feature, recorded in the superblock. All checksums are stored in 32 bits.
+*/
+type Checksum uint8
+
+const (
+	// CRC-32 with the IEEE polynomial. The default, and the checksum of files written before the choice existed.
+	ChecksumCRC32 Checksum = iota
+	
+	// CRC-32C (Castagnoli). Computed with the CRC32 instructions on amd64 (SSE4.2) and arm64 (ARMv8).
+	ChecksumCRC32C
+	
+	// The lower 32 bits of xxHash64 with seed 0. Fast on any CPU.
+	ChecksumXXH64
+	
+	// No checksums: the trailers and the doublewrite area are taken as they are.
+	// The superblock, which records the choice, still uses CRC32.
+	ChecksumNone
+	
+	numChecksums
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (c Checksum) String() string {
+	switch c {
+	case ChecksumCRC32: return "crc32"
+	case ChecksumCRC32C: return "crc32c"
+	case ChecksumXXH64: return "xxh64"
+	case ChecksumNone: return "none"
+	}
+	return fmt.Sprintf("Checksum(%d)",uint8(c))
+}
+
+// Reports, whether c is a known algorithm.
+func (c Checksum) Valid() bool { return c<numChecksums }
+
+// Returns the checksum of b.
+func (c Checksum) Sum(b []byte) uint32 {
+	switch c {
+	case ChecksumCRC32C: return crc32.Checksum(b,castagnoli)
+	case ChecksumXXH64: return uint32(xxh64(b))
+	case ChecksumNone: return 0
+	}
+	return crc32.ChecksumIEEE(b)
+}
+
+// Reports, whether sum is the checksum of b. Always true for ChecksumNone.
+func (c Checksum) Check(b []byte, sum uint32) bool {
+	return c==ChecksumNone || c.Sum(b)==sum
+}
+
+// The superblock is never left without a checksum.
+func (c Checksum) super() Checksum {
+	if c==ChecksumNone { return ChecksumCRC32 }
+	return c
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc, v uint64) uint64 {
+	acc += v*xxPrime2
+	return bits.RotateLeft64(acc,31)*xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0,v)
+	return acc*xxPrime1+xxPrime4
+}
+
+// xxHash64 of b, with seed 0.
+func xxh64(b []byte) uint64 {
+	n := uint64(len(b))
+	var h uint64
+	if len(b)>=32 {
+		v1,v2,v3,v4 := xxPrime1,xxPrime2,uint64(0),^xxPrime1+1
+		v1 += xxPrime2
+		for ; len(b)>=32; b = b[32:] {
+			v1 = xxRound(v1,binary.LittleEndian.Uint64(b))
+			v2 = xxRound(v2,binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxRound(v3,binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxRound(v4,binary.LittleEndian.Uint64(b[24:]))
+		}
+		h = bits.RotateLeft64(v1,1)+bits.RotateLeft64(v2,7)+bits.RotateLeft64(v3,12)+bits.RotateLeft64(v4,18)
+		h = xxMerge(h,v1)
+		h = xxMerge(h,v2)
+		h = xxMerge(h,v3)
+		h = xxMerge(h,v4)
+	} else {
+		h = xxPrime5
+	}
+	h += n
+	for ; len(b)>=8; b = b[8:] {
+		h ^= xxRound(0,binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h,27)*xxPrime1+xxPrime4
+	}
+	if len(b)>=4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b))*xxPrime1
+		h = bits.RotateLeft64(h,23)*xxPrime2+xxPrime3
+		b = b[4:]
+	}
+	for _,c := range b {
+		h ^= uint64(c)*xxPrime5
+		h = bits.RotateLeft64(h,11)*xxPrime1
+	}
+	h ^= h>>33
+	h *= xxPrime2
+	h ^= h>>29
+	h *= xxPrime3
+	h ^= h>>32
+	return h
+}
@@ -0,0 +1,38 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import "testing"
+
+// The published vectors of xxHash64, with seed 0.
+func TestXXH64(t *testing.T) {
+	for _,c := range []struct{
+		in  string
+		sum uint64
+	}{
+		{"",0xef46db3751d8e999},
+		{"a",0xd24ec4f1a98c6e5b},
+		{"abc",0x44bc2cf5ad770999},
+		{"asdf",0x415872f599cea71e},
+		{"Nobody inspects the spammish repetition",0xfbcea83c8a378bf1},
+		{"Call me Ishmael. Some years ago--never mind how long precisely-",0x02a2e85470d6fd96},
+	}{
+		if sum := xxh64([]byte(c.in)); sum!=c.sum { t.Errorf("xxh64(%q) = %#x, want %#x",c.in,sum,c.sum) }
+	}
+	if sum := ChecksumXXH64.Sum([]byte("abc")); sum!=0xad770999 { t.Errorf("ChecksumXXH64.Sum(\"abc\") = %#x",sum) }
+}
+
+func benchmarkChecksum(b *testing.B, c Checksum) {
+	buf := make([]byte,4096)
+	for i := range buf { buf[i] = byte(i*7) }
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i<b.N; i++ { c.Sum(buf) }
+}
+
+func BenchmarkChecksumCRC32(b *testing.B) { benchmarkChecksum(b,ChecksumCRC32) }
+func BenchmarkChecksumCRC32C(b *testing.B) { benchmarkChecksum(b,ChecksumCRC32C) }
+func BenchmarkChecksumXXH64(b *testing.B) { benchmarkChecksum(b,ChecksumXXH64) }
+func BenchmarkChecksumNone(b *testing.B) { benchmarkChecksum(b,ChecksumNone) }
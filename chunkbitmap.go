@@ -0,0 +1,84 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+/*
+A read-only view of a chunk's bitmap, as of the time it was taken, for tools, that analyze
+the allocation state. Slot pos stands for the data block Address(pos). Safe for concurrent use.
+*/
+type ReadOnlyBitmap struct{
+	bm    []byte
+	chunk int64
+	base  int64
+}
+
+/*
+Returns a view of the chunk's bitmap. Like StateSnapshot, a heap-backed bitmap is shared
+copy-on-write, a mmapped one is copied.
+*/
+func (pa *PageAllocator) ChunkBitmap(chunk int64) (ReadOnlyBitmap, error) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if chunk<0 || int64(len(pa.allocators))<=chunk { return ReadOnlyBitmap{},OUTOFBOUNDS }
+	pa.touch(int(chunk))
+	a := &pa.allocators[chunk]
+	bm := a.buffer
+	if a.mmapped {
+		bm = append([]byte(nil),bm...)
+	} else {
+		a.shared = true
+	}
+	return ReadOnlyBitmap{bm,chunk,pa.MakeAddress(chunk,0)},nil
+}
+
+// Returns a view of the chunk's bitmap in the snapshot.
+func (s *Snapshot) ChunkBitmap(chunk int64) (ReadOnlyBitmap, error) {
+	if chunk<0 || int64(len(s.bitmaps))<=chunk { return ReadOnlyBitmap{},OUTOFBOUNDS }
+	return ReadOnlyBitmap{s.bitmaps[chunk],chunk,s.cfg.MakeAddress(chunk,0)},nil
+}
+
+// The index of the chunk.
+func (b ReadOnlyBitmap) Chunk() int64 { return b.chunk }
+
+// The number of slots: the data blocks of the chunk.
+func (b ReadOnlyBitmap) Len() int64 { return int64(len(b.bm))<<3 }
+
+// The address of the data block of slot pos.
+func (b ReadOnlyBitmap) Address(pos int64) int64 { return b.base+pos }
+
+// Counts the used slots.
+func (b ReadOnlyBitmap) Count() int64 { return bitmap.CountInUse(b.bm,0,b.Len()) }
+
+// Counts the used slots in [pos,pos+lng), clipped to the bitmap.
+func (b ReadOnlyBitmap) CountRange(pos, lng int64) int64 {
+	if pos<0 { lng,pos = lng+pos,0 }
+	if max := b.Len()-pos; lng>max { lng = max }
+	return bitmap.CountInUse(b.bm,pos,lng)
+}
+
+// Reports, whether slot pos is used. Slots outside the bitmap are not.
+func (b ReadOnlyBitmap) Test(pos int64) bool {
+	if pos<0 || pos>=b.Len() { return false }
+	return b.bm[pos>>3]&byte(0x80>>uint(pos&7))!=0
+}
+
+/*
+Calls fn for every maximal run of free or used slots, in ascending order.
+Stops, if fn returns false.
+*/
+func (b ReadOnlyBitmap) ForEachRun(fn func(pos, lng int64, used bool) bool) {
+	next,more := int64(0),true
+	bitmap.ForEachFreeRun(b.bm,func(pos, lng int64) bool {
+		if pos>next { more = fn(next,pos-next,true) }
+		if more { more = fn(pos,lng,false) }
+		next = pos+lng
+		return more
+	})
+	if more && next<b.Len() { fn(next,b.Len()-next,true) }
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import "sync"
+
+/*
+Per-chunk read-write locks, shared between the allocator and higher layers.
+
+Operations of this package, that relocate data (MoveBlocks, the compactor, ImportChunk),
+hold the write lock of every chunk they touch: the one, the data leaves, and the one, it goes to.
+They take them in ascending order. ExportChunk holds the read lock. Higher layers hold the read lock
+around their own I/O on a chunk's data region, so that it doesn't move underneath them.
+
+The chunk locks are never acquired while the allocator itself is locked,
+so they may be held across calls into the allocator.
+*/
+func (pa *PageAllocator) chunkLock(chunk int64) (*sync.RWMutex, error) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if chunk<0 || chunk>=int64(len(pa.allocators)) { return nil,OUTOFBOUNDS }
+	for int64(len(pa.chunkLocks))<=chunk { pa.chunkLocks = append(pa.chunkLocks,new(sync.RWMutex)) }
+	return pa.chunkLocks[chunk],nil
+}
+
+// Acquires the chunk's lock for reading. Returns the function, that releases it.
+func (pa *PageAllocator) LockChunkForRead(chunk int64) (unlock func(), err error) {
+	l,err := pa.chunkLock(chunk)
+	if err!=nil { return }
+	l.RLock()
+	return l.RUnlock,nil
+}
+
+// Acquires the chunk's lock for writing. Returns the function, that releases it.
+func (pa *PageAllocator) LockChunkForWrite(chunk int64) (unlock func(), err error) {
+	l,err := pa.chunkLock(chunk)
+	if err!=nil { return }
+	l.Lock()
+	return l.Unlock,nil
+}
+
+// Calls fn with the chunk's lock held for reading.
+func (pa *PageAllocator) WithChunkRead(chunk int64, fn func() error) error {
+	unlock,err := pa.LockChunkForRead(chunk)
+	if err!=nil { return err }
+	defer unlock()
+	return fn()
+}
+
+// Calls fn with the chunk's lock held for writing.
+func (pa *PageAllocator) WithChunkWrite(chunk int64, fn func() error) error {
+	unlock,err := pa.LockChunkForWrite(chunk)
+	if err!=nil { return err }
+	defer unlock()
+	return fn()
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The superblock has no room for another chunk state.
+var STATESFULL = errors.New("STATES_FULL")
+
+// The health of a chunk.
+type ChunkState uint8
+
+const (
+	ChunkHealthy ChunkState = iota
+	
+	// I/O errors were seen in the chunk. It is still used for allocations.
+	ChunkDegraded
+	
+	// The chunk takes no new allocations. Frees are still applied.
+	ChunkRetired
+	
+	// The bitmap was lost, when the file was opened in Salvage mode. The chunk is taken as fully used
+	// and takes neither allocations nor frees. Can't be set with SetChunkStatus, and is not persisted.
+	ChunkSalvaged
+	
+	// The chunk is immutable and takes neither allocations nor frees. Set by SealChunk, not by SetChunkStatus.
+	ChunkSealed
+)
+
+var chunkStateNames = [...]string{"healthy","degraded","retired","salvaged","sealed"}
+
+func (s ChunkState) String() string {
+	if int(s)<len(chunkStateNames) { return chunkStateNames[s] }
+	return "unknown"
+}
+
+// A chunk, that is not healthy. The superblock lists them.
+type chunkState struct{
+	chunk uint32
+	state ChunkState
+}
+
+// Whether allocations may be placed in a chunk in this state.
+func (s ChunkState) allocatable() bool { return s<ChunkRetired }
+
+// Returns the state of chunk i. pa.mu must be held.
+func (pa *PageAllocator) chunkState(i int) ChunkState {
+	if i<len(pa.allocators) && pa.allocators[i].salvaged { return ChunkSalvaged }
+	for _,s := range pa.super.states {
+		if int(s.chunk)==i { return s.state }
+	}
+	return ChunkHealthy
+}
+
+// Returns the state of the chunk.
+func (pa *PageAllocator) ChunkStatus(chunk int64) (ChunkState, error) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if chunk<0 || int64(len(pa.allocators))<=chunk { return 0,OUTOFBOUNDS }
+	return pa.chunkState(int(chunk)),nil
+}
+
+/*
+Sets the state of the chunk and emits EventChunkState. In files with a superblock (see Create),
+the state is persisted there, so that it survives reopening. The superblock holds the states
+of up to 53 chunks, that are not healthy; beyond that, SetChunkStatus fails with STATESFULL.
+The state of a sealed chunk can't be changed, before it is unsealed (see SealChunk).
+*/
+func (pa *PageAllocator) SetChunkStatus(chunk int64, state ChunkState) (err error) {
+	if state>ChunkRetired { return fmt.Errorf("%w: can't set chunk state %v",BADCONFIG,state) }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if chunk<0 || int64(len(pa.allocators))<=chunk { return OUTOFBOUNDS }
+	if pa.readOnly(int(chunk)) { return pa.readOnlyChunk(chunk) }
+	if pa.chunkState(int(chunk))==state { return }
+	return pa.changeChunkState(int(chunk),state)
+}
+
+// Sets the state of chunk i, persists it and emits EventChunkState.
+func (pa *PageAllocator) changeChunkState(i int, state ChunkState) (err error) {
+	old := pa.super.states
+	if err = pa.setChunkState(i,state); err!=nil { return }
+	if pa.hasSuper {
+		if err = pa.writeSuperblock(); err!=nil {
+			pa.super.states = old
+			return
+		}
+	}
+	pa.changed = true
+	pa.emit(Event{Kind: EventChunkState, Chunk: int64(i), ChunkState: state})
+	return
+}
+
+func (pa *PageAllocator) setChunkState(i int, state ChunkState) error {
+	l := make([]chunkState,0,len(pa.super.states)+1)
+	for _,s := range pa.super.states {
+		if int(s.chunk)!=i { l = append(l,s) }
+	}
+	if state!=ChunkHealthy {
+		if len(l)>=maxChunkStates { return STATESFULL }
+		l = append(l,chunkState{uint32(i),state})
+	}
+	pa.super.states = l
+	return nil
+}
+
+// Forgets the states of the chunks from n on, after they were removed. Reports, whether there were any.
+func (pa *PageAllocator) dropChunkStates(n int) bool {
+	l := pa.super.states[:0:0]
+	for _,s := range pa.super.states {
+		if int(s.chunk)<n { l = append(l,s) }
+	}
+	dropped := len(l)<len(pa.super.states)
+	pa.super.states = l
+	return dropped
+}
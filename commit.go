@@ -0,0 +1,197 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+When the allocator writes modified bitmaps back. It is also the durability class of a single
+operation: see AllocateBlocksWithPolicy.
+*/
+type SyncPolicy uint8
+
+const (
+	// After every operation, before it returns.
+	SyncEachOp SyncPolicy = iota
+	
+	// Modifications are collected and written back together, at most CommitInterval after the first one.
+	SyncGroupCommit
+	
+	// Only on Flush() and Close().
+	SyncOnFlush
+)
+
+const defaultCommitInterval = 5*time.Millisecond
+
+type commitWaiter struct{
+	e    Extent
+	done func(Extent, error)
+}
+
+type commitState struct{
+	timer   *time.Timer
+	waiters []commitWaiter
+}
+
+func (c *commitState) stop() {
+	if c.timer!=nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// The SyncPolicy of the operation in progress.
+func (pa *PageAllocator) policy() SyncPolicy {
+	if pa.classed { return pa.class }
+	return pa.SyncPolicy
+}
+
+func (pa *PageAllocator) syncEachOp() bool { return pa.policy()==SyncEachOp || pa.MultiProcess }
+
+/*
+Writes the chunk back or defers it, according to the SyncPolicy. Bitmaps in persistent memory are flushed right away.
+An operation, that syncs, writes back the chunks awaiting the group commit as well, so that it
+doesn't become durable before the operations, that returned earlier and are about to.
+*/
+func (pa *PageAllocator) commitChunk(i int, async bool) error {
+	if pa.batching { return nil }
+	if pa.syncEachOp() {
+		chunks := []int{i}
+		for j := range pa.allocators {
+			if j!=i && pa.allocators[j].urgent { chunks = append(chunks,j) }
+		}
+		return pa.flushChunks(chunks)
+	}
+	if pa.allocators[i].persistent && !pa.DontMsync { return pa.flushChunk(i) }
+	if async || pa.policy()==SyncGroupCommit {
+		pa.allocators[i].urgent = true
+		pa.scheduleCommit()
+	}
+	return nil
+}
+
+func (pa *PageAllocator) scheduleCommit() {
+	if pa.commit.timer!=nil { return }
+	d := pa.CommitInterval
+	if d<=0 { d = defaultCommitInterval }
+	pa.commit.timer = time.AfterFunc(d,pa.groupCommit)
+}
+
+func (pa *PageAllocator) groupCommit() {
+	err := pa.enter()
+	if err!=nil {
+		// Try again later.
+		pa.mu.Lock()
+		pa.commit.timer = nil
+		pa.scheduleCommit()
+		pa.mu.Unlock()
+		return
+	}
+	pa.commit.timer = nil
+	w,err := pa.flushUrgent()
+	pa.leave(&err)
+	notify(w,err)
+}
+
+// Writes back the modified bitmaps awaiting the group commit. Returns the waiters to notify.
+func (pa *PageAllocator) flushUrgent() (w []commitWaiter, err error) {
+	var urgent []int
+	for i := range pa.allocators {
+		if pa.allocators[i].urgent { urgent = append(urgent,i) }
+	}
+	w = pa.commit.waiters
+	pa.commit.waiters = nil
+	err = pa.flushChunks(urgent)
+	return
+}
+
+// Writes back all modified bitmaps. Returns the waiters to notify.
+func (pa *PageAllocator) flushDirty() (w []commitWaiter, err error) {
+	var dirty []int
+	for i := range pa.allocators {
+		if pa.allocators[i].dirty { dirty = append(dirty,i) }
+	}
+	w = pa.commit.waiters
+	pa.commit.waiters = nil
+	err = pa.flushChunks(dirty)
+	return
+}
+
+func notify(w []commitWaiter, err error) {
+	for _,c := range w { c.done(c.e,err) }
+}
+
+/*
+Allocates a series of contiguous blocks, like AllocateBlocks, but doesn't wait for the bitmap to be
+written back. The extent is usable immediately; done is called, once the allocation is durable,
+or with the error of the write-back or the sync, that failed.
+
+With SyncEachOp (and in MultiProcess mode), the bitmap is written back and synced before
+AllocateBlocksAsync returns: done is called before it returns, and the error is returned as well.
+Otherwise the allocation is written back by the next group commit, even with SyncOnFlush.
+done may run on another goroutine, never with the allocator locked.
+*/
+func (pa *PageAllocator) AllocateBlocksAsync(lng int64, grow bool, done func(Extent, error)) (e Extent, err error) {
+	if lng>pa.RunSizeInBlocks() { return e,EXCEEDMAX }
+	if err = pa.enter(); err!=nil { return }
+	blk,ok,err := pa.allocate(lng,grow,true)
+	if ok {
+		e = Extent{blk,lng}
+		if done!=nil { pa.commit.waiters = append(pa.commit.waiters,commitWaiter{e,done}) }
+	}
+	var w []commitWaiter
+	if ok && pa.syncEachOp() {
+		// Already written back.
+		w = pa.commit.waiters
+		pa.commit.waiters = nil
+	}
+	pa.leave(&err)
+	notify(w,err)
+	return
+}
+
+func checkPolicy(p SyncPolicy) error {
+	if p>SyncOnFlush { return fmt.Errorf("%w: unknown policy %d",BADCONFIG,p) }
+	return nil
+}
+
+// Sets the durability class of the operation in progress. The returned func resets it.
+func (pa *PageAllocator) withClass(p SyncPolicy) func() {
+	pa.classed,pa.class = true,p
+	return func() { pa.classed = false }
+}
+
+/*
+Allocates like AllocateBlocks, but writes the bitmap back according to p instead of the SyncPolicy:
+SyncEachOp for critical metadata, that must be durable, when the call returns; SyncGroupCommit
+for data written in bulk; SyncOnFlush for allocations, that may be lost in a crash. In MultiProcess
+mode, every operation syncs.
+
+When an operation syncs, the chunks awaiting the group commit are written back with it; chunks
+modified with SyncOnFlush only wait for Flush().
+*/
+func (pa *PageAllocator) AllocateBlocksWithPolicy(lng int64, grow bool, p SyncPolicy) (blk int64, ok bool, err error) {
+	if err = checkPolicy(p); err!=nil { return }
+	if lng>pa.RunSizeInBlocks() { return 0,false,EXCEEDMAX }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	defer pa.withClass(p)()
+	return pa.allocate(lng,grow,false)
+}
+
+/*
+Frees like FreeBlocks, but writes the bitmap back according to p instead of the SyncPolicy.
+See AllocateBlocksWithPolicy. Frees, that are quarantined, take the SyncPolicy, when they are released.
+*/
+func (pa *PageAllocator) FreeBlocksWithPolicy(blk, lng int64, p SyncPolicy) (err error) {
+	if err = checkPolicy(p); err!=nil { return }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	defer pa.withClass(p)()
+	return pa.free(blk,lng)
+}
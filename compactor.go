@@ -0,0 +1,203 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// StartCompactor was called, while the compactor runs.
+var COMPACTORRUNNING = errors.New("COMPACTOR_RUNNING")
+
+const (
+	defaultCompactIdle = 10*time.Millisecond
+	defaultCompactInterval = time.Second
+)
+
+// A relocator, that knows the extents it follows. The compactor only moves those.
+type extentLister interface{
+	movableExtents() []Extent
+}
+
+// Settings of the background compactor.
+type CompactorConfig struct{
+	// Bytes to copy per second at most. 0 means no limit.
+	Rate int64
+	
+	// The compactor only moves an extent, after no other operation ran for this long. Defaults to 10ms.
+	Idle time.Duration
+	
+	// The pause after a pass, that found nothing to move, and after an error. Defaults to 1s.
+	Interval time.Duration
+}
+
+// Progress of the background compactor.
+type CompactorStatus struct{
+	Running bool
+	
+	// Extents moved, and their blocks.
+	Moved, MovedBlocks int64
+	
+	// Times, the compactor found nothing left to move.
+	Passes int64
+	
+	// Times, the compactor waited for other operations.
+	Yields int64
+	
+	// The error of the last move, that failed. The compactor carries on after Interval.
+	LastError error
+}
+
+type compactorState struct{
+	stop   chan struct{}
+	done   chan struct{}
+	status CompactorStatus
+	// The allocation in progress is a move by the compactor: place it as low as possible.
+	lowest bool
+}
+
+/*
+Starts a goroutine, that moves extents towards the start of the file, one at a time with MoveBlocks,
+so that the tail empties out and Shrink() can reclaim it. Only the extents of HandleTables and those,
+that WatchRelocations follows, are moved, since nothing else would learn of their new place.
+
+An extent is moved, if a free run below it holds it. The compactor holds the write locks of the extent's
+chunk and of the one it moves to (see LockChunkForWrite) while moving it, copies no more than Rate bytes
+per second, and yields to other operations: it moves nothing, until the allocator was idle for Idle.
+Does nothing after Close, which stops the compactor.
+*/
+func (pa *PageAllocator) StartCompactor(c CompactorConfig) error {
+	if c.Idle<=0 { c.Idle = defaultCompactIdle }
+	if c.Interval<=0 { c.Interval = defaultCompactInterval }
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if pa.maint.closed { return nil }
+	if pa.compactor.stop!=nil { return COMPACTORRUNNING }
+	pa.compactor.stop,pa.compactor.done = make(chan struct{}),make(chan struct{})
+	pa.compactor.status.Running = true
+	go pa.runCompactor(c,pa.compactor.stop,pa.compactor.done)
+	return nil
+}
+
+// Stops the compactor and waits for the move in progress to complete.
+func (pa *PageAllocator) StopCompactor() {
+	pa.mu.Lock()
+	stop,done := pa.compactor.stop,pa.compactor.done
+	pa.compactor.stop = nil
+	pa.mu.Unlock()
+	if stop==nil { return }
+	close(stop)
+	<-done
+	pa.mu.Lock()
+	pa.compactor.status.Running = false
+	pa.mu.Unlock()
+}
+
+// Returns the progress of the compactor. Its counters accumulate over all runs.
+func (pa *PageAllocator) CompactorStatus() CompactorStatus {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	return pa.compactor.status
+}
+
+func (pa *PageAllocator) runCompactor(c CompactorConfig, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	sleep := func(d time.Duration) bool {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-stop: return false
+		case <-t.C: return true
+		}
+	}
+	start,copied := time.Now(),int64(0)
+	for {
+		pa.mu.Lock()
+		seq := pa.opSeq
+		pa.mu.Unlock()
+		if !sleep(c.Idle) { return }
+	
+		pa.mu.Lock()
+		if pa.opSeq!=seq {
+			pa.compactor.status.Yields++
+			pa.mu.Unlock()
+			continue
+		}
+		e,ok := pa.compactionCandidate()
+		if !ok { pa.compactor.status.Passes++ }
+		pa.mu.Unlock()
+		if !ok {
+			if !sleep(c.Interval) { return }
+			start,copied = time.Now(),0
+			continue
+		}
+	
+		moved,err := pa.compactExtent(e)
+		pa.mu.Lock()
+		if err!=nil { pa.compactor.status.LastError = err }
+		if moved {
+			pa.compactor.status.Moved++
+			pa.compactor.status.MovedBlocks += e.Len
+		}
+		pa.mu.Unlock()
+		if err!=nil && !sleep(c.Interval) { return }
+		if !moved || c.Rate<=0 { continue }
+		copied += e.Len<<pa.BlockSizeLog
+		due := time.Duration(copied*int64(time.Second)/c.Rate)
+		if d := due-time.Since(start); d>0 && !sleep(d) { return }
+	}
+}
+
+// Returns the highest movable extent, that fits into a free run below it. pa.mu must be held.
+func (pa *PageAllocator) compactionCandidate() (e Extent, ok bool) {
+	var l []Extent
+	for _,r := range pa.relocators {
+		if el,ok := r.(extentLister); ok { l = append(l,el.movableExtents()...) }
+	}
+	sort.Slice(l,func(i, j int) bool { return l[i].Start>l[j].Start })
+	fits := make(map[int64]int64)
+	for _,e = range l {
+		if c,_,_ := pa.BreakAddress(e.Start); int(c)<len(pa.allocators) && pa.readOnly(int(c)) { continue }
+		if pa.checkLeases(e.Start,e.Len)!=nil { continue }
+		to,seen := fits[e.Len]
+		if !seen {
+			to = pa.lowestFit(e.Len)
+			fits[e.Len] = to
+		}
+		if to>=0 && to<e.Start { return e,true }
+	}
+	return Extent{},false
+}
+
+// Returns the lowest block, at which lng blocks can be allocated, or -1.
+func (pa *PageAllocator) lowestFit(lng int64) int64 {
+	rz := int64(0)
+	if pa.Redzones { rz = 2 }
+	if pa.intoReserve(lng+rz) { return -1 }
+	for i := range pa.allocators {
+		if !pa.chunkState(i).allocatable() { continue }
+		if a := &pa.allocators[i]; a.lazy && a.sum.largest<lng+rz { continue }
+		if pos,ok := pa.findAccepted(i,pa.bitmapOf(i),lng+rz); ok { return pa.MakeAddress(int64(i),pos)+rz/2 }
+	}
+	return -1
+}
+
+// Moves the extent as low as possible, unless it changed since it was picked.
+func (pa *PageAllocator) compactExtent(e Extent) (moved bool, err error) {
+	c,_,_ := pa.BreakAddress(e.Start)
+	err = pa.withChunksLocked([]int64{c},func(locked []int64) (need int64, err error) {
+		if err = pa.enter(); err!=nil { return -1,err }
+		defer pa.leave(&err)
+		if cur,ok := pa.compactionCandidate(); !ok || cur!=e { return -1,nil }
+		pa.compactor.lowest = true
+		_,need,err = pa.moveBlocks(e.Start,e.Len,false,locked)
+		pa.compactor.lowest = false
+		moved = need<0 && err==nil
+		return
+	})
+	return
+}
@@ -0,0 +1,8 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+// Returns the number of allocated blocks, without locking the allocator. Operations update it with the allocator locked.
+func (pa *PageAllocator) UsedBlocks() int64 { return pa.usedBlocks.Load() }
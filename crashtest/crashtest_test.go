@@ -0,0 +1,161 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package crashtest
+
+import (
+	"fmt"
+	"testing"
+	"github.com/byte-mug/filealloc"
+)
+
+// An extent, and the number of writes, after which its allocation and its free were acknowledged.
+type acked struct{
+	e                  filealloc.Extent
+	alloc, freeing, freed int
+}
+
+const never = 1<<30
+
+func allocated(pa *filealloc.PageAllocator, e filealloc.Extent) (int64, error) {
+	c,pos,_ := pa.BreakAddress(e.Start)
+	bm,err := pa.ChunkBitmap(c)
+	if err!=nil { return 0,err }
+	return bm.CountRange(pos,e.Len),nil
+}
+
+func reused(e filealloc.Extent, l []acked) bool {
+	for _,a := range l {
+		if a.e!=e && a.e.Start<e.End() && e.Start<a.e.End() { return true }
+	}
+	return false
+}
+
+// Opens the file, and checks, that the acknowledged allocations and frees survived the first n writes.
+func verify(s filealloc.Storage, n int, l []acked) error {
+	pa,err := filealloc.Open(s,filealloc.FormatConfig{})
+	if err!=nil { return err }
+	defer pa.Close()
+	for _,a := range l {
+		used,err := allocated(pa,a.e)
+		switch {
+		case a.alloc>n || (a.freeing<n && a.freed>n):
+			// In flight.
+		case a.freed<=n && reused(a.e,l):
+			// Allocated again.
+		case a.freed<=n && err==nil && used!=0:
+			return fmt.Errorf("freed extent %v: %d blocks in use",a.e,used)
+		case a.freed>n && (err!=nil || used!=a.e.Len):
+			return fmt.Errorf("allocated extent %v: %d blocks in use, %v",a.e,used,err)
+		}
+	}
+	return nil
+}
+
+// Runs the allocator with doublewrite, trailers and a superblock backup through every crash state.
+func TestAllocatorCrash(t *testing.T) {
+	base := NewMemFile(nil)
+	cfg := filealloc.NewFormatConfig(9)
+	cfg.BitmapBlocks,cfg.PrefixBlocks = 2,5
+	pa,err := filealloc.Create(base,cfg,filealloc.WithDoublewrite(),filealloc.WithTrailers(),filealloc.WithSuperblockBackup())
+	if err!=nil { t.Fatal(err) }
+	if err = pa.Close(); err!=nil { t.Fatal(err) }
+	
+	r := NewRecorder(base.Bytes())
+	pa,err = filealloc.Open(r,filealloc.FormatConfig{})
+	if err!=nil { t.Fatal(err) }
+	var l []acked
+	alloc := func(lng int64) {
+		blk,ok,err := pa.AllocateBlocks(lng,true)
+		if err!=nil || !ok { t.Fatal(lng,ok,err) }
+		l = append(l,acked{filealloc.Extent{Start: blk, Len: lng},r.Writes(),never,never})
+	}
+	free := func(k int) {
+		l[k].freeing = r.Writes()
+		if err := pa.FreeBlocks(l[k].e.Start,l[k].e.Len); err!=nil { t.Fatal(err) }
+		l[k].freed = r.Writes()
+	}
+	alloc(3)
+	alloc(100)
+	alloc(1)
+	free(1)
+	alloc(pa.RunSizeInBlocks())
+	alloc(7)
+	free(0)
+	alloc(2)
+	if err = pa.Close(); err!=nil { t.Fatal(err) }
+	
+	err = Check(r,128,func(s filealloc.Storage) error {
+		pa,err := filealloc.Open(s,filealloc.FormatConfig{})
+		if err!=nil { return err }
+		return pa.Close()
+	})
+	if err!=nil { t.Fatal(err) }
+	for n := 0; n<=r.Writes(); n++ {
+		if err := verify(r.Replay(n),n,l); err!=nil { t.Fatalf("crash after %d writes: %v",n,err) }
+	}
+}
+
+// The used runs of each chunk.
+func runs(pa *filealloc.PageAllocator) (l []string, err error) {
+	for c := 0; c<pa.ChunksN(); c++ {
+		bm,err := pa.ChunkBitmap(int64(c))
+		if err!=nil { return nil,err }
+		s := ""
+		bm.ForEachRun(func(pos, lng int64, used bool) bool {
+			if used { s += fmt.Sprintf("%d+%d ",pos,lng) }
+			return true
+		})
+		l = append(l,s)
+	}
+	return
+}
+
+// A Flush, that writes several chunks through the doublewrite area: every chunk is either old or new.
+func TestDoublewriteFlush(t *testing.T) {
+	for _,trailers := range []bool{false,true} {
+		opts := []filealloc.Option{filealloc.WithoutMmap(),filealloc.WithSyncPolicy(filealloc.SyncOnFlush,0)}
+		format := append([]filealloc.Option{filealloc.WithDoublewrite(),filealloc.WithSuperblockBackup()},opts...)
+		if trailers { format = append(format,filealloc.WithTrailers()) }
+		base := NewMemFile(nil)
+		cfg := filealloc.NewFormatConfig(9)
+		cfg.BitmapBlocks,cfg.PrefixBlocks = 2,5
+		pa,err := filealloc.Create(base,cfg,format...)
+		if err!=nil { t.Fatal(err) }
+		var blks []int64
+		for c := 0; c<3; c++ {
+			blk,ok,err := pa.AllocateBlocks(pa.RunSizeInBlocks()/2,true)
+			if !ok || err!=nil { t.Fatal(ok,err) }
+			if _,ok,err = pa.AllocateBlocks(pa.RunSizeInBlocks()-pa.RunSizeInBlocks()/2,true); !ok || err!=nil { t.Fatal(ok,err) }
+			blks = append(blks,blk)
+		}
+		old,err := runs(pa)
+		if err!=nil { t.Fatal(err) }
+		if err = pa.Close(); err!=nil { t.Fatal(err) }
+		
+		r := NewRecorder(base.Bytes())
+		pa,err = filealloc.Open(r,filealloc.FormatConfig{},opts...)
+		if err!=nil { t.Fatal(err) }
+		for _,b := range blks {
+			if err = pa.FreeBlocks(b,pa.RunSizeInBlocks()/2); err!=nil { t.Fatal(err) }
+		}
+		if err = pa.Flush(); err!=nil { t.Fatal(err) }
+		cur,err := runs(pa)
+		if err!=nil { t.Fatal(err) }
+		pa.Close()
+		
+		err = Check(r,128,func(s filealloc.Storage) error {
+			pa,err := filealloc.Open(s,filealloc.FormatConfig{},opts...)
+			if err!=nil { return err }
+			defer pa.Close()
+			l,err := runs(pa)
+			if err!=nil { return err }
+			for c := range l {
+				if l[c]!=old[c] && l[c]!=cur[c] { return fmt.Errorf("chunk %d: %q, neither %q nor %q",c,l[c],old[c],cur[c]) }
+			}
+			return nil
+		})
+		if err!=nil { t.Fatal("trailers",trailers,err) }
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+/*
+Crash simulation for code built on filealloc.
+
+A Recorder is a Storage, that remembers every write. Afterwards, the file can be reconstructed
+as it would look like after a crash at any point, including torn writes, where only some of
+the sectors of a write reached the disk, and lost writes, that were not synced yet.
+*/
+package crashtest
+
+import (
+	"io"
+	"sync"
+)
+
+// An in-memory file. Implements filealloc.Storage.
+type MemFile struct{
+	mu   sync.Mutex
+	data []byte
+}
+
+// Creates a MemFile with a copy of data as its content.
+func NewMemFile(data []byte) *MemFile {
+	return &MemFile{data: append([]byte(nil),data...)}
+}
+
+func (m *MemFile) ReadAt(p []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off>=int64(len(m.data)) { return 0,io.EOF }
+	n = copy(p,m.data[off:])
+	if n<len(p) { err = io.EOF }
+	return
+}
+
+func (m *MemFile) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeAt(p,off)
+	return len(p),nil
+}
+
+func (m *MemFile) writeAt(p []byte, off int64) {
+	if end := off+int64(len(p)); end>int64(len(m.data)) {
+		m.data = append(m.data,make([]byte,end-int64(len(m.data)))...)
+	}
+	copy(m.data[off:],p)
+}
+
+func (m *MemFile) truncate(size int64) {
+	if size<int64(len(m.data)) {
+		m.data = m.data[:size]
+	} else {
+		m.data = append(m.data,make([]byte,size-int64(len(m.data)))...)
+	}
+}
+
+// Changes the size of the file. Implements filealloc.Truncater.
+func (m *MemFile) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.truncate(size)
+	return nil
+}
+
+func (m *MemFile) Sync() error { return nil }
+func (m *MemFile) Close() error { return nil }
+
+// Returns the size of the file.
+func (m *MemFile) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.data))
+}
+
+// Returns a copy of the file's content.
+func (m *MemFile) Bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]byte(nil),m.data...)
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package crashtest
+
+import (
+	"fmt"
+	"github.com/byte-mug/filealloc"
+)
+
+// A write, or a truncation to off, if data is nil.
+type write struct{
+	off  int64
+	data []byte
+}
+
+func (w *write) apply(m *MemFile) {
+	if w.data==nil {
+		m.truncate(w.off)
+	} else {
+		m.writeAt(w.data,w.off)
+	}
+}
+
+// An in-memory Storage, that records every write and truncation.
+type Recorder struct{
+	MemFile
+	base   []byte
+	writes []write
+	syncs  []int
+}
+
+// Creates a Recorder, starting with a copy of base as the file content.
+func NewRecorder(base []byte) *Recorder {
+	r := new(Recorder)
+	r.base = append([]byte(nil),base...)
+	r.data = append([]byte(nil),base...)
+	return r
+}
+
+func (r *Recorder) WriteAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(p)==0 { return 0,nil }
+	r.writes = append(r.writes,write{off,append([]byte(nil),p...)})
+	r.writeAt(p,off)
+	return len(p),nil
+}
+
+func (r *Recorder) Truncate(size int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes,write{size,nil})
+	r.truncate(size)
+	return nil
+}
+
+func (r *Recorder) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.syncs = append(r.syncs,len(r.writes))
+	return nil
+}
+
+// Returns the number of recorded writes (truncations included).
+func (r *Recorder) Writes() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.writes)
+}
+
+// Returns the number of writes, that preceded each Sync call.
+func (r *Recorder) Syncs() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil),r.syncs...)
+}
+
+// Returns the number of sectors the n-th write touches.
+func (r *Recorder) Sectors(n int, sectorSize int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w := r.writes[n]
+	if len(w.data)==0 { return 0 }
+	ss := int64(sectorSize)
+	return int(((w.off+int64(len(w.data))+ss-1)/ss) - (w.off/ss))
+}
+
+// Reconstructs the file after a crash, that happened after the first n writes.
+func (r *Recorder) Replay(n int) *MemFile {
+	return r.ReplayTorn(n,1,nil)
+}
+
+/*
+Reconstructs the file after a crash during the write with the index n:
+the first n writes are complete, and of the n-th write, only the sectors for which keep returns true
+reached the disk. Sectors are numbered from 0, relative to the first sector the write touches.
+If keep is nil, the n-th write is lost entirely.
+*/
+func (r *Recorder) ReplayTorn(n int, sectorSize int, keep func(sector int) bool) *MemFile {
+	if n>=r.Writes() { return r.ReplayLost(n,n,sectorSize,keep) }
+	return r.ReplayLost(n+1,n,sectorSize,keep)
+}
+
+/*
+Reconstructs the file after a crash, that happened after the first n writes, of which the write
+with the index k didn't reach the disk, or only the sectors for which keep returns true.
+The other writes after the last Sync before the crash may have reached the disk in any order,
+so that this is a valid crash state, if k is one of them.
+*/
+func (r *Recorder) ReplayLost(n, k int, sectorSize int, keep func(sector int) bool) *MemFile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := NewMemFile(r.base)
+	for i := range r.writes[:n] {
+		if i!=k { r.writes[i].apply(m) }
+	}
+	if keep==nil || k>=n { return m }
+	w := r.writes[k]
+	if w.data==nil { return m }
+	ss := int64(sectorSize)
+	first := w.off/ss
+	for pos := int64(0); pos<int64(len(w.data)); {
+		sec := (w.off+pos)/ss
+		end := (sec+1)*ss-w.off
+		if end>int64(len(w.data)) { end = int64(len(w.data)) }
+		if keep(int(sec-first)) { m.writeAt(w.data[pos:end],w.off+pos) }
+		pos = end
+	}
+	return m
+}
+
+// Reports, whether the write with the index k is a truncation.
+func (r *Recorder) truncation(k int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writes[k].data==nil
+}
+
+/*
+Calls check on every crash state: after each prefix of the recorded writes, and, for every write,
+each torn variant in which only a leading or a trailing part of its sectors reached the disk.
+
+Writes between two Syncs may reach the disk in any order. So at each Sync, and at the end, check
+is also called on the states, in which one of the writes since the previous Sync was lost or torn,
+while all the others reached the disk. Truncations are not reordered.
+
+Returns the first error, annotated with the crash point.
+*/
+func Check(r *Recorder, sectorSize int, check func(s filealloc.Storage) error) error {
+	n := r.Writes()
+	for i := 0; i<=n; i++ {
+		if err := check(r.Replay(i)); err!=nil {
+			return fmt.Errorf("crash after %d writes: %w",i,err)
+		}
+		if i==n { break }
+		secs := r.Sectors(i,sectorSize)
+		for j := 1; j<secs; j++ {
+			if err := check(r.ReplayTorn(i,sectorSize,func(s int) bool { return s<j })); err!=nil {
+				return fmt.Errorf("crash during write %d, first %d of %d sectors written: %w",i,j,secs,err)
+			}
+			if err := check(r.ReplayTorn(i,sectorSize,func(s int) bool { return s>=j })); err!=nil {
+				return fmt.Errorf("crash during write %d, last %d of %d sectors written: %w",i,secs-j,secs,err)
+			}
+		}
+	}
+	from := 0
+	for _,to := range append(r.Syncs(),n) {
+		// The last write of the window is covered above.
+		for k := from; k<to-1; k++ {
+			if r.truncation(k) { continue }
+			if err := check(r.ReplayLost(to,k,sectorSize,nil)); err!=nil {
+				return fmt.Errorf("crash after %d writes, write %d lost: %w",to,k,err)
+			}
+			secs := r.Sectors(k,sectorSize)
+			for j := 1; j<secs; j++ {
+				if err := check(r.ReplayLost(to,k,sectorSize,func(s int) bool { return s<j })); err!=nil {
+					return fmt.Errorf("crash after %d writes, first %d of %d sectors of write %d written: %w",to,j,secs,k,err)
+				}
+				if err := check(r.ReplayLost(to,k,sectorSize,func(s int) bool { return s>=j })); err!=nil {
+					return fmt.Errorf("crash after %d writes, last %d of %d sectors of write %d written: %w",to,secs-j,secs,k,err)
+				}
+			}
+		}
+		if to>from { from = to }
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !filealloc_debug
+
+package filealloc
+
+const debugRanges = false
@@ -0,0 +1,10 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build filealloc_debug
+
+package filealloc
+
+// Range checks panic, rather than returning an error.
+const debugRanges = true
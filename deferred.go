@@ -0,0 +1,74 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+type pendingFree struct{
+	Extent
+	epoch uint64
+}
+
+/*
+Queues the extent to be freed at the next Flush(). Until then, the blocks remain allocated.
+If readers are registered with EnterEpoch(), the free is further delayed until all of them exited.
+The extent is checked like by FreeBlocks, right away: ranges outside the data region of a chunk
+are rejected with a *RangeError, leased ones with LEASED. A lease taken later delays the free.
+
+Pending frees are not persisted. If the process crashes before they are applied,
+they are simply lost: the blocks leak, but the file is never corrupted.
+*/
+func (pa *PageAllocator) FreeDeferred(e Extent) (err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if _,_,err = pa.checkRange(e.Start,e.Len); err!=nil || e.Len==0 { return }
+	if err = pa.checkLeases(e.Start,e.Len); err!=nil { return }
+	cur,_ := pa.epochs.bounds()
+	pa.pending = append(pa.pending,pendingFree{e,cur})
+	return
+}
+
+// Returns a copy of the frees queued by FreeDeferred, that are not yet applied.
+func (pa *PageAllocator) PendingFrees() []Extent {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	return pa.pendingFrees()
+}
+
+func (pa *PageAllocator) pendingFrees() []Extent {
+	l := make([]Extent,len(pa.pending))
+	for i,p := range pa.pending { l[i] = p.Extent }
+	return l
+}
+
+// Applies the pending frees, that no reader can observe anymore, and writes back all modified bitmaps.
+func (pa *PageAllocator) Flush() (err error) {
+	if err = pa.enter(); err!=nil { return }
+	w,err := pa.flush()
+	pa.leave(&err)
+	notify(w,err)
+	return
+}
+
+// Returns the waiters of AllocateBlocksAsync, that must be notified (after unlocking).
+func (pa *PageAllocator) flush() (w []commitWaiter, err error) {
+	pa.opClass(OpFlush)
+	_,oldest := pa.epochs.bounds()
+	rest := pa.pending[:0]
+	for _,p := range pa.pending {
+		// Leased blocks are freed, once the lease ended.
+		if p.epoch>=oldest || pa.checkLeases(p.Start,p.Len)!=nil {
+			rest = append(rest,p)
+			continue
+		}
+		if _,_,e := pa.applyFree(p.Start,p.Len); err==nil { err = e }
+	}
+	for i := len(rest); i<len(pa.pending); i++ { pa.pending[i] = pendingFree{} }
+	pa.pending = rest
+	pa.epochs.advance()
+	pa.flushes++
+	if e := pa.releaseQuarantine(false); err==nil { err = e }
+	w,e := pa.flushDirty()
+	if err==nil { err = e }
+	return
+}
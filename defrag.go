@@ -0,0 +1,86 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import "github.com/byte-mug/filealloc/bitmap"
+
+// The result of DefragAdvice.
+type DefragAdvice struct{
+	// 0 if all free blocks form one run, approaching 1 as free space is scattered.
+	Fragmentation float64
+	
+	// A free run of the target size exists already.
+	AlreadyFree bool
+	
+	// The cheapest place for the run: the chunk and the blocks of the run.
+	Chunk  int64
+	Window Extent
+	
+	// The allocated runs overlapping the window, that would have to move.
+	// Runs of adjacent extents are not told apart.
+	Moves []Extent
+	BlocksToMove int64
+	
+	// Bytes to read and write to move them.
+	IOBytes int64
+	
+	// Enough free blocks exist outside the window to take the moved runs.
+	Feasible bool
+}
+
+/*
+Analyzes the bitmaps and tells, which allocated runs would have to move
+to create a free run of targetRun blocks, and what it would cost.
+Nothing is moved.
+*/
+func (pa *PageAllocator) DefragAdvice(targetRun int64) (d DefragAdvice, err error) {
+	if targetRun<=0 || targetRun>pa.RunSizeInBlocks() { return d,EXCEEDMAX }
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	st := pa.stats()
+	if st.FreeBlocks>0 { d.Fragmentation = 1-float64(st.LargestFreeRun)/float64(st.FreeBlocks) }
+	if st.LargestFreeRun>=targetRun {
+		d.AlreadyFree = true
+		d.Feasible = true
+		return
+	}
+	best := int64(-1)
+	for i := range pa.allocators {
+		pos,used := cheapestWindow(pa.bitmapOf(i),targetRun)
+		if best>=0 && used>=best { continue }
+		best = used
+		d.Chunk = int64(i)
+		d.Window = Extent{pa.MakeAddress(int64(i),pos),targetRun}
+	}
+	bm := pa.allocators[d.Chunk].buffer
+	wpos := d.Window.Start-pa.MakeAddress(d.Chunk,0)
+	bitmap.ForEachUsedRun(bm,func(pos, lng int64) bool {
+		if pos>=wpos+targetRun { return false }
+		if pos+lng<=wpos { return true }
+		d.Moves = append(d.Moves,Extent{pa.MakeAddress(d.Chunk,pos),lng})
+		d.BlocksToMove += lng
+		return true
+	})
+	d.IOBytes = 2*d.BlocksToMove<<pa.BlockSizeLog
+	free := st.FreeBlocks-(targetRun-best)
+	d.Feasible = free>=d.BlocksToMove
+	return
+}
+
+// Finds the window of lng slots with the fewest occupied slots.
+func cheapestWindow(bm []byte, lng int64) (pos, used int64) {
+	n := int64(len(bm))<<3
+	bit := func(j int64) int64 { return int64(bm[j>>3]>>(7-uint(j&7))&1) }
+	cur := bitmap.CountInUse(bm,0,lng)
+	used = cur
+	for j := lng; j<n; j++ {
+		cur += bit(j)-bit(j-lng)
+		if cur<used {
+			used = cur
+			pos = j-lng+1
+		}
+	}
+	return
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+)
+
+/*
+The doublewrite area follows the superblock: one header block, then BitmapBlocks blocks
+holding a copy of the bitmap, that was written last.
+
+Every bitmap is first written to the doublewrite area and synced, and only then written in place.
+If the in-place write is torn by a crash, Open() restores it from the copy.
+
+The header (little endian):
+	0  magic
+	8  chunk
+	16 sequence number
+	24 file id, a copy from another file is ignored
+	40 checksum of the bitmap copy
+	44 checksum of the preceding bytes
+*/
+const doublewriteHeader = 48
+
+var doublewriteMagic = [8]byte{'F','A','L','L','O','C','D','W'}
+
+func (pa *PageAllocator) doublewriteOff() (hdr, data int64) {
+	first := int64(1)
+	if pa.SuperblockBackup { first++ }
+	hdr = first<<pa.BlockSizeLog
+	data = (first+1)<<pa.BlockSizeLog
+	return
+}
+
+func (pa *PageAllocator) writeDoublewrite(chunk int, bm []byte) (err error) {
+	hdr,data := pa.doublewriteOff()
+	pa.op.written += int64(len(bm))
+	_,err = pa.WriteAt(bm,data)
+	if err!=nil { return }
+	pa.dwSeq++
+	h := make([]byte,doublewriteHeader)
+	copy(h,doublewriteMagic[:])
+	binary.LittleEndian.PutUint64(h[8:],uint64(chunk))
+	binary.LittleEndian.PutUint64(h[16:],pa.dwSeq)
+	copy(h[24:],pa.super.id[:])
+	binary.LittleEndian.PutUint32(h[40:],pa.Checksum.Sum(bm))
+	binary.LittleEndian.PutUint32(h[44:],pa.Checksum.Sum(h[:44]))
+	_,err = pa.WriteAt(h,hdr)
+	if err!=nil { return }
+	return pa.Sync()
+}
+
+// Reads the doublewrite area. ok is false, if it holds no complete copy.
+func (pa *PageAllocator) readDoublewrite() (chunk int64, bm []byte, ok bool) {
+	hdr,data := pa.doublewriteOff()
+	h := make([]byte,doublewriteHeader)
+	if n,_ := pa.ReadAt(h,hdr); n<len(h) { return }
+	if string(h[:8])!=string(doublewriteMagic[:]) { return }
+	if !pa.Checksum.Check(h[:44],binary.LittleEndian.Uint32(h[44:])) { return }
+	if string(h[24:40])!=string(pa.super.id[:]) { return }
+	chunk = int64(binary.LittleEndian.Uint64(h[8:]))
+	pa.dwSeq = binary.LittleEndian.Uint64(h[16:])
+	bm = make([]byte,pa.rawBitmapBytes())
+	if n,_ := pa.ReadAt(bm,data); n<len(bm) { return }
+	if !pa.Checksum.Check(bm,binary.LittleEndian.Uint32(h[40:])) { return }
+	ok = chunk>=0
+	return
+}
+
+/*
+Writes the copy from the doublewrite area back in place.
+
+This is idempotent: every write of a bitmap goes through the doublewrite area,
+so the copy is never older than the bitmap in place. With Trailers, only the blocks
+are written back, that are torn or older in place.
+*/
+func (pa *PageAllocator) replayDoublewrite() (err error) {
+	chunk,bm,ok := pa.readDoublewrite()
+	if !ok { return }
+	if pa.Trailers { return pa.replayTrailers(chunk,bm) }
+	off := pa.MakeAddress(chunk,-int64(pa.BitmapBlocks))<<pa.BlockSizeLog
+	_,err = pa.WriteAt(bm,off)
+	if err==nil { err = pa.Sync() }
+	return
+}
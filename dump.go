@@ -0,0 +1,145 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// Not a dump written by DebugDump.
+var BADDUMP = errors.New("BADDUMP")
+
+// DebugDump was given a DumpFormat, it doesn't know.
+var UNKNOWNDUMPFORMAT = errors.New("UNKNOWN_DUMP_FORMAT")
+
+// Output format of DebugDump.
+type DumpFormat uint
+
+const (
+	DumpJSON DumpFormat = iota
+	DumpBinary
+)
+
+// Flag for DumpFormat: include the full bitmaps.
+const DumpBitmaps DumpFormat = 1<<8
+
+var dumpMagic = []byte("FADUMP1\n")
+
+// The superblock, as seen by DebugDump.
+type DumpSuperblock struct{
+	Version  uint32
+	Features uint32
+	Flags    uint32
+	ID       FileID
+	Created  int64
+}
+
+// Summary of a chunk, as seen by DebugDump.
+type DumpChunk struct{
+	Index   int
+	// File offset of the bitmap.
+	Offset  int64
+	Mmapped bool
+	Dirty   bool
+	// The chunk is not loaded (see WithSummary). Without DumpBitmaps, or if the bitmap can not be read, the counts come from the summary and FreeRuns is 0.
+	Lazy    bool `json:",omitempty"`
+	UsedBlocks, FreeBlocks, LargestFreeRun int64
+	FreeRuns int64
+	Bitmap  []byte `json:",omitempty"`
+}
+
+// Structured dump of the allocator metadata.
+type Dump struct{
+	Config       FormatConfig
+	Superblock   *DumpSuperblock `json:",omitempty"`
+	Stats        Stats
+	Chunks       []DumpChunk
+	PendingFrees []Extent `json:",omitempty"`
+}
+
+// Collects the allocator metadata for DebugDump.
+func (pa *PageAllocator) dump(bitmaps bool) *Dump {
+	d := &Dump{
+		Config: pa.FormatConfig,
+		Stats: pa.stats(),
+		Chunks: make([]DumpChunk,len(pa.allocators)),
+		PendingFrees: pa.pendingFrees(),
+	}
+	if pa.hasSuper {
+		d.Superblock = &DumpSuperblock{superblockVersion,pa.super.features,pa.super.flags,pa.super.id,pa.super.created}
+	}
+	for i := range pa.allocators {
+		a := &pa.allocators[i]
+		c := &d.Chunks[i]
+		c.Index = i
+		c.Offset = a.rawoff
+		c.Mmapped = a.mmapped
+		c.Dirty = a.dirty
+		bm := a.buffer
+		if a.lazy {
+			// Loading the chunk would change the memory use, read a private copy, if the bitmap is needed.
+			c.Lazy = true
+			bm = nil
+			if bitmaps {
+				bm = make([]byte,pa.bitmapSize)
+				if _,_,err := pa.decodeBitmap(bm,a.rawoff); err!=nil { bm = nil }
+			}
+			if bm==nil {
+				c.FreeBlocks,c.LargestFreeRun = a.sum.free,a.sum.largest
+				c.UsedBlocks = (int64(pa.bitmapSize)<<3)-a.sum.free
+				continue
+			}
+		}
+		bitmap.ForEachFreeRun(bm,func(pos, lng int64) bool {
+			c.FreeRuns++
+			c.FreeBlocks += lng
+			if lng>c.LargestFreeRun { c.LargestFreeRun = lng }
+			return true
+		})
+		c.UsedBlocks = (int64(len(bm))<<3)-c.FreeBlocks
+		if bitmaps { c.Bitmap = append([]byte(nil),bm...) }
+	}
+	return d
+}
+
+/*
+Writes a dump of the superblock, the per-chunk summaries and, if format includes DumpBitmaps, the full bitmaps.
+The dump can be read back by LoadDump for offline analysis.
+*/
+func (pa *PageAllocator) DebugDump(w io.Writer, format DumpFormat) error {
+	pa.mu.Lock()
+	d := pa.dump(format&DumpBitmaps!=0)
+	pa.mu.Unlock()
+	switch format&^DumpBitmaps {
+	case DumpJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("","\t")
+		return enc.Encode(d)
+	case DumpBinary:
+		if _,err := w.Write(dumpMagic); err!=nil { return err }
+		return gob.NewEncoder(w).Encode(d)
+	}
+	return UNKNOWNDUMPFORMAT
+}
+
+// Reads a dump written by DebugDump, in either format.
+func LoadDump(r io.Reader) (*Dump, error) {
+	br := bufio.NewReader(r)
+	d := new(Dump)
+	head,err := br.Peek(len(dumpMagic))
+	if err==nil && string(head)==string(dumpMagic) {
+		br.Discard(len(dumpMagic))
+		err = gob.NewDecoder(br).Decode(d)
+	} else {
+		err = json.NewDecoder(br).Decode(d)
+	}
+	if err!=nil { return nil,err }
+	return d,nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The configuration never makes the bitmaps durable. See AllowUnsafe.
+var UNSAFECONFIG = errors.New("UNSAFE_CONFIG")
+
+// How durable the bitmap modifications are, as implied by the configuration.
+type Durability uint8
+
+const (
+	// The bitmaps are never forced to stable storage: mmapped with DontMsync, or heap-backed
+	// with DontFsync and SyncOnFlush. Modifications can be lost without bound.
+	DurabilityNone Durability = iota
+	
+	// The bitmaps are handed to the OS, but never synced (DontFsync). They survive a crash
+	// of the process, but not of the machine.
+	DurabilityOS
+	
+	// The bitmaps are synced after the operation returned: on group commit (SyncGroupCommit) or Flush() (SyncOnFlush).
+	DurabilityDeferred
+	
+	// The bitmaps are synced before each operation returns.
+	DurabilityEachOp
+)
+
+var durabilityNames = [...]string{"none","os","deferred","each-op"}
+
+func (d Durability) String() string {
+	if int(d)<len(durabilityNames) { return durabilityNames[d] }
+	return "unknown"
+}
+
+// Reports, whether the bitmaps of this configuration would be mmapped.
+func (pa *PageAllocator) wantsMmap() bool {
+	if pa.DontUseMmap || pa.Salvage || pa.Doublewrite || pa.Trailers || pa.BitmapEncoding!=0 { return false }
+	return getMemMapper(pa.Storage)!=nil
+}
+
+func (pa *PageAllocator) durability(mmapped bool) Durability {
+	if mmapped && pa.DontMsync { return DurabilityNone }
+	if !mmapped && pa.DontFsync {
+		if pa.SyncPolicy==SyncOnFlush && !pa.MultiProcess { return DurabilityNone }
+		return DurabilityOS
+	}
+	if pa.syncEachOp() { return DurabilityEachOp }
+	return DurabilityDeferred
+}
+
+/*
+Returns the durability of the bitmap modifications, that the configuration provides.
+If all bitmaps lie in persistent memory, they are flushed after each operation (see PersistentMapper).
+*/
+func (pa *PageAllocator) DurabilityLevel() Durability {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	d := pa.durability(pa.mmapper!=nil)
+	if d==DurabilityDeferred && pa.allPersistent() { d = DurabilityEachOp }
+	return d
+}
+
+func (pa *PageAllocator) allPersistent() bool {
+	for i := range pa.allocators {
+		if !pa.allocators[i].persistent { return false }
+	}
+	return len(pa.allocators)>0
+}
+
+/*
+Fails with UNSAFECONFIG, if the configuration provides DurabilityNone, unless AllowUnsafe is set.
+Create and Open call it. Callers, that construct a PageAllocator directly, may call it before Init.
+*/
+func (pa *PageAllocator) CheckDurability() error {
+	if pa.AllowUnsafe { return nil }
+	mmapped := pa.mmapper!=nil
+	if pa.bitmapSize==0 { mmapped = pa.wantsMmap() }
+	if pa.durability(mmapped)!=DurabilityNone { return nil }
+	if mmapped { return fmt.Errorf("%w: mmapped bitmaps with DontMsync are never synced",UNSAFECONFIG) }
+	return fmt.Errorf("%w: DontFsync with SyncOnFlush never syncs the bitmaps",UNSAFECONFIG)
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import "sync"
+
+// A reader's stay in an epoch. Obtained from EnterEpoch().
+type EpochGuard struct{
+	id uint64
+}
+
+type epochState struct{
+	mu      sync.Mutex
+	current uint64
+	nextId  uint64
+	readers map[uint64]uint64
+}
+
+/*
+Registers a reader in the current epoch. Until the guard is passed to ExitEpoch(),
+no block freed with FreeDeferred() from now on will be reused, not even after Flush().
+
+EnterEpoch and ExitEpoch may be called concurrently with each other and with the allocator.
+*/
+func (pa *PageAllocator) EnterEpoch() EpochGuard {
+	e := &pa.epochs
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.readers==nil { e.readers = make(map[uint64]uint64) }
+	e.nextId++
+	e.readers[e.nextId] = e.current
+	return EpochGuard{e.nextId}
+}
+
+// Ends the reader's stay in its epoch.
+func (pa *PageAllocator) ExitEpoch(g EpochGuard) {
+	e := &pa.epochs
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.readers,g.id)
+}
+
+// Returns the current epoch and the oldest epoch, that still has readers.
+func (e *epochState) bounds() (current, oldest uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	current = e.current
+	oldest = current+1
+	for _,r := range e.readers {
+		if r<oldest { oldest = r }
+	}
+	return
+}
+
+// Starts a new epoch.
+func (e *epochState) advance() {
+	e.mu.Lock()
+	e.current++
+	e.mu.Unlock()
+}
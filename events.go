@@ -0,0 +1,137 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"time"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// The kind of an Event.
+type EventKind uint8
+
+const (
+	// A chunk was added. Chunk is the new chunk.
+	EventGrow EventKind = iota+1
+	
+	// Chunks were removed from the end of the file. Chunk is the first removed chunk.
+	EventShrink
+	
+	// The fraction of used blocks reached HighWatermark.
+	EventHighWatermark
+	
+	// The fraction of used blocks fell back to LowWatermark.
+	EventLowWatermark
+	
+	// Writing a bitmap back failed. Err holds the error.
+	EventWriteFailed
+	
+	// PlaceAuto switched the strategy. Placement holds the new one.
+	EventPlacement
+	
+	// The forecast exhaustion came closer than ForecastAlert. Exhaustion holds the forecast.
+	EventExhaustion
+	
+	// The state of a chunk changed. Chunk and ChunkState describe it.
+	EventChunkState
+	
+	// Background maintenance finished. Err holds its first error.
+	EventMaintenance
+	
+	// A chunk's bitmap could not be mmapped and is heap-backed. Chunk and Err describe it.
+	EventMmapFallback
+)
+
+// A change of the allocator's capacity or state.
+type Event struct{
+	Kind  EventKind
+	Time  time.Time
+	Chunk int64
+	// Number of chunks after the event.
+	Chunks int
+	// Fraction of used blocks after the event.
+	Usage float64
+	Err   error
+	Placement Placement
+	Exhaustion time.Duration
+	ChunkState ChunkState
+}
+
+const eventBuffer = 64
+
+/*
+Returns a channel, that receives events from now on.
+
+Events are delivered without blocking the allocator: if the subscriber falls behind
+by more than the channel's buffer, further events are dropped for it.
+*/
+func (pa *PageAllocator) Subscribe() <-chan Event {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	ch := make(chan Event,eventBuffer)
+	pa.subscribers = append(pa.subscribers,ch)
+	return ch
+}
+
+// Stops the delivery of events to ch and closes it.
+func (pa *PageAllocator) Unsubscribe(ch <-chan Event) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	for i,c := range pa.subscribers {
+		if c!=ch { continue }
+		close(c)
+		pa.subscribers = append(pa.subscribers[:i],pa.subscribers[i+1:]...)
+		return
+	}
+}
+
+func (pa *PageAllocator) usage() float64 {
+	total := int64(len(pa.allocators))*pa.RunSizeInBlocks()
+	if total==0 { return 0 }
+	return float64(pa.usedBlocks.Load())/float64(total)
+}
+
+func (pa *PageAllocator) emit(ev Event) {
+	if len(pa.subscribers)==0 { return }
+	ev.Time = time.Now()
+	ev.Chunks = len(pa.allocators)
+	ev.Usage = pa.usage()
+	for _,c := range pa.subscribers {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
+
+// Emits the watermark events, if the usage crossed one of them.
+func (pa *PageAllocator) checkWatermarks() {
+	pa.sampleUsage()
+	if pa.HighWatermark<=0 { return }
+	low := pa.LowWatermark
+	if low<=0 || low>pa.HighWatermark { low = pa.HighWatermark }
+	u := pa.usage()
+	if !pa.aboveHigh && u>=pa.HighWatermark {
+		pa.aboveHigh = true
+		pa.emit(Event{Kind: EventHighWatermark})
+	} else if pa.aboveHigh && u<low {
+		pa.aboveHigh = false
+		pa.emit(Event{Kind: EventLowWatermark})
+	}
+}
+
+// Recounts the used blocks of all chunks.
+func (pa *PageAllocator) countUsed() {
+	var n int64
+	for i := range pa.allocators {
+		if a := &pa.allocators[i]; a.lazy {
+			n += pa.RunSizeInBlocks()-a.sum.free
+			continue
+		}
+		bm := pa.allocators[i].buffer
+		n += bitmap.CountInUse(bm,0,int64(len(bm))<<3)
+	}
+	pa.usedBlocks.Store(n)
+}
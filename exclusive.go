@@ -0,0 +1,45 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Another allocator has the file open with ExclusiveOpen.
+var LOCKED = errors.New("LOCKED")
+
+/*
+Optional interface of a Storage, that supports a lock held for as long as the file is open,
+like flock(2) or LockFileEx. See the osfile package for an implementation.
+*/
+type ExclusiveLocker interface{
+	// Acquires the lock without blocking. Fails with an error matching LOCKED, if it is held by another.
+	TryLockExclusive() error
+	UnlockExclusive() error
+}
+
+// Acquires the open lock, if ExclusiveOpen is set.
+func (pa *PageAllocator) lockExclusive() error {
+	if !pa.ExclusiveOpen { return nil }
+	if pa.MultiProcess { return fmt.Errorf("%w: ExclusiveOpen contradicts MultiProcess",BADCONFIG) }
+	l,ok := pa.Storage.(ExclusiveLocker)
+	if !ok { return UNSUPPORTED }
+	if err := l.TryLockExclusive(); err!=nil { return err }
+	pa.exclusive = l
+	return nil
+}
+
+func (pa *PageAllocator) unlockExclusive() {
+	if pa.exclusive==nil { return }
+	pa.exclusive.UnlockExclusive()
+	pa.exclusive = nil
+}
+
+// Releases the open lock, if Create() or Open() failed.
+func (pa *PageAllocator) unlockExclusiveOn(err *error) {
+	if *err!=nil { pa.unlockExclusive() }
+}
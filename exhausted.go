@@ -0,0 +1,59 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"fmt"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+/*
+Returned, if an allocation fails without growth. Tells apart a file, that is out of space,
+from one, that is too fragmented. Matches EXTHAUSTED with errors.Is.
+*/
+type ExhaustedError struct{
+	// The blocks asked for, including redzones.
+	Len int64
+	
+	// Free blocks in the chunks, that take allocations, and the largest run of them.
+	Free, LargestFreeRun int64
+	
+	// Chunks scanned, and chunks skipped, because they take no allocations (see ChunkState).
+	Chunks, Skipped int
+	
+	// Blocks held back by ReservedFraction, that the allocation was not allowed to use.
+	Reserved int64
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("EXTHAUSTED: %d blocks wanted, %d free in %d chunks, the largest run %d",e.Len,e.Free,e.Chunks,e.LargestFreeRun)
+}
+
+func (e *ExhaustedError) Is(target error) bool { return target==EXTHAUSTED }
+
+// Reports, whether enough blocks are free, but not contiguous.
+func (e *ExhaustedError) Fragmented() bool { return e.Free-e.Reserved>=e.Len }
+
+// Describes the failed allocation of lng blocks. Scans all bitmaps.
+func (pa *PageAllocator) exhausted(lng int64) error {
+	e := &ExhaustedError{Len: lng}
+	for i := range pa.allocators {
+		if !pa.chunkState(i).allocatable() {
+			e.Skipped++
+			continue
+		}
+		e.Chunks++
+		if a := &pa.allocators[i]; a.lazy {
+			e.Free += a.sum.free
+			if a.sum.largest>e.LargestFreeRun { e.LargestFreeRun = a.sum.largest }
+			continue
+		}
+		bm := pa.allocators[i].buffer
+		e.Free += int64(len(bm))<<3-bitmap.CountInUse(bm,0,int64(len(bm))<<3)
+		if r := bitmap.LargestFreeRuns(bm,1); len(r)>0 && r[0].Len>e.LargestFreeRun { e.LargestFreeRun = r[0].Len }
+	}
+	if !pa.privileged { e.Reserved = pa.reservedBlocks() }
+	return e
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// Why an allocation was not placed in a chunk.
+type SkipReason uint8
+
+const (
+	// The chunk was chosen.
+	NotSkipped SkipReason = iota
+	
+	// The chunk has no free block.
+	SkipFull
+	
+	// The chunk has free blocks, but no run long enough.
+	SkipRunTooSmall
+	
+	// The free-run index rules the chunk out, its bitmap was not scanned.
+	SkipIndexed
+	
+	// Best-fit: the chunk has a run long enough, but another chunk fits better.
+	SkipWorseFit
+	
+	// The chunk is retired (see SetChunkStatus), salvaged or sealed.
+	SkipRetired
+	
+	// The PlacementFilter vetoed every candidate, that fits.
+	SkipFiltered
+)
+
+// How the search for free blocks treated a chunk.
+type ChunkDecision struct{
+	Chunk  int64
+	Reason SkipReason
+	// Free blocks and the longest free run, unless the index decided.
+	Free, LargestFreeRun int64
+	// Bitmap bits examined.
+	Scanned int64
+}
+
+// The course of a simulated allocation. See ExplainAllocate.
+type Explanation struct{
+	// Blocks searched for, including redzones.
+	Len int64
+	// The strategy in effect.
+	Placement Placement
+	// The chunks in the order, in which they were considered.
+	Chunks []ChunkDecision
+	// The allocation would start at Block.
+	Found bool
+	Block int64
+	// No chunk fits: the allocation would add a chunk, if allowed to grow and MaxChunks permits.
+	Grow bool
+	// Sum of the Scanned bits.
+	BitsScanned int64
+}
+
+/*
+Explains, where AllocateBlocks(lng,...) would place the blocks and why the chunks before were skipped,
+without modifying the allocator. It has to scan the bitmaps for the free-block counts, so it is slow.
+*/
+func (pa *PageAllocator) ExplainAllocate(lng int64) (ex Explanation, err error) {
+	if lng>pa.RunSizeInBlocks() { return ex,EXCEEDMAX }
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if pa.Redzones {
+		if lng>pa.RunSizeInBlocks()-2 { return ex,EXCEEDMAX }
+		lng += 2
+	}
+	ex.Len = lng
+	ex.Placement = pa.strategy()
+	n := len(pa.allocators)
+	start := 0
+	if ex.Placement==PlaceNextFit && pa.adapt.next<n { start = pa.adapt.next }
+	best,bestSize := -1,int64(0)
+	for k := 0; k<n; k++ {
+		i := (start+k)%n
+		d,pos,size := pa.explainChunk(i,lng)
+		ex.BitsScanned += d.Scanned
+		ex.Chunks = append(ex.Chunks,d)
+		if d.Reason!=NotSkipped { continue }
+		if ex.Placement!=PlaceBestFit {
+			ex.Found,ex.Block = true,pa.MakeAddress(int64(i),pos)
+			break
+		}
+		if best>=0 && size>=bestSize {
+			ex.Chunks[len(ex.Chunks)-1].Reason = SkipWorseFit
+			continue
+		}
+		if best>=0 { ex.Chunks[best].Reason = SkipWorseFit }
+		best,bestSize = len(ex.Chunks)-1,size
+		ex.Found,ex.Block = true,pa.MakeAddress(int64(i),pos)
+	}
+	ex.Grow = !ex.Found
+	if ex.Found && pa.Redzones { ex.Block++ }
+	return
+}
+
+// Decides on a chunk like findInChunk and findBestFit. For best-fit, size is the length of the chosen run.
+func (pa *PageAllocator) explainChunk(i int, lng int64) (d ChunkDecision, pos, size int64) {
+	pa.touch(i)
+	a := &pa.allocators[i]
+	d.Chunk = int64(i)
+	bits := int64(len(a.buffer))<<3
+	strategy := pa.strategy()
+	if !pa.chunkState(i).allocatable() {
+		d.Reason = SkipRetired
+		return
+	}
+	if a.index.valid {
+		p,ok,scan := a.index.find(lng)
+		if !ok && !scan {
+			d.Reason = SkipIndexed
+			return
+		}
+		if ok && strategy!=PlaceLowest && strategy!=PlaceBestFit && !pa.Deterministic && pa.accepts(i,p,lng) {
+			d.Free,d.LargestFreeRun = -1,-1
+			return d,p,0
+		}
+	}
+	size = -1
+	bitmap.ForEachFreeRun(a.buffer,func(p, l int64) bool {
+		d.Free += l
+		if l>d.LargestFreeRun { d.LargestFreeRun = l }
+		if l<lng || (size>=0 && l>=size) { return true }
+		if q,ok := pa.acceptRun(i,p,l,lng); ok { pos,size = q,l }
+		return true
+	})
+	switch {
+	case d.Free==0: d.Reason = SkipFull
+	case d.LargestFreeRun<lng: d.Reason = SkipRunTooSmall
+	case size<0: d.Reason = SkipFiltered
+	}
+	if d.Reason!=NotSkipped || strategy==PlaceBestFit {
+		d.Scanned = bits
+		return
+	}
+	pos,_ = pa.findAccepted(i,a.buffer,lng)
+	d.Scanned = pos+lng
+	return
+}
@@ -0,0 +1,13 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+// A contiguous range of blocks.
+type Extent struct{
+	Start, Len int64
+}
+
+// Returns the first block after the extent.
+func (e Extent) End() int64 { return e.Start+e.Len }
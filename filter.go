@@ -0,0 +1,52 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+/*
+Vetoes placements, to keep allocations off ranges, that are about to be punched, or off a chunk,
+that is being migrated, for instance. The search for free blocks calls it with each candidate:
+the chunk and the position of lng blocks in its data region (with Redzones, including them).
+If it returns false, the search goes on with the next candidate.
+
+The candidates of a free run are its start, the positions lng blocks apart after it, and the one,
+that ends with the run. A chunk claimed as a whole is offered at position 0, and AllocateScatter
+offers each free run as a whole, before it takes a fragment of it. Moves and the compactor consult it,
+and so does ExplainAllocate. It is called with the allocator locked, so it must be quick, must not
+call the allocator, and should not have side effects.
+*/
+type PlacementFilter func(chunk, pos, lng int64) bool
+
+// Sets the PlacementFilter. nil removes it.
+func WithPlacementFilter(f PlacementFilter) Option {
+	return Option{"WithPlacementFilter",optLive,nil,func(pa *PageAllocator) { pa.PlacementFilter = f }}
+}
+
+func (pa *PageAllocator) accepts(i int, pos, lng int64) bool {
+	return pa.PlacementFilter==nil || pa.PlacementFilter(int64(i),pos,lng)
+}
+
+// Returns the first candidate in the free run [pos,pos+run), that the PlacementFilter accepts.
+func (pa *PageAllocator) acceptRun(i int, pos, run, lng int64) (int64, bool) {
+	last := pos+run-lng
+	for p := pos; p<last; p += lng {
+		if pa.accepts(i,p,lng) { return p,true }
+	}
+	if last>=pos && pa.accepts(i,last,lng) { return last,true }
+	return 0,false
+}
+
+// Finds lng free blocks in the bitmap of chunk i, in the first free run, that has an accepted candidate.
+func (pa *PageAllocator) findAccepted(i int, bm []byte, lng int64) (pos int64, ok bool) {
+	if pa.PlacementFilter==nil { return bitmap.FindFreeSpot(bm,lng) }
+	bitmap.ForEachFreeRun(bm,func(p, l int64) bool {
+		if l>=lng { pos,ok = pa.acceptRun(i,p,l,lng) }
+		return !ok
+	})
+	return
+}
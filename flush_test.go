@@ -0,0 +1,117 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"github.com/byte-mug/filealloc"
+	"github.com/byte-mug/filealloc/crashtest"
+)
+
+var errInjected = errors.New("injected")
+
+// A MemFile, whose writes fail after the first ok ones, while ok is not negative.
+type failFile struct{
+	*crashtest.MemFile
+	ok int
+}
+
+func (f *failFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.ok==0 { return 0,errInjected }
+	if f.ok>0 { f.ok-- }
+	return f.MemFile.WriteAt(p,off)
+}
+
+func dirtyChunks(t *testing.T, pa *filealloc.PageAllocator) (l []int) {
+	var buf bytes.Buffer
+	if err := pa.DebugDump(&buf,filealloc.DumpJSON); err!=nil { t.Fatal(err) }
+	d,err := filealloc.LoadDump(&buf)
+	if err!=nil { t.Fatal(err) }
+	for _,c := range d.Chunks {
+		if c.Dirty { l = append(l,c.Index) }
+	}
+	return
+}
+
+// Allocates a block in each of n chunks.
+func spread(t *testing.T, pa *filealloc.PageAllocator, n int) (blks []int64) {
+	for len(blks)<n {
+		if len(blks)>0 {
+			if _,ok,err := pa.AllocateBlocks(pa.RunSizeInBlocks()-1,true); !ok || err!=nil { t.Fatal(ok,err) }
+		}
+		blk,ok,err := pa.AllocateBlocks(1,true)
+		if !ok || err!=nil { t.Fatal(ok,err) }
+		blks = append(blks,blk)
+	}
+	return
+}
+
+// A write error in any step of a multi-chunk flush leaves the unwritten chunks dirty, so that the next Flush writes them.
+func TestFlushWriteError(t *testing.T) {
+	for _,opts := range [][]filealloc.Option{
+		nil,
+		{filealloc.WithTrailers()},
+		{filealloc.WithDoublewrite()},
+		{filealloc.WithDoublewrite(),filealloc.WithTrailers()},
+	}{
+		for ok := 0; ; ok++ {
+			f := &failFile{crashtest.NewMemFile(nil),-1}
+			cfg := filealloc.NewFormatConfig(9)
+			cfg.PrefixBlocks = 5
+			pa,err := filealloc.Create(f,cfg,append(opts,filealloc.WithoutMmap(),filealloc.WithSyncPolicy(filealloc.SyncOnFlush,0))...)
+			if err!=nil { t.Fatal(err) }
+			if err = pa.Flush(); err!=nil { t.Fatal(err) }
+			blks := spread(t,pa,3)
+			used := pa.UsedBlocks()
+			f.ok = ok
+			err = pa.Flush()
+			f.ok = -1
+			if err==nil {
+				if ok==0 { t.Fatal("no write") }
+				break
+			}
+			if !errors.Is(err,errInjected) { t.Fatal(ok,err) }
+			if len(dirtyChunks(t,pa))==0 { t.Fatalf("%d writes: no chunk left dirty",ok) }
+			if err = pa.Flush(); err!=nil { t.Fatal(ok,err) }
+			if l := dirtyChunks(t,pa); len(l)!=0 { t.Fatal(ok,l) }
+			pa.Close()
+	
+			pa,err = filealloc.Open(f,filealloc.FormatConfig{})
+			if err!=nil { t.Fatal(ok,err) }
+			if pa.UsedBlocks()!=used { t.Fatalf("%d writes: %d blocks used, %d expected",ok,pa.UsedBlocks(),used) }
+			for _,b := range blks {
+				if err = pa.FreeBlocks(b,1); err!=nil { t.Fatal(ok,err) }
+			}
+			pa.Close()
+		}
+	}
+}
+
+// A generation mismatch in one chunk writes none of them, and leaves them all dirty.
+func TestFlushGenerationMismatch(t *testing.T) {
+	f := crashtest.NewMemFile(nil)
+	pa,err := filealloc.Create(f,filealloc.NewFormatConfig(9),filealloc.WithTrailers(),filealloc.WithoutMmap(),filealloc.WithSyncPolicy(filealloc.SyncOnFlush,0))
+	if err!=nil { t.Fatal(err) }
+	blks := spread(t,pa,3)
+	if err = pa.Flush(); err!=nil { t.Fatal(err) }
+	before := f.Bytes()
+	
+	// Another writer modifies the last chunk.
+	pa2,err := filealloc.Open(f,filealloc.FormatConfig{},filealloc.WithoutMmap())
+	if err!=nil { t.Fatal(err) }
+	if _,ok,err := pa2.AllocateBlocks(pa2.RunSizeInBlocks()-1,false); !ok || err!=nil { t.Fatal(ok,err) }
+	after := f.Bytes()
+	
+	for _,b := range blks {
+		if err = pa.FreeBlocks(b,1); err!=nil { t.Fatal(err) }
+	}
+	if l := dirtyChunks(t,pa); len(l)!=3 { t.Fatal(l) }
+	if err = pa.Flush(); !errors.Is(err,filealloc.CONCURRENTMODIFICATION) { t.Fatal(err) }
+	if l := dirtyChunks(t,pa); len(l)!=3 { t.Fatal("marked clean",l) }
+	if !bytes.Equal(f.Bytes(),after) { t.Fatal("written") }
+	if bytes.Equal(before,after) { t.Fatal("not modified") }
+}
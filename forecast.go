@@ -0,0 +1,138 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"time"
+)
+
+/*
+Optional interface of a Storage, that knows the size in bytes, it can grow to at most,
+like the file size plus the free space of the file system. See the osfile package for an implementation.
+*/
+type CapacityReporter interface{
+	Capacity() (int64, error)
+}
+
+const (
+	defaultForecastWindow = 10*time.Minute
+	
+	// The usage history keeps this many samples, at least historyInterval apart.
+	// When it is full, every other sample is dropped and the interval doubles.
+	historySamples = 128
+	historyInterval = time.Second
+)
+
+// A prediction of the time, until the blocks are used up.
+type Forecast struct{
+	// Growth of the used blocks per second, over the window. Negative, if the usage shrinks.
+	Rate float64
+	
+	// Blocks, that can still be allocated, up to MaxChunks or the Capacity() of the Storage.
+	Remaining int64
+	
+	// Time until the Remaining blocks are used up at Rate.
+	Exhaustion time.Duration
+	
+	// Exhaustion is valid: the capacity is limited and the usage grows.
+	OK bool
+}
+
+type usageSample struct{
+	t    time.Time
+	used int64
+}
+
+type usageHistory struct{
+	samples  []usageSample
+	interval time.Duration
+	// EventExhaustion was emitted.
+	alerted  bool
+}
+
+// Records a sample, unless the previous one is too recent.
+func (h *usageHistory) add(now time.Time, used int64) bool {
+	if h.interval==0 { h.interval = historyInterval }
+	if n := len(h.samples); n>0 && now.Sub(h.samples[n-1].t)<h.interval { return false }
+	if len(h.samples)==historySamples {
+		j := 0
+		for i := 0; i<len(h.samples); i += 2 {
+			h.samples[j] = h.samples[i]
+			j++
+		}
+		h.samples = h.samples[:j]
+		h.interval *= 2
+	}
+	h.samples = append(h.samples,usageSample{now,used})
+	return true
+}
+
+// Returns the oldest sample within the window.
+func (h *usageHistory) base(now time.Time, window time.Duration) (s usageSample, ok bool) {
+	from := now.Add(-window)
+	for _,s = range h.samples {
+		if !s.t.Before(from) { return s,true }
+	}
+	return
+}
+
+// Returns the number of blocks, the file can hold at most.
+func (pa *PageAllocator) capacityBlocks() (n int64, ok bool) {
+	if pa.MaxChunks>0 { return int64(pa.MaxChunks)*pa.RunSizeInBlocks(),true }
+	cr,ok := pa.Storage.(CapacityReporter)
+	if !ok { return }
+	size,err := cr.Capacity()
+	if err!=nil { return 0,false }
+	chunks := (size-int64(pa.PrefixBlocks)<<pa.BlockSizeLog)/(pa.ChunkSizeInBlocks()<<pa.BlockSizeLog)
+	if c := int64(len(pa.allocators)); chunks<c { chunks = c }
+	return chunks*pa.RunSizeInBlocks(),true
+}
+
+/*
+Predicts, when the blocks are used up at the rate, at which the usage grew in the last window.
+The capacity is limited by MaxChunks, or by the Capacity() of the Storage, if it is a CapacityReporter.
+
+The usage is sampled at most once per second. As the history grows, older samples are thinned out.
+*/
+func (pa *PageAllocator) EstimateExhaustion(window time.Duration) Forecast {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	return pa.forecast(window)
+}
+
+func (pa *PageAllocator) forecast(window time.Duration) (f Forecast) {
+	now := time.Now()
+	used := pa.usedBlocks.Load()
+	total,limited := pa.capacityBlocks()
+	if limited {
+		f.Remaining = total-used
+		if f.Remaining<0 { f.Remaining = 0 }
+	}
+	s,ok := pa.history.base(now,window)
+	if !ok { return }
+	secs := now.Sub(s.t).Seconds()
+	if secs<=0 { return }
+	f.Rate = float64(used-s.used)/secs
+	if !limited || f.Rate<=0 { return }
+	f.Exhaustion = time.Duration(float64(f.Remaining)/f.Rate*float64(time.Second))
+	f.OK = true
+	return
+}
+
+func (pa *PageAllocator) forecastWindow() time.Duration {
+	if pa.ForecastWindow>0 { return pa.ForecastWindow }
+	return defaultForecastWindow
+}
+
+// Samples the usage and emits EventExhaustion, if the forecast exhaustion came closer than ForecastAlert.
+func (pa *PageAllocator) sampleUsage() {
+	if !pa.history.add(time.Now(),pa.usedBlocks.Load()) || pa.ForecastAlert<=0 { return }
+	f := pa.forecast(pa.forecastWindow())
+	near := f.OK && f.Exhaustion<pa.ForecastAlert
+	if near && !pa.history.alerted {
+		pa.emit(Event{Kind: EventExhaustion, Exhaustion: f.Exhaustion})
+	}
+	pa.history.alerted = near
+}
@@ -0,0 +1,396 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sort"
+)
+
+// The handle is not in the table.
+var NOHANDLE = errors.New("NO_HANDLE")
+
+// Not the root of a HandleTable, or the table is damaged.
+var BADHANDLETABLE = errors.New("BAD_HANDLE_TABLE")
+
+// The handle names an extent from Allocate, not an object from Store.
+var NOTOBJECT = errors.New("NOT_AN_OBJECT")
+
+// A stable name of an extent, that survives MoveBlocks. See HandleTable.
+type Handle uint64
+
+// Tables with 24-byte entries, and with the records below.
+const (
+	handleMagic1 = "FAHANDL1"
+	handleMagic = "FAHANDL2"
+)
+
+/*
+Layout of a root slot (little endian), after the magic:
+	sequence number
+	next handle
+	first block and length of the records
+	size of the records in bytes (FAHANDL1: number of entries)
+	crc32 of the records
+	crc32 of the slot up to here
+Each record takes 32 bytes: handle, first block, length, object size (-1 for extents from Allocate).
+Inline objects have a length of 0; their payload follows, padded to 8 bytes.
+FAHANDL1 entries lack the object size.
+*/
+const (
+	handleRootSize = 5*8+2*4
+	handleEntry1 = 24
+	handleRecord = 32
+)
+
+// An extent, or an object stored in blocks or inline.
+type handleEntry struct{
+	Extent
+	// Bytes of the object, or -1.
+	size   int64
+	inline []byte
+}
+
+/*
+Maps Handles to extents. When MoveBlocks moves an extent, its handle is updated, so that
+applications, that store handles rather than block numbers, survive defragmentation.
+Besides extents, the table stores objects (see Store): those up to the inline limit are kept
+in the table itself, rather than in blocks of their own.
+
+The table is kept in blocks of the allocator: two root blocks, that the caller keeps the address
+of (see Root), and the records, which are written copy-on-write on every change, and then
+committed by writing the root block not written last. A crash leaves either table intact, but may leak
+the blocks of the older records. The blocks of the table itself must not be moved.
+The table must not be used with MultiProcess.
+*/
+type HandleTable struct{
+	pa      *PageAllocator
+	root    int64
+	seq     uint64
+	next    Handle
+	data    Extent
+	entries map[Handle]*handleEntry
+	// An extent, that MoveBlocks might move, to its handle.
+	byStart map[int64]Handle
+	inlineLimit int
+	closed  bool
+}
+
+func newHandleTable(pa *PageAllocator, root int64) *HandleTable {
+	return &HandleTable{pa: pa, root: root, next: 1, entries: make(map[Handle]*handleEntry), byStart: make(map[int64]Handle)}
+}
+
+// Creates an empty HandleTable, in blocks allocated from pa. Store Root() to open it again.
+func CreateHandleTable(pa *PageAllocator) (t *HandleTable, err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	pa.privileged = true
+	root,ok,err := pa.allocate(2,true,false)
+	pa.privileged = false
+	if err==nil && !ok { err = EXTHAUSTED }
+	if err!=nil { return }
+	t = newHandleTable(pa,root)
+	if err = t.save(); err!=nil {
+		pa.doFree(root,2)
+		return nil,err
+	}
+	pa.relocators = append(pa.relocators,t)
+	return
+}
+
+// Opens the HandleTable, whose root blocks start at root.
+func OpenHandleTable(pa *PageAllocator, root int64) (t *HandleTable, err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	t = newHandleTable(pa,root)
+	le := binary.LittleEndian
+	var best []byte
+	v1 := false
+	for slot := int64(0); slot<2; slot++ {
+		b := make([]byte,handleRootSize+len(handleMagic))
+		if _,e := pa.ReadAt(b,(root+slot)<<pa.BlockSizeLog); e!=nil { continue }
+		magic := string(b[:len(handleMagic)])
+		if magic!=handleMagic && magic!=handleMagic1 { continue }
+		b = b[len(handleMagic):]
+		if crc32.ChecksumIEEE(b[:handleRootSize-4])!=le.Uint32(b[handleRootSize-4:]) { continue }
+		if best==nil || le.Uint64(b)>le.Uint64(best) { best,v1 = b,magic==handleMagic1 }
+	}
+	if best==nil { return nil,BADHANDLETABLE }
+	t.seq,t.next = le.Uint64(best),Handle(le.Uint64(best[8:]))
+	t.data = Extent{int64(le.Uint64(best[16:])),int64(le.Uint64(best[24:]))}
+	n := int64(le.Uint64(best[32:]))
+	if v1 { n *= handleEntry1 }
+	if n<0 || n>t.data.Len<<pa.BlockSizeLog { return nil,BADHANDLETABLE }
+	buf := make([]byte,n)
+	if n>0 {
+		if _,err = pa.ReadAt(buf,t.data.Start<<pa.BlockSizeLog); err!=nil { return nil,err }
+	}
+	if crc32.ChecksumIEEE(buf)!=le.Uint32(best[40:]) { return nil,BADHANDLETABLE }
+	for len(buf)>0 {
+		if len(buf)<handleEntry1 { return nil,BADHANDLETABLE }
+		h := Handle(le.Uint64(buf))
+		e := &handleEntry{Extent{int64(le.Uint64(buf[8:])),int64(le.Uint64(buf[16:]))},-1,nil}
+		if v1 {
+			buf = buf[handleEntry1:]
+		} else {
+			if len(buf)<handleRecord { return nil,BADHANDLETABLE }
+			e.size = int64(le.Uint64(buf[24:]))
+			buf = buf[handleRecord:]
+			if e.Len==0 {
+				pad := (e.size+7)&^7
+				if e.size<0 || pad>int64(len(buf)) { return nil,BADHANDLETABLE }
+				e.inline = append([]byte(nil),buf[:e.size]...)
+				buf = buf[pad:]
+			}
+		}
+		t.put(h,e)
+	}
+	pa.relocators = append(pa.relocators,t)
+	return
+}
+
+// Returns the first of the two root blocks.
+func (t *HandleTable) Root() int64 { return t.root }
+
+// Sets the size in bytes, up to which Store and Update keep objects in the table. It is not persisted.
+func (t *HandleTable) SetInlineLimit(n int) (err error) {
+	if err = t.pa.enter(); err!=nil { return }
+	defer t.pa.leave(&err)
+	t.inlineLimit = n
+	return
+}
+
+// Writes the records to new blocks and commits them in the other root slot. pa.mu must be held.
+func (t *HandleTable) save() (err error) {
+	pa := t.pa
+	hs := make([]Handle,0,len(t.entries))
+	for h := range t.entries { hs = append(hs,h) }
+	sort.Slice(hs,func(i, j int) bool { return hs[i]<hs[j] })
+	var buf []byte
+	le := binary.LittleEndian
+	for _,h := range hs {
+		e := t.entries[h]
+		var b [handleRecord]byte
+		le.PutUint64(b[:],uint64(h))
+		le.PutUint64(b[8:],uint64(e.Start))
+		le.PutUint64(b[16:],uint64(e.Len))
+		le.PutUint64(b[24:],uint64(e.size))
+		buf = append(buf,b[:]...)
+		if e.Len==0 {
+			buf = append(buf,e.inline...)
+			buf = append(buf,make([]byte,(8-len(e.inline)&7)&7)...)
+		}
+	}
+	var data Extent
+	if len(buf)>0 {
+		data.Len = pa.BlocksFor(int64(len(buf)))
+		if data.Len>pa.RunSizeInBlocks() { return EXCEEDMAX }
+		pa.privileged = true
+		blk,ok,err := pa.allocate(data.Len,true,false)
+		pa.privileged = false
+		if err==nil && !ok { err = EXTHAUSTED }
+		if err!=nil { return err }
+		data.Start = blk
+		if _,err = pa.WriteAt(buf,blk<<pa.BlockSizeLog); err==nil && !pa.DontFsync { err = pa.Sync() }
+		if err!=nil {
+			pa.doFree(data.Start,data.Len)
+			return err
+		}
+	}
+	slot := make([]byte,len(handleMagic)+handleRootSize)
+	copy(slot,handleMagic)
+	r := slot[len(handleMagic):]
+	le.PutUint64(r,t.seq+1)
+	le.PutUint64(r[8:],uint64(t.next))
+	le.PutUint64(r[16:],uint64(data.Start))
+	le.PutUint64(r[24:],uint64(data.Len))
+	le.PutUint64(r[32:],uint64(len(buf)))
+	le.PutUint32(r[40:],crc32.ChecksumIEEE(buf))
+	le.PutUint32(r[44:],crc32.ChecksumIEEE(r[:44]))
+	_,err = pa.WriteAt(slot,(t.root+int64((t.seq+1)&1))<<pa.BlockSizeLog)
+	if err==nil && !pa.DontFsync { err = pa.Sync() }
+	if err!=nil {
+		if data.Len>0 { pa.doFree(data.Start,data.Len) }
+		return
+	}
+	t.seq++
+	old := t.data
+	t.data = data
+	if old.Len>0 { err = pa.doFree(old.Start,old.Len) }
+	return
+}
+
+// Replaces the entry of h in memory. nil removes it.
+func (t *HandleTable) put(h Handle, e *handleEntry) {
+	if old,ok := t.entries[h]; ok && old.Len>0 { delete(t.byStart,old.Start) }
+	if e==nil {
+		delete(t.entries,h)
+		return
+	}
+	t.entries[h] = e
+	if e.Len>0 { t.byStart[e.Start] = h }
+}
+
+// Replaces the entry of h and saves the table. Restores the entry, if that fails.
+func (t *HandleTable) set(h Handle, e *handleEntry) (err error) {
+	old := t.entries[h]
+	t.put(h,e)
+	if err = t.save(); err!=nil { t.put(h,old) }
+	return
+}
+
+// Allocates lng blocks like AllocateBlocks, and a handle for them.
+func (t *HandleTable) Allocate(lng int64, grow bool) (h Handle, e Extent, err error) {
+	pa := t.pa
+	if lng<=0 { return 0,e,&RangeError{0,lng,FaultLength} }
+	if lng>pa.RunSizeInBlocks() { return 0,e,EXCEEDMAX }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if t.closed { return 0,e,BADHANDLETABLE }
+	blk,ok,err := pa.allocate(lng,grow,false)
+	if err==nil && !ok { err = EXTHAUSTED }
+	if err!=nil { return }
+	h = t.next
+	t.next++
+	if err = t.set(h,&handleEntry{Extent{blk,lng},-1,nil}); err!=nil {
+		pa.doFree(blk,lng)
+		return 0,e,err
+	}
+	return h,Extent{blk,lng},nil
+}
+
+// Returns the extent of the handle. The extent of an inline object is empty.
+func (t *HandleTable) Resolve(h Handle) (e Extent, ok bool, err error) {
+	if err = t.pa.enter(); err!=nil { return }
+	defer t.pa.leave(&err)
+	if x,ok := t.entries[h]; ok { return x.Extent,true,nil }
+	return
+}
+
+// Frees the extent or object of the handle, and the handle. The extent goes through the quarantine, like FreeBlocks.
+func (t *HandleTable) Free(h Handle) (err error) {
+	pa := t.pa
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	e,ok := t.entries[h]
+	if !ok || t.closed { return NOHANDLE }
+	if err = pa.checkLeases(e.Start,e.Len); err!=nil { return }
+	if err = t.set(h,nil); err!=nil || e.Len==0 { return }
+	return pa.free(e.Start,e.Len)
+}
+
+// Returns the number of handles.
+func (t *HandleTable) Len() (n int, err error) {
+	if err = t.pa.enter(); err!=nil { return }
+	defer t.pa.leave(&err)
+	return len(t.entries),nil
+}
+
+// Places data inline or in newly written blocks. pa.mu must be held.
+func (t *HandleTable) place(data []byte, grow bool) (e *handleEntry, err error) {
+	pa := t.pa
+	e = &handleEntry{size: int64(len(data))}
+	if len(data)<=t.inlineLimit {
+		e.inline = append([]byte(nil),data...)
+		return
+	}
+	lng := pa.BlocksFor(int64(len(data)))
+	if lng>pa.RunSizeInBlocks() { return nil,EXCEEDMAX }
+	blk,ok,err := pa.allocate(lng,grow,false)
+	if err==nil && !ok { err = EXTHAUSTED }
+	if err!=nil { return }
+	e.Extent = Extent{blk,lng}
+	if _,err = pa.WriteAt(data,blk<<pa.BlockSizeLog); err==nil && !pa.DontFsync { err = pa.Sync() }
+	if err!=nil {
+		pa.doFree(blk,lng)
+		return nil,err
+	}
+	return
+}
+
+// Stores data as a new object, inline if it fits into the inline limit. Returns its handle.
+func (t *HandleTable) Store(data []byte, grow bool) (h Handle, err error) {
+	pa := t.pa
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if t.closed { return 0,BADHANDLETABLE }
+	e,err := t.place(data,grow)
+	if err!=nil { return }
+	h = t.next
+	t.next++
+	if err = t.set(h,e); err!=nil {
+		if e.Len>0 { pa.doFree(e.Start,e.Len) }
+		return 0,err
+	}
+	return
+}
+
+/*
+Replaces the object of the handle. The new data is placed like in Store: an inline object spills
+to blocks, once it outgrows the inline limit, and moves back, once it fits again.
+The old blocks are freed after the table is committed, through the quarantine like FreeBlocks.
+*/
+func (t *HandleTable) Update(h Handle, data []byte, grow bool) (err error) {
+	pa := t.pa
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	old,ok := t.entries[h]
+	if !ok || t.closed { return NOHANDLE }
+	if old.size<0 { return NOTOBJECT }
+	if err = pa.checkLeases(old.Start,old.Len); err!=nil { return }
+	e,err := t.place(data,grow)
+	if err!=nil { return }
+	if err = t.set(h,e); err!=nil {
+		if e.Len>0 { pa.doFree(e.Start,e.Len) }
+		return
+	}
+	if old.Len>0 { err = pa.free(old.Start,old.Len) }
+	return
+}
+
+// Returns the data of the object of the handle.
+func (t *HandleTable) Load(h Handle) (data []byte, err error) {
+	pa := t.pa
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	e,ok := t.entries[h]
+	if !ok || t.closed { return nil,NOHANDLE }
+	if e.size<0 { return nil,NOTOBJECT }
+	if e.Len==0 { return append([]byte(nil),e.inline...),nil }
+	data = make([]byte,e.size)
+	_,err = pa.ReadAt(data,e.Start<<pa.BlockSizeLog)
+	return
+}
+
+// Updates the handle of a moved extent. Called by MoveBlocks.
+func (t *HandleTable) relocated(from Extent, to int64) error {
+	h,ok := t.byStart[from.Start]
+	if !ok || t.entries[h].Len!=from.Len { return nil }
+	e := *t.entries[h]
+	e.Start = to
+	return t.set(h,&e)
+}
+
+// The extents, that MoveBlocks may move, for the compactor.
+func (t *HandleTable) movableExtents() (l []Extent) {
+	for _,h := range t.byStart { l = append(l,t.entries[h].Extent) }
+	return
+}
+
+// Stops following MoveBlocks. The table stays in the file.
+func (t *HandleTable) Close() (err error) {
+	pa := t.pa
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	t.closed = true
+	for i,r := range pa.relocators {
+		if r!=relocator(t) { continue }
+		pa.relocators = append(pa.relocators[:i],pa.relocators[i+1:]...)
+		break
+	}
+	return
+}
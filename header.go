@@ -0,0 +1,65 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import "io"
+
+/*
+The user header is the part of the prefix blocks, that the allocator doesn't use for its own metadata.
+Applications may store their own data there, like root pointers.
+
+For allocators set up with Init(), this is the whole prefix.
+*/
+func (pa *PageAllocator) userHeader() (off, size int64) {
+	if pa.hasSuper { off = int64(pa.metaBlocks())<<pa.BlockSizeLog }
+	size = (int64(pa.PrefixBlocks)<<pa.BlockSizeLog) - off
+	if size<0 { size = 0 }
+	return
+}
+
+// Returns the size of the user header in bytes.
+func (pa *PageAllocator) UserHeaderSize() int64 {
+	_,size := pa.userHeader()
+	return size
+}
+
+/*
+Reads from the user header. Reading past its end returns io.EOF. The part of the header, that the
+file doesn't reach yet, reads as zeros; other errors of the Storage are returned.
+*/
+func (pa *PageAllocator) ReadUserHeader(p []byte, off int64) (n int, err error) {
+	base,size := pa.userHeader()
+	if off<0 || off>=size { return 0,io.EOF }
+	if int64(len(p))>size-off {
+		p = p[:size-off]
+		err = io.EOF
+	}
+	n,err2 := pa.ReadAt(p,base+off)
+	switch {
+	case err2==io.EOF || err2==io.ErrUnexpectedEOF:
+		// The prefix may not be written yet.
+		for i := n; i<len(p); i++ { p[i] = 0 }
+		n = len(p)
+	case err2!=nil:
+		return n,err2
+	}
+	return
+}
+
+/*
+Writes to the user header and syncs the file (unless DontFsync is set).
+Writing past its end writes as much as fits and returns io.ErrShortWrite.
+*/
+func (pa *PageAllocator) WriteUserHeader(p []byte, off int64) (n int, err error) {
+	base,size := pa.userHeader()
+	if off<0 || off>size { return 0,io.ErrShortWrite }
+	short := int64(len(p))>size-off
+	if short { p = p[:size-off] }
+	n,err = pa.WriteAt(p,base+off)
+	if err!=nil { return }
+	if !pa.DontFsync { err = pa.Sync() }
+	if err==nil && short { err = io.ErrShortWrite }
+	return
+}
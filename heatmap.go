@@ -0,0 +1,142 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"time"
+)
+
+/*
+Where allocations and frees happened over the HeatmapWindow, by region of each chunk.
+Region r of a chunk holds its data blocks [r*RegionBlocks,(r+1)*RegionBlocks).
+*/
+type Heatmap struct{
+	Window       time.Duration
+	Regions      int
+	RegionBlocks int64
+	
+	// Allocs[c][r] and Frees[c][r] count the operations, that started in region r of chunk c.
+	Allocs, Frees [][]int64
+}
+
+// The allocations and frees in the chunk.
+func (h *Heatmap) Chunk(c int64) (allocs, frees int64) {
+	if c<0 || c>=int64(len(h.Allocs)) { return }
+	for r := range h.Allocs[c] {
+		allocs += h.Allocs[c][r]
+		frees += h.Frees[c][r]
+	}
+	return
+}
+
+// Returns the chunk with the most allocations and frees, or -1, if there were none.
+func (h *Heatmap) Hottest() (c int64) {
+	c,max := -1,int64(0)
+	for i := range h.Allocs {
+		if a,f := h.Chunk(int64(i)); a+f>max { c,max = int64(i),a+f }
+	}
+	return
+}
+
+type heatCount struct{
+	allocs, frees int64
+}
+
+/*
+The counts are kept for two halves of the window. When the current half is over, it becomes the
+previous one. The previous half is weighted by the part of it, that is still in the window.
+*/
+type heatState struct{
+	start     time.Time
+	regions   int
+	cur, prev []heatCount
+}
+
+// Sets HeatmapWindow and HeatmapRegions. Changing them discards the counts.
+func WithHeatmap(window time.Duration, regions int) Option {
+	if window<0 || regions<0 { return badOption("WithHeatmap","window %v, %d regions",window,regions) }
+	return Option{"WithHeatmap",optLive,nil,func(pa *PageAllocator) {
+		pa.HeatmapWindow,pa.HeatmapRegions = window,regions
+		pa.heat = heatState{}
+	}}
+}
+
+// Returns the number of regions per chunk, and their size in blocks.
+func (pa *PageAllocator) heatRegions() (n int, size int64) {
+	n = pa.HeatmapRegions
+	if n<=0 { n = 1 }
+	if max := pa.RunSizeInBlocks(); int64(n)>max { n = int(max) }
+	return n,(pa.RunSizeInBlocks()+int64(n)-1)/int64(n)
+}
+
+// Advances the window to now.
+func (h *heatState) advance(now time.Time, window time.Duration) {
+	half := window/2
+	switch d := now.Sub(h.start); {
+	case h.start.IsZero() || d>=window:
+		for i := range h.cur { h.cur[i],h.prev[i] = heatCount{},heatCount{} }
+		h.start = now
+	case d>=half:
+		h.cur,h.prev = h.prev,h.cur
+		for i := range h.cur { h.cur[i] = heatCount{} }
+		h.start = h.start.Add(half)
+	}
+}
+
+// Counts an allocation or free of the blocks of op.
+func (pa *PageAllocator) countHeat(op Op) {
+	if pa.HeatmapWindow<=0 || op.Kind==OpKindGrow { return }
+	c,pos,ok := pa.BreakAddress(op.Start)
+	if !ok || c>=int64(len(pa.allocators)) { return }
+	h := &pa.heat
+	n,size := pa.heatRegions()
+	if h.regions!=n { *h = heatState{regions: n} }
+	h.advance(time.Now(),pa.HeatmapWindow)
+	if need := len(pa.allocators)*h.regions; len(h.cur)<need {
+		h.cur = append(h.cur,make([]heatCount,need-len(h.cur))...)
+		h.prev = append(h.prev,make([]heatCount,need-len(h.prev))...)
+	}
+	i := int(c)*n+int(pos/size)
+	if op.Kind==OpKindFree {
+		h.cur[i].frees++
+	} else {
+		h.cur[i].allocs++
+	}
+}
+
+// The heatmap, or nil, if HeatmapWindow is not set. pa.mu must be held.
+func (pa *PageAllocator) heatmap() *Heatmap {
+	if pa.HeatmapWindow<=0 { return nil }
+	h := &pa.heat
+	n,size := pa.heatRegions()
+	if h.regions!=n { *h = heatState{regions: n} }
+	now := time.Now()
+	h.advance(now,pa.HeatmapWindow)
+	// The part of the previous half, that is still in the window.
+	left := 0.0
+	if half := pa.HeatmapWindow/2; half>0 && now.Sub(h.start)<half { left = float64(half-now.Sub(h.start))/float64(half) }
+	hm := &Heatmap{Window: pa.HeatmapWindow, Regions: n, RegionBlocks: size}
+	hm.Allocs = make([][]int64,len(pa.allocators))
+	hm.Frees = make([][]int64,len(pa.allocators))
+	for c := range hm.Allocs {
+		hm.Allocs[c],hm.Frees[c] = make([]int64,n),make([]int64,n)
+		for r := 0; r<n; r++ {
+			i := c*n+r
+			if i>=len(h.cur) { break }
+			hm.Allocs[c][r] = h.cur[i].allocs
+			hm.Frees[c][r] = h.cur[i].frees
+			hm.Allocs[c][r] += int64(float64(h.prev[i].allocs)*left)
+			hm.Frees[c][r] += int64(float64(h.prev[i].frees)*left)
+		}
+	}
+	return hm
+}
+
+// Returns the heatmap, or nil, if HeatmapWindow is not set.
+func (pa *PageAllocator) Heatmap() *Heatmap {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	return pa.heatmap()
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Identifies an allocator file. It is a random (version 4) UUID, generated by Create().
+type FileID [16]byte
+
+func newFileID() (id FileID, err error) {
+	if _,err = rand.Read(id[:]); err!=nil { return }
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return
+}
+
+// Returns the id in the usual UUID notation.
+func (id FileID) String() string {
+	var b [36]byte
+	hex.Encode(b[0:8],id[0:4])
+	hex.Encode(b[9:13],id[4:6])
+	hex.Encode(b[14:18],id[6:8])
+	hex.Encode(b[19:23],id[8:10])
+	hex.Encode(b[24:],id[10:])
+	b[8],b[13],b[18],b[23] = '-','-','-','-'
+	return string(b[:])
+}
+
+func (id FileID) MarshalText() ([]byte, error) { return []byte(id.String()),nil }
+
+func (id *FileID) UnmarshalText(b []byte) error {
+	var h [32]byte
+	n := 0
+	for _,c := range b {
+		if c=='-' { continue }
+		if n==len(h) { return BADDUMP }
+		h[n] = c
+		n++
+	}
+	if n!=len(h) { return BADDUMP }
+	_,err := hex.Decode(id[:],h[:])
+	return err
+}
+
+// Returns the id of the file. It is zero, if the file has no superblock.
+func (pa *PageAllocator) ID() FileID { return pa.super.id }
+
+// Returns the time, the file was created. It is zero, if the file has no superblock.
+func (pa *PageAllocator) CreatedAt() time.Time {
+	if pa.super.created==0 { return time.Time{} }
+	return time.Unix(0,pa.super.created)
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"io"
+)
+
+/*
+An allocator file in memory, opened read-only: a Snapshot of its bitmaps along with its data
+blocks. See OpenBytes. Like a Snapshot, it is safe for concurrent use.
+*/
+type Image struct{
+	*Snapshot
+	data []byte
+}
+
+// A Storage over a byte slice, that can't be written.
+type bytesStorage []byte
+
+func (b bytesStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	if off<0 || off>=int64(len(b)) { return 0,io.EOF }
+	n = copy(p,b[off:])
+	if n<len(p) { err = io.EOF }
+	return
+}
+
+func (b bytesStorage) WriteAt(p []byte, off int64) (int, error) { return 0,UNSUPPORTED }
+func (b bytesStorage) Sync() error { return nil }
+func (b bytesStorage) Close() error { return nil }
+
+/*
+Opens the allocator file in data, a copy read from a backup blob or an embedded asset, for
+instance, without writing to it or to a temporary file: Stats, Iterate, ChunkBitmap and ReadBlock
+work like on the file opened with Open. data is not copied, and must not change meanwhile.
+
+If data has a superblock, the format is taken from it, and the fields, that cfg sets, must match
+it, as for Open; for a file without one (see Init), cfg must describe the format. The bitmap of the
+last chunk must be complete; data blocks beyond the end of data read as zeros, as in a sparse file.
+An image of a file, that was not closed cleanly, is not repaired: bitmap blocks, that fail the check
+of their trailer, count as used. The Summary and other side files are not read.
+*/
+func OpenBytes(data []byte, cfg FormatConfig) (m *Image, err error) {
+	pa := &PageAllocator{Storage: bytesStorage(data), FormatConfig: cfg}
+	if _,ok := pa.loadSuperblock(&pa.super); ok {
+		if err = pa.super.checkConfig(&cfg); err!=nil { return }
+		pa.super.format(&cfg)
+	}
+	if err = cfg.Validate(); err!=nil { return }
+	pa.FormatConfig = cfg
+	if err = pa.checkGeometry(); err!=nil { return }
+	pa.bitmapSize = pa.bitmapBytes()
+	n := pa.countChunks()
+	s := &Snapshot{cfg: cfg, bitmaps: make([][]byte,n), indices: make([]runIndex,n)}
+	for i := range s.bitmaps {
+		s.bitmaps[i] = make([]byte,pa.bitmapSize)
+		if _,_,err = pa.decodeBitmap(s.bitmaps[i],pa.MakeAddress(int64(i),-int64(pa.BitmapBlocks))<<pa.BlockSizeLog); err!=nil { return nil,err }
+	}
+	return &Image{s,data},nil
+}
+
+// Returns the format of the file.
+func (m *Image) Format() FormatConfig { return m.cfg }
+
+// Reads len(p) bytes from the data blocks starting at blk. The range must lie within one chunk's data region.
+func (m *Image) ReadBlock(blk int64, p []byte) (err error) {
+	if _,_,err = m.cfg.checkRangeIn(blk,m.cfg.BlocksFor(int64(len(p))),len(m.bitmaps)); err!=nil { return }
+	off,err := m.cfg.BlockOffset(blk)
+	if err!=nil { return }
+	n,_ := bytesStorage(m.data).ReadAt(p,off)
+	for i := n; i<len(p); i++ { p[i] = 0 }
+	return
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"time"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// The blocks are leased: they can't be freed or moved, until the lease ends. See Lease.
+var LEASED = errors.New("LEASED")
+
+// The lease doesn't exist, or it expired.
+var NOLEASE = errors.New("NO_LEASE")
+
+// Identifies a lease. See Lease.
+type LeaseID uint64
+
+// A lease on allocated blocks.
+type LeaseInfo struct{
+	ID LeaseID
+	Extent
+	Expires time.Time
+}
+
+type leaseState struct{
+	last   LeaseID
+	leases map[LeaseID]LeaseInfo
+}
+
+const leaseMagic = "FALEASE1"
+
+/*
+Layout of the lease table (little endian):
+	0  magic
+	8  the last lease id
+	16 number of leases
+	24 the leases: id, first block, length, expiry in unix nanoseconds
+	   crc32 of the preceding bytes
+*/
+const (
+	leaseHeader = 24
+	leaseRecord = 32
+)
+
+// Sets LeaseTable.
+func WithLeaseTable(s Storage) Option {
+	return Option{"WithLeaseTable",optOpen,nil,func(pa *PageAllocator) { pa.LeaseTable = s }}
+}
+
+/*
+Leases the allocated blocks of e for ttl: until the lease is released or expires, FreeBlocks and
+the other frees fail with LEASED, and MoveBlocks and the compactor leave the blocks in place.
+FreeDeferred fails with LEASED as well; frees it queued before wait for the lease to end. Backup agents and zero-copy readers use it,
+to read blocks, that the owner may free meanwhile, without seeing them reused.
+
+All blocks of e must be allocated. If LeaseTable is set, the lease survives a restart.
+*/
+func (pa *PageAllocator) Lease(e Extent, ttl time.Duration) (id LeaseID, err error) {
+	if ttl<=0 { return 0,fmt.Errorf("%w: lease for %v",BADCONFIG,ttl) }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	c,pos,err := pa.checkRange(e.Start,e.Len)
+	if err!=nil { return }
+	if n := bitmap.CountInUse(pa.bitmapOf(int(c)),pos,e.Len); n!=e.Len {
+		return 0,fmt.Errorf("%w: blocks %d+%d: %d are free",BADRANGE,e.Start,e.Len,e.Len-n)
+	}
+	if pa.leases.leases==nil { pa.leases.leases = make(map[LeaseID]LeaseInfo) }
+	pa.leases.last++
+	id = pa.leases.last
+	pa.leases.leases[id] = LeaseInfo{id,e,time.Now().Add(ttl)}
+	if err = pa.storeLeases(); err!=nil {
+		delete(pa.leases.leases,id)
+		return 0,err
+	}
+	return
+}
+
+// Extends the lease to ttl from now. Fails with NOLEASE, if it expired.
+func (pa *PageAllocator) Renew(id LeaseID, ttl time.Duration) (err error) {
+	if ttl<=0 { return fmt.Errorf("%w: lease for %v",BADCONFIG,ttl) }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	pa.expireLeases()
+	l,ok := pa.leases.leases[id]
+	if !ok { return NOLEASE }
+	old := l.Expires
+	l.Expires = time.Now().Add(ttl)
+	pa.leases.leases[id] = l
+	if err = pa.storeLeases(); err!=nil {
+		l.Expires = old
+		pa.leases.leases[id] = l
+	}
+	return
+}
+
+// Ends the lease. Fails with NOLEASE, if it expired.
+func (pa *PageAllocator) Release(id LeaseID) (err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	pa.expireLeases()
+	if _,ok := pa.leases.leases[id]; !ok { return NOLEASE }
+	delete(pa.leases.leases,id)
+	return pa.storeLeases()
+}
+
+// Returns the leases in effect, by ID.
+func (pa *PageAllocator) Leases() (l []LeaseInfo) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	pa.expireLeases()
+	return pa.leaseList()
+}
+
+func (pa *PageAllocator) leaseList() (l []LeaseInfo) {
+	for _,x := range pa.leases.leases { l = append(l,x) }
+	sort.Slice(l,func(i, j int) bool { return l[i].ID<l[j].ID })
+	return
+}
+
+func (pa *PageAllocator) expireLeases() {
+	now := time.Now()
+	for id,l := range pa.leases.leases {
+		if !now.Before(l.Expires) { delete(pa.leases.leases,id) }
+	}
+}
+
+// Fails with LEASED, if a lease covers any of the blocks [blk,blk+lng).
+func (pa *PageAllocator) checkLeases(blk, lng int64) error {
+	if len(pa.leases.leases)==0 || lng<=0 { return nil }
+	pa.expireLeases()
+	for _,l := range pa.leases.leases {
+		if blk<l.End() && l.Start<blk+lng { return fmt.Errorf("%w: blocks %d+%d, lease %d",LEASED,blk,lng,l.ID) }
+	}
+	return nil
+}
+
+// Writes the lease table and syncs it, if there is one.
+func (pa *PageAllocator) storeLeases() (err error) {
+	if pa.LeaseTable==nil { return }
+	b := make([]byte,leaseHeader+len(pa.leases.leases)*leaseRecord+4)
+	copy(b,leaseMagic)
+	binary.LittleEndian.PutUint64(b[8:],uint64(pa.leases.last))
+	binary.LittleEndian.PutUint64(b[16:],uint64(len(pa.leases.leases)))
+	o := leaseHeader
+	for _,l := range pa.leaseList() {
+		binary.LittleEndian.PutUint64(b[o:],uint64(l.ID))
+		binary.LittleEndian.PutUint64(b[o+8:],uint64(l.Start))
+		binary.LittleEndian.PutUint64(b[o+16:],uint64(l.Len))
+		binary.LittleEndian.PutUint64(b[o+24:],uint64(l.Expires.UnixNano()))
+		o += leaseRecord
+	}
+	binary.LittleEndian.PutUint32(b[o:],crc32.ChecksumIEEE(b[:o]))
+	if _,err = pa.LeaseTable.WriteAt(b,0); err!=nil { return }
+	return pa.LeaseTable.Sync()
+}
+
+// Reads the lease table. A damaged one is reported in the RecoveryReport. Called by Init.
+func (pa *PageAllocator) loadLeases() {
+	pa.leases = leaseState{leases: make(map[LeaseID]LeaseInfo)}
+	hdr := make([]byte,leaseHeader)
+	if n,_ := pa.LeaseTable.ReadAt(hdr,0); n==0 {
+		// A new table.
+		return
+	} else if n<len(hdr) || string(hdr[:8])!=leaseMagic {
+		pa.recovery.LeasesLost = true
+		return
+	}
+	n := binary.LittleEndian.Uint64(hdr[16:])
+	if n>1<<24 {
+		pa.recovery.LeasesLost = true
+		return
+	}
+	b := make([]byte,leaseHeader+int(n)*leaseRecord+4)
+	if k,_ := pa.LeaseTable.ReadAt(b,0); k<len(b) || binary.LittleEndian.Uint32(b[len(b)-4:])!=crc32.ChecksumIEEE(b[:len(b)-4]) {
+		pa.recovery.LeasesLost = true
+		return
+	}
+	pa.leases.last = LeaseID(binary.LittleEndian.Uint64(b[8:]))
+	for o := leaseHeader; o<len(b)-4; o += leaseRecord {
+		l := LeaseInfo{ID: LeaseID(binary.LittleEndian.Uint64(b[o:]))}
+		l.Start = int64(binary.LittleEndian.Uint64(b[o+8:]))
+		l.Len = int64(binary.LittleEndian.Uint64(b[o+16:]))
+		l.Expires = time.Unix(0,int64(binary.LittleEndian.Uint64(b[o+24:])))
+		pa.leases.leases[l.ID] = l
+	}
+	pa.expireLeases()
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An allocation exceeds HardLimitBlocks.
+var SIZELIMIT = errors.New("SIZE_LIMIT")
+
+// Describes an allocation, that HardLimitBlocks rejected. It matches SIZELIMIT with errors.Is.
+type LimitError struct{
+	Len, Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("SIZE_LIMIT: %d blocks, the limit is %d",e.Len,e.Limit)
+}
+
+func (e *LimitError) Is(target error) bool { return target==SIZELIMIT }
+
+type limitState struct{
+	softHits, hardHits int64
+	// The last request of the operation in progress over SoftLimitBlocks, for OnSoftLimit.
+	soft int64
+}
+
+// Sets SoftLimitBlocks, HardLimitBlocks and OnSoftLimit.
+func WithSizeLimits(soft, hard int64, onSoft func(lng int64)) Option {
+	if soft<0 || hard<0 { return badOption("WithSizeLimits","%d and %d blocks",soft,hard) }
+	if soft>0 && hard>0 && soft>hard { return badOption("WithSizeLimits","soft limit %d above the hard limit %d",soft,hard) }
+	return Option{"WithSizeLimits",optLive,nil,func(pa *PageAllocator) {
+		pa.SoftLimitBlocks,pa.HardLimitBlocks,pa.OnSoftLimit = soft,hard,onSoft
+	}}
+}
+
+/*
+Checks an allocation of lng blocks against the size limits. Privileged allocations and moves
+are exempt. pa.mu must be held.
+*/
+func (pa *PageAllocator) checkLimits(lng int64) error {
+	if pa.privileged || pa.unlimited { return nil }
+	if pa.HardLimitBlocks>0 && lng>pa.HardLimitBlocks {
+		pa.limits.hardHits++
+		return &LimitError{lng,pa.HardLimitBlocks}
+	}
+	if pa.SoftLimitBlocks>0 && lng>pa.SoftLimitBlocks {
+		pa.limits.softHits++
+		pa.limits.soft = lng
+	}
+	return nil
+}
+
+// Returns the request for OnSoftLimit, if the operation in progress exceeded the soft limit.
+func (pa *PageAllocator) softLimitHit() (lng int64, hit bool) {
+	lng,pa.limits.soft = pa.limits.soft,0
+	return lng,lng>0 && pa.OnSoftLimit!=nil
+}
+
+func (pa *PageAllocator) limitStats(st *Stats) {
+	st.SoftLimitBlocks,st.HardLimitBlocks = pa.SoftLimitBlocks,pa.HardLimitBlocks
+	st.SoftLimitHits,st.HardLimitHits = pa.limits.softHits,pa.limits.hardHits
+}
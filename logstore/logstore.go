@@ -0,0 +1,354 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+/*
+A crash-safe append-only log on top of filealloc, and an example of using the allocator right.
+
+The log is a chain of segments, extents of the allocator, that hold the records back to back.
+The root in the user header (see filealloc.PageAllocator.WriteUserHeader) names the first and the
+last segment and the bytes of the last one, that are committed. Appends write past the committed
+end; Commit makes them durable and visible, in this order:
+
+	1. A new segment is allocated with SyncEachOp, whatever the SyncPolicy of the allocator:
+	   its bitmap must be durable, before anything on disk points to it.
+	2. The header of the new segment is written and synced, before the previous segment links to it,
+	   so that a crash never leaves a link to stale blocks, that only look like a segment.
+	3. Commit syncs the records and the links, and only then writes the root, which syncs as well.
+	   The root is the commit point: a crash before it leaves the previous state.
+	4. TrimFront writes the root without the first segment, before it frees it. The free follows the
+	   SyncPolicy of the allocator: a crash before it is durable leaves the segment allocated, but
+	   never leaves the root pointing to blocks, that are reused.
+
+The root is written to one of two slots in turn, so that a torn write leaves the other one intact.
+Open takes the valid one with the higher sequence number, and frees the blocks, that no committed
+segment holds: segments, that an Append allocated after the last Commit, and a segment, whose free
+by TrimFront was lost. The log must therefore be the only user of the allocator.
+
+	pa,_ := filealloc.Create(f,filealloc.FormatConfig{BlockSizeLog: 12, BitmapBlocks: 1, PrefixBlocks: 2},
+		filealloc.WithSyncPolicy(filealloc.SyncGroupCommit,0))
+	l,_ := logstore.Create(pa,256)
+	l.Append([]byte("hello"))
+	l.Commit()
+	l.Iterate(func(rec []byte) bool { fmt.Printf("%s\n",rec); return true })
+*/
+package logstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"github.com/byte-mug/filealloc"
+)
+
+// The user header holds no valid root, or a segment or record is damaged.
+var BADLOG = errors.New("BADLOG")
+
+// The record doesn't fit into a segment.
+var TOOLARGE = errors.New("TOO_LARGE")
+
+const (
+	rootMagic    = "FALOGRT1"
+	segmentMagic = "FALOGSG1"
+)
+
+/*
+Layout of a root slot (little endian):
+	0  magic
+	8  sequence number
+	16 blocks per segment
+	24 first segment
+	32 last segment
+	40 committed bytes of the last segment
+	48 crc32 of the preceding bytes
+
+Layout of the header of a segment, in its first block:
+	0  magic
+	8  next segment, or 0
+	16 bytes of records, once the segment is followed by another one
+	24 crc32 of the preceding bytes
+
+A record is its length and the crc32 of its data (4 bytes each), followed by the data.
+*/
+const (
+	rootSlot      = 64
+	segmentHeader = 28
+	recordHeader  = 8
+)
+
+type root struct{
+	seq       uint64
+	segBlocks int64
+	first     int64
+	tail      int64
+	tailLen   int64
+}
+
+type segment struct{
+	next, used int64
+}
+
+// A log. Safe for concurrent use.
+type Log struct{
+	pa *filealloc.PageAllocator
+	mu sync.Mutex
+	// The last one committed.
+	root root
+	// The last segment and the bytes written to it, including those, that are not committed.
+	tail, end int64
+	dirty     bool
+}
+
+func (r *root) encode() []byte {
+	b := make([]byte,rootSlot)
+	copy(b,rootMagic)
+	binary.LittleEndian.PutUint64(b[8:],r.seq)
+	binary.LittleEndian.PutUint64(b[16:],uint64(r.segBlocks))
+	binary.LittleEndian.PutUint64(b[24:],uint64(r.first))
+	binary.LittleEndian.PutUint64(b[32:],uint64(r.tail))
+	binary.LittleEndian.PutUint64(b[40:],uint64(r.tailLen))
+	binary.LittleEndian.PutUint32(b[48:],crc32.ChecksumIEEE(b[:48]))
+	return b
+}
+
+func (r *root) decode(b []byte) bool {
+	if string(b[:8])!=rootMagic || binary.LittleEndian.Uint32(b[48:])!=crc32.ChecksumIEEE(b[:48]) { return false }
+	r.seq = binary.LittleEndian.Uint64(b[8:])
+	r.segBlocks = int64(binary.LittleEndian.Uint64(b[16:]))
+	r.first = int64(binary.LittleEndian.Uint64(b[24:]))
+	r.tail = int64(binary.LittleEndian.Uint64(b[32:]))
+	r.tailLen = int64(binary.LittleEndian.Uint64(b[40:]))
+	return true
+}
+
+/*
+Creates a log in pa, which should be new: the log takes the first 128 bytes of its user header,
+and all of its blocks (see Open).
+A segment has segmentBlocks blocks, the first of them holds its header; a record must fit into the others.
+*/
+func Create(pa *filealloc.PageAllocator, segmentBlocks int64) (l *Log, err error) {
+	if pa.UserHeaderSize()<2*rootSlot { return nil,fmt.Errorf("%w: user header of %d bytes",filealloc.BADCONFIG,pa.UserHeaderSize()) }
+	if segmentBlocks<2 || segmentBlocks>pa.RunSizeInBlocks() { return nil,fmt.Errorf("%w: %d blocks per segment",filealloc.BADCONFIG,segmentBlocks) }
+	l = &Log{pa: pa}
+	l.root.segBlocks = segmentBlocks
+	first,err := l.newSegment()
+	if err!=nil { return nil,err }
+	l.root.first,l.root.tail = first,first
+	l.tail = first
+	// A root left in the other slot would win, if it had a higher sequence number.
+	if _,err = pa.WriteUserHeader(make([]byte,2*rootSlot),0); err!=nil { return nil,err }
+	if err = l.writeRoot(l.root); err!=nil { return nil,err }
+	return
+}
+
+// Opens the log in pa, and frees the blocks, that no committed segment holds.
+func Open(pa *filealloc.PageAllocator) (l *Log, err error) {
+	l = &Log{pa: pa}
+	b := make([]byte,2*rootSlot)
+	if _,err = pa.ReadUserHeader(b,0); err!=nil { return nil,err }
+	var r0,r1 root
+	ok0,ok1 := r0.decode(b),r1.decode(b[rootSlot:])
+	switch {
+	case ok0 && (!ok1 || r0.seq>r1.seq): l.root = r0
+	case ok1: l.root = r1
+	default: return nil,BADLOG
+	}
+	l.tail,l.end = l.root.tail,l.root.tailLen
+	if err = l.recover(); err!=nil { return nil,err }
+	return
+}
+
+/*
+Frees the blocks, that no committed segment holds: the segments, that an Append allocated after
+the last Commit, linked or not, and the one, whose free by TrimFront didn't make it to the file.
+*/
+func (l *Log) recover() (err error) {
+	rz := int64(0)
+	if l.pa.Redzones { rz = 1 }
+	// The first block of each committed segment, with its redzone.
+	held := make(map[int64]bool)
+	for blk := l.root.first; ; {
+		if held[blk-rz] { return fmt.Errorf("%w: segment at block %d is linked twice",BADLOG,blk) }
+		held[blk-rz] = true
+		if blk==l.root.tail { break }
+		s,err := l.readSegment(blk)
+		if err!=nil { return err }
+		blk = s.next
+	}
+	step := l.root.segBlocks+2*rz
+	var orphans []int64
+	for c := 0; c<l.pa.ChunksN() && err==nil; c++ {
+		bm,e := l.pa.ChunkBitmap(int64(c))
+		if e!=nil { return e }
+		bm.ForEachRun(func(pos, lng int64, used bool) bool {
+			if !used { return true }
+			for p,end := bm.Address(pos),bm.Address(pos+lng); p<end; p += step {
+				if p+step>end {
+					err = fmt.Errorf("%w: blocks %d+%d don't belong to the log",BADLOG,p,end-p)
+					return false
+				}
+				if !held[p] { orphans = append(orphans,p+rz) }
+			}
+			return true
+		})
+	}
+	if err!=nil { return }
+	for _,blk := range orphans {
+		if err = l.pa.FreeBlocks(blk,l.root.segBlocks); err!=nil { return }
+	}
+	return
+}
+
+func (l *Log) offset(blk int64) (int64, error) { return l.pa.BlockOffset(blk) }
+
+func (l *Log) sync() error {
+	if l.pa.DontFsync { return nil }
+	return l.pa.Sync()
+}
+
+// The bytes of records, that a segment holds.
+func (l *Log) capacity() int64 { return (l.root.segBlocks-1)<<l.pa.BlockSizeLog }
+
+func (l *Log) readSegment(blk int64) (s segment, err error) {
+	off,err := l.offset(blk)
+	if err!=nil { return }
+	b := make([]byte,segmentHeader)
+	if _,err = l.pa.ReadAt(b,off); err!=nil { return }
+	if string(b[:8])!=segmentMagic || binary.LittleEndian.Uint32(b[24:])!=crc32.ChecksumIEEE(b[:24]) {
+		return s,fmt.Errorf("%w: segment at block %d",BADLOG,blk)
+	}
+	s.next = int64(binary.LittleEndian.Uint64(b[8:]))
+	s.used = int64(binary.LittleEndian.Uint64(b[16:]))
+	return
+}
+
+func (l *Log) writeSegment(blk int64, s segment) (err error) {
+	off,err := l.offset(blk)
+	if err!=nil { return }
+	b := make([]byte,segmentHeader)
+	copy(b,segmentMagic)
+	binary.LittleEndian.PutUint64(b[8:],uint64(s.next))
+	binary.LittleEndian.PutUint64(b[16:],uint64(s.used))
+	binary.LittleEndian.PutUint32(b[24:],crc32.ChecksumIEEE(b[:24]))
+	_,err = l.pa.WriteAt(b,off)
+	return
+}
+
+// Allocates a segment durably, and writes and syncs its header.
+func (l *Log) newSegment() (blk int64, err error) {
+	blk,ok,err := l.pa.AllocateBlocksWithPolicy(l.root.segBlocks,true,filealloc.SyncEachOp)
+	if err==nil && !ok { err = filealloc.EXTHAUSTED }
+	if err!=nil { return }
+	if err = l.writeSegment(blk,segment{}); err==nil { err = l.sync() }
+	if err!=nil {
+		l.pa.FreeBlocks(blk,l.root.segBlocks)
+		return 0,err
+	}
+	return
+}
+
+// Writes the root to the slot, that doesn't hold the current one.
+func (l *Log) writeRoot(r root) (err error) {
+	r.seq++
+	if _,err = l.pa.WriteUserHeader(r.encode(),int64(r.seq&1)*rootSlot); err!=nil { return }
+	l.root = r
+	return
+}
+
+/*
+Appends a record. It is neither durable nor visible to Iterate, until Commit. A record, that
+doesn't fit into the rest of the last segment, starts a new one.
+*/
+func (l *Log) Append(rec []byte) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := int64(recordHeader+len(rec))
+	if n>l.capacity() { return fmt.Errorf("%w: record of %d bytes",TOOLARGE,len(rec)) }
+	if l.end+n>l.capacity() {
+		next,err := l.newSegment()
+		if err!=nil { return err }
+		if err = l.writeSegment(l.tail,segment{next,l.end}); err!=nil { return err }
+		l.tail,l.end = next,0
+	}
+	b := make([]byte,n)
+	binary.LittleEndian.PutUint32(b,uint32(len(rec)))
+	binary.LittleEndian.PutUint32(b[4:],crc32.ChecksumIEEE(rec))
+	copy(b[recordHeader:],rec)
+	off,err := l.offset(l.tail+1)
+	if err!=nil { return }
+	if _,err = l.pa.WriteAt(b,off+l.end); err!=nil { return }
+	l.end += n
+	l.dirty = true
+	return
+}
+
+// Makes the records appended so far durable and visible: syncs them, then writes the root.
+func (l *Log) Commit() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.commit()
+}
+
+func (l *Log) commit() (err error) {
+	if !l.dirty { return }
+	if err = l.sync(); err!=nil { return }
+	r := l.root
+	r.tail,r.tailLen = l.tail,l.end
+	if err = l.writeRoot(r); err!=nil { return }
+	l.dirty = false
+	return
+}
+
+/*
+Calls fn with each committed record, oldest first, until it returns false. The slice is only
+valid during the call. fn must not call the log. Fails with BADLOG, if a record is damaged.
+*/
+func (l *Log) Iterate(fn func(rec []byte) bool) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.root
+	buf := make([]byte,l.capacity())
+	for blk := r.first; ; {
+		s,err := l.readSegment(blk)
+		if err!=nil { return err }
+		used := s.used
+		if blk==r.tail { used = r.tailLen }
+		if used>int64(len(buf)) { return fmt.Errorf("%w: segment at block %d holds %d bytes",BADLOG,blk,used) }
+		off,err := l.offset(blk+1)
+		if err!=nil { return err }
+		// The file may end before the records, that were not written yet.
+		if used>0 {
+			if _,err = l.pa.ReadAt(buf[:used],off); err!=nil { return err }
+		}
+		for p := int64(0); p<used; {
+			n := int64(binary.LittleEndian.Uint32(buf[p:]))
+			if p+recordHeader+n>used { return fmt.Errorf("%w: record at block %d, byte %d",BADLOG,blk,p) }
+			rec := buf[p+recordHeader:p+recordHeader+n]
+			if binary.LittleEndian.Uint32(buf[p+4:])!=crc32.ChecksumIEEE(rec) { return fmt.Errorf("%w: record at block %d, byte %d",BADLOG,blk,p) }
+			if !fn(rec) { return nil }
+			p += recordHeader+n
+		}
+		if blk==r.tail { return nil }
+		blk = s.next
+	}
+}
+
+/*
+Drops the oldest segment with its records, unless it is the last one. Commits first.
+The root is written without the segment, before the segment is freed.
+Reports, whether a segment was dropped.
+*/
+func (l *Log) TrimFront() (ok bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err = l.commit(); err!=nil || l.root.first==l.root.tail { return }
+	old := l.root.first
+	s,err := l.readSegment(old)
+	if err!=nil { return }
+	r := l.root
+	r.first = s.next
+	if err = l.writeRoot(r); err!=nil { return }
+	return true,l.pa.FreeBlocks(old,r.segBlocks)
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package logstore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"github.com/byte-mug/filealloc"
+	"github.com/byte-mug/filealloc/crashtest"
+)
+
+func testConfig() filealloc.FormatConfig {
+	cfg := filealloc.NewFormatConfig(9)
+	cfg.PrefixBlocks = 4
+	return cfg
+}
+
+func records(l *Log) (r []string, err error) {
+	err = l.Iterate(func(rec []byte) bool {
+		r = append(r,string(rec))
+		return true
+	})
+	return
+}
+
+// The blocks of the committed segments.
+func heldBlocks(l *Log) (n int64, err error) {
+	for blk := l.root.first; ; {
+		n += l.root.segBlocks
+		if blk==l.root.tail { return }
+		s,err := l.readSegment(blk)
+		if err!=nil { return 0,err }
+		blk = s.next
+	}
+}
+
+func ExampleLog() {
+	f := crashtest.NewMemFile(nil)
+	pa,err := filealloc.Create(f,filealloc.FormatConfig{BlockSizeLog: 12, BitmapBlocks: 1, PrefixBlocks: 2})
+	if err!=nil { panic(err) }
+	l,err := Create(pa,4)
+	if err!=nil { panic(err) }
+	l.Append([]byte("hello"))
+	l.Append([]byte("world"))
+	if err = l.Commit(); err!=nil { panic(err) }
+	// Not committed: lost, when the file is opened again.
+	l.Append([]byte("lost"))
+	pa.Close()
+	
+	pa,err = filealloc.Open(f,filealloc.FormatConfig{})
+	if err!=nil { panic(err) }
+	defer pa.Close()
+	l,err = Open(pa)
+	if err!=nil { panic(err) }
+	l.Iterate(func(rec []byte) bool {
+		fmt.Printf("%s\n",rec)
+		return true
+	})
+	// Output:
+	// hello
+	// world
+}
+
+func TestLog(t *testing.T) {
+	f := crashtest.NewMemFile(nil)
+	pa,err := filealloc.Create(f,testConfig())
+	if err!=nil { t.Fatal(err) }
+	if _,err = Create(pa,1); !errors.Is(err,filealloc.BADCONFIG) { t.Fatal(err) }
+	l,err := Create(pa,3)
+	if err!=nil { t.Fatal(err) }
+	if err = l.Append(make([]byte,1024)); !errors.Is(err,TOOLARGE) { t.Fatal(err) }
+	var want []string
+	for i := 0; i<100; i++ {
+		rec := fmt.Sprintf("record-%d-%s",i,make([]byte,i%50))
+		if err = l.Append([]byte(rec)); err!=nil { t.Fatal(err) }
+		want = append(want,rec)
+	}
+	if got,err := records(l); err!=nil || len(got)!=0 { t.Fatal(len(got),err) }
+	if err = l.Commit(); err!=nil { t.Fatal(err) }
+	if got,err := records(l); err!=nil || fmt.Sprint(got)!=fmt.Sprint(want) { t.Fatal(len(got),err) }
+	l.Append([]byte("uncommitted"))
+	l.Append(make([]byte,900))
+	used := pa.UsedBlocks()
+	pa.Close()
+	
+	pa,err = filealloc.Open(f,filealloc.FormatConfig{})
+	if err!=nil { t.Fatal(err) }
+	if l,err = Open(pa); err!=nil { t.Fatal(err) }
+	if got,err := records(l); err!=nil || fmt.Sprint(got)!=fmt.Sprint(want) { t.Fatal(len(got),err) }
+	// The segment of the uncommitted record is freed.
+	if pa.UsedBlocks()!=used-3 { t.Fatal(pa.UsedBlocks(),used) }
+	n := 0
+	for {
+		ok,err := l.TrimFront()
+		if err!=nil { t.Fatal(err) }
+		if !ok { break }
+		n++
+	}
+	got,err := records(l)
+	if err!=nil || n==0 || len(got)==0 || fmt.Sprint(got)!=fmt.Sprint(want[len(want)-len(got):]) { t.Fatal(n,len(got),err) }
+	if pa.UsedBlocks()!=3 { t.Fatal(pa.UsedBlocks()) }
+}
+
+// Crashes after every write: the committed records survive, and no segment leaks.
+func TestLogCrash(t *testing.T) {
+	base := crashtest.NewMemFile(nil)
+	pa,err := filealloc.Create(base,testConfig())
+	if err!=nil { t.Fatal(err) }
+	if _,err = Create(pa,2); err!=nil { t.Fatal(err) }
+	pa.Close()
+	
+	r := crashtest.NewRecorder(base.Bytes())
+	pa,err = filealloc.Open(r,filealloc.FormatConfig{})
+	if err!=nil { t.Fatal(err) }
+	l,err := Open(pa)
+	if err!=nil { t.Fatal(err) }
+	var recs []string
+	// The number of writes, after which the first k records were acknowledged.
+	acked := map[int]int{}
+	trimmed := 0
+	for i := 0; i<40; i++ {
+		recs = append(recs,fmt.Sprintf("r%d-%s",i,make([]byte,100)))
+		if err = l.Append([]byte(recs[i])); err!=nil { t.Fatal(err) }
+		if i%3==2 {
+			if err = l.Commit(); err!=nil { t.Fatal(err) }
+			acked[i+1] = r.Writes()
+		}
+		if i==30 {
+			for k := 0; k<2; k++ {
+				if _,err = l.TrimFront(); err!=nil { t.Fatal(err) }
+			}
+			acked[i+1] = r.Writes()
+		}
+	}
+	got,err := records(l)
+	if err!=nil || len(got)==0 { t.Fatal(err) }
+	if fmt.Sscanf(got[0],"r%d-",&trimmed); trimmed==0 { t.Fatal("not trimmed") }
+	pa.Close()
+	
+	for n := 0; n<=r.Writes(); n++ {
+		pa,err := filealloc.Open(r.Replay(n),filealloc.FormatConfig{})
+		if err!=nil { t.Fatalf("crash after %d writes: %v",n,err) }
+		l,err := Open(pa)
+		if err!=nil { t.Fatalf("crash after %d writes: %v",n,err) }
+		got,err := records(l)
+		if err!=nil { t.Fatalf("crash after %d writes: %v",n,err) }
+		first,end := 0,0
+		if len(got)>0 {
+			fmt.Sscanf(got[0],"r%d-",&first)
+			end = first+len(got)
+		}
+		if end>len(recs) || fmt.Sprint(got)!=fmt.Sprint(recs[first:end]) { t.Fatalf("crash after %d writes: records %d to %d damaged",n,first,end) }
+		if first>trimmed { t.Fatalf("crash after %d writes: records before %d lost",n,first) }
+		for k,w := range acked {
+			if w<=n && end<k { t.Fatalf("crash after %d writes: %d records, %d acknowledged",n,end,k) }
+		}
+		held,err := heldBlocks(l)
+		if err!=nil || pa.UsedBlocks()!=held { t.Fatalf("crash after %d writes: %d blocks used, %d held, %v",n,pa.UsedBlocks(),held,err) }
+		if err = l.Append([]byte("after")); err==nil { err = l.Commit() }
+		if err!=nil { t.Fatalf("crash after %d writes: %v",n,err) }
+		pa.Close()
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"sync"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// Housekeeping, that a MaintenancePolicy can ask for. The actions can be combined.
+type MaintenanceAction uint8
+
+const (
+	// Call OnCompact, to move allocations out of the tail of the file.
+	MaintainCompact MaintenanceAction = 1<<iota
+	
+	// Remove the empty chunks at the end of the file. See Shrink.
+	MaintainShrink
+	
+	// Punch holes over all free blocks at once, rather than on each free. See Discard.
+	MaintainDiscard
+)
+
+// What a MaintenancePolicy decides on.
+type MaintenanceState struct{
+	Chunks int
+	// Fraction of free data blocks.
+	Free float64
+	// Fraction of used blocks in the last chunk.
+	TailUsage float64
+	// Blocks freed since the last Discard.
+	Undiscarded int64
+}
+
+/*
+Decides after each allocation and free, which housekeeping to run. It is called with the allocator
+locked, so it must be quick and must not call the allocator. The actions run in the background,
+one batch at a time; while they run, the policy is not consulted.
+*/
+type MaintenancePolicy func(s MaintenanceState) MaintenanceAction
+
+/*
+Returns a policy, that tidies the tail of the file, once more than minFree of the blocks are free:
+it removes the last chunk, if it is empty, or compacts and then removes it, if less than maxTailUsage of it is used.
+*/
+func TidyPolicy(minFree, maxTailUsage float64) MaintenancePolicy {
+	return func(s MaintenanceState) (a MaintenanceAction) {
+		if s.Chunks<2 || s.Free<=minFree { return }
+		if s.TailUsage==0 { return MaintainShrink }
+		if s.TailUsage<maxTailUsage { return MaintainCompact|MaintainShrink }
+		return
+	}
+}
+
+type maintState struct{
+	running     bool
+	closed      bool
+	wg          sync.WaitGroup
+	undiscarded int64
+}
+
+// Consults the MaintenancePolicy and starts the actions, it asks for.
+func (pa *PageAllocator) maintain() {
+	if pa.Maintenance==nil || pa.maint.running || pa.maint.closed || len(pa.allocators)==0 { return }
+	s := MaintenanceState{Chunks: len(pa.allocators), Free: 1-pa.usage(), Undiscarded: pa.maint.undiscarded}
+	bm := pa.bitmapOf(len(pa.allocators)-1)
+	s.TailUsage = float64(bitmap.CountInUse(bm,0,int64(len(bm))<<3))/float64(int64(len(bm))<<3)
+	a := pa.Maintenance(s)
+	if a==0 { return }
+	pa.maint.running = true
+	pa.maint.wg.Add(1)
+	go pa.runMaintenance(a,pa.OnCompact)
+}
+
+// Runs the actions. compact is OnCompact, as maintain() read it, with the allocator locked.
+func (pa *PageAllocator) runMaintenance(a MaintenanceAction, compact func(pa *PageAllocator) error) {
+	defer pa.maint.wg.Done()
+	var err error
+	keep := func(e error) {
+		if err==nil { err = e }
+	}
+	if a&MaintainCompact!=0 && compact!=nil { keep(compact(pa)) }
+	if a&MaintainShrink!=0 {
+		_,e := pa.Shrink()
+		if e!=UNSUPPORTED { keep(e) }
+	}
+	if a&MaintainDiscard!=0 {
+		_,e := pa.Discard()
+		if e!=UNSUPPORTED { keep(e) }
+	}
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	pa.maint.running = false
+	pa.emit(Event{Kind: EventMaintenance, Err: err})
+}
+
+/*
+Punches holes over all free blocks, if the Storage is a HolePuncher, so that the file system
+can reclaim their space. Returns the number of blocks discarded.
+*/
+func (pa *PageAllocator) Discard() (blocks int64, err error) {
+	if _,ok := pa.Storage.(HolePuncher); !ok { return 0,UNSUPPORTED }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	for i := range pa.allocators {
+		bitmap.ForEachFreeRun(pa.bitmapOf(i),func(pos, lng int64) bool {
+			if !pa.punchHole(pa.MakeAddress(int64(i),pos),lng) { return false }
+			blocks += lng
+			return true
+		})
+		if pa.noPunch { return blocks,UNSUPPORTED }
+	}
+	pa.maint.undiscarded = 0
+	return
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// Not a chunk written by ExportChunk, or one of another format.
+var BADCHUNK = errors.New("BADCHUNK")
+
+// The chunk has allocated blocks.
+var CHUNKINUSE = errors.New("CHUNK_IN_USE")
+
+const chunkMagic = "FACHUNK1"
+
+/*
+Stream header, after the magic (little endian):
+	BlockSizeLog
+	(padding)
+	size of the bitmap in bytes
+	first data block of the chunk in the source
+	number of allocated blocks, that follow the bitmap
+	crc32 of the bitmap
+	crc32 of the header up to here
+*/
+const chunkHeader = 32
+
+/*
+Writes the chunk's bitmap and the data of its allocated blocks to w, for ImportChunk.
+Free blocks are not written. The allocator is locked, while the chunk is written, and so is the
+read lock of the chunk (see LockChunkForRead).
+*/
+func (pa *PageAllocator) ExportChunk(chunk int64, w io.Writer) (err error) {
+	unlock,err := pa.LockChunkForRead(chunk)
+	if err!=nil { return }
+	defer unlock()
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if chunk<0 || int64(len(pa.allocators))<=chunk { return OUTOFBOUNDS }
+	bm := pa.bitmapOf(int(chunk))
+	used := bitmap.CountInUse(bm,0,int64(len(bm))<<3)
+	var hdr [chunkHeader]byte
+	hdr[0] = pa.BlockSizeLog
+	binary.LittleEndian.PutUint32(hdr[4:],uint32(len(bm)))
+	binary.LittleEndian.PutUint64(hdr[8:],uint64(pa.MakeAddress(chunk,0)))
+	binary.LittleEndian.PutUint64(hdr[16:],uint64(used))
+	binary.LittleEndian.PutUint32(hdr[24:],crc32.ChecksumIEEE(bm))
+	binary.LittleEndian.PutUint32(hdr[28:],crc32.ChecksumIEEE(hdr[:28]))
+	if _,err = w.Write([]byte(chunkMagic)); err!=nil { return }
+	if _,err = w.Write(hdr[:]); err!=nil { return }
+	if _,err = w.Write(bm); err!=nil { return }
+	bitmap.ForEachUsedRun(bm,func(pos, lng int64) bool {
+		off := pa.MakeAddress(chunk,pos)<<pa.BlockSizeLog
+		_,err = io.Copy(w,io.NewSectionReader(pa.Storage,off,lng<<pa.BlockSizeLog))
+		return err==nil
+	})
+	return
+}
+
+/*
+Reads a chunk written by ExportChunk into the chunk with the given index, which must be free of
+allocations, or the next chunk to be added. The block size and the size of the bitmaps must match.
+
+The block numbers of the imported allocations are those of the source plus offset.
+ImportChunk holds the write lock of the chunk (see LockChunkForWrite), if it exists.
+*/
+func (pa *PageAllocator) ImportChunk(chunk int64, r io.Reader) (offset int64, err error) {
+	err = pa.withChunksLocked([]int64{chunk},func(locked []int64) (need int64, err error) {
+		if err = pa.enter(); err!=nil { return -1,err }
+		defer pa.leave(&err)
+		// A chunk, that is added, can't be locked by others, before the import is done.
+		if chunk<int64(len(pa.allocators)) && !hasChunk(locked,chunk) { return chunk,nil }
+		offset,err = pa.importChunk(chunk,r)
+		return -1,err
+	})
+	return
+}
+
+func (pa *PageAllocator) importChunk(chunk int64, r io.Reader) (offset int64, err error) {
+	var hdr [len(chunkMagic)+chunkHeader]byte
+	if _,err = io.ReadFull(r,hdr[:]); err!=nil { return }
+	if string(hdr[:len(chunkMagic)])!=chunkMagic { return 0,BADCHUNK }
+	h := hdr[len(chunkMagic):]
+	if binary.LittleEndian.Uint32(h[28:])!=crc32.ChecksumIEEE(h[:28]) { return 0,BADCHUNK }
+	if h[0]!=pa.BlockSizeLog || int(binary.LittleEndian.Uint32(h[4:]))!=pa.bitmapSize {
+		return 0,fmt.Errorf("%w: 2^%d byte blocks and %d bitmap bytes, want 2^%d and %d",BADCHUNK,h[0],binary.LittleEndian.Uint32(h[4:]),pa.BlockSizeLog,pa.bitmapSize)
+	}
+	src := int64(binary.LittleEndian.Uint64(h[8:]))
+	bm := make([]byte,pa.bitmapSize)
+	if _,err = io.ReadFull(r,bm); err!=nil { return }
+	if crc32.ChecksumIEEE(bm)!=binary.LittleEndian.Uint32(h[24:]) { return 0,BADCHUNK }
+	if used := bitmap.CountInUse(bm,0,int64(len(bm))<<3); used!=int64(binary.LittleEndian.Uint64(h[16:])) { return 0,BADCHUNK }
+	
+	switch n := int64(len(pa.allocators)); {
+	case chunk<0 || chunk>n: return 0,OUTOFBOUNDS
+	case chunk==n:
+		if err = pa.appendAllocator(); err!=nil { return }
+	case !isZero(pa.bitmapOf(int(chunk))):
+		return 0,fmt.Errorf("%w: chunk %d",CHUNKINUSE,chunk)
+	}
+	i := int(chunk)
+	buf := make([]byte,64<<pa.BlockSizeLog)
+	bitmap.ForEachUsedRun(bm,func(pos, lng int64) bool {
+		off := pa.MakeAddress(chunk,pos)<<pa.BlockSizeLog
+		for end := off+lng<<pa.BlockSizeLog; off<end && err==nil; off += int64(len(buf)) {
+			if int64(len(buf))>end-off { buf = buf[:end-off] }
+			if _,err = io.ReadFull(r,buf); err==nil { _,err = pa.WriteAt(buf,off) }
+		}
+		buf = buf[:cap(buf)]
+		return err==nil
+	})
+	if err!=nil { return }
+	if !pa.DontFsync {
+		if err = pa.Sync(); err!=nil { return }
+	}
+	
+	copy(pa.writable(i),bm)
+	pa.usedBlocks.Add(bitmap.CountInUse(bm,0,int64(len(bm))<<3))
+	pa.checkWatermarks()
+	pa.markDirty(i,0,int64(len(bm))<<3)
+	pa.allocators[i].index.valid = false
+	if pa.RunIndex!=nil { pa.allocators[i].index.compute(bm,pa.runIndexSize()) }
+	if err = pa.flushChunk(i); err!=nil { return }
+	return pa.MakeAddress(chunk,0)-src,nil
+}
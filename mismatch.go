@@ -0,0 +1,71 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The FormatConfig passed to Open() contradicts the file.
+var FORMATMISMATCH = errors.New("FORMAT_MISMATCH")
+
+// Returned by Open(), if the file contradicts the FormatConfig, or itself. Matches FORMATMISMATCH.
+type FormatMismatchError struct{
+	// The field of the FormatConfig (1 for true), or "file size".
+	Field string
+	
+	// The value found in the file, and the one expected.
+	File, Config int64
+}
+
+func (e *FormatMismatchError) Error() string {
+	return fmt.Sprintf("FORMAT_MISMATCH: %s is %d in the file, but %d is expected",e.Field,e.File,e.Config)
+}
+
+func (e *FormatMismatchError) Is(target error) bool { return target==FORMATMISMATCH }
+
+func boolInt(b bool) int64 {
+	if b { return 1 }
+	return 0
+}
+
+/*
+Checks the format fields, that cfg sets, against the superblock. Zero values and false leave
+the choice to the file.
+*/
+func (sb *superblock) checkConfig(cfg *FormatConfig) error {
+	checks := []struct{
+		field string
+		file, cfg int64
+	}{
+		{"BlockSizeLog",int64(sb.blockSizeLog),int64(cfg.BlockSizeLog)},
+		{"BitmapBlocks",int64(sb.bitmapBlocks),int64(cfg.BitmapBlocks)},
+		{"PrefixBlocks",int64(sb.prefixBlocks),int64(cfg.PrefixBlocks)},
+		{"BitmapEncoding",int64(sb.encoding),int64(cfg.BitmapEncoding)},
+		{"Checksum",int64((sb.features&featureChecksumMask)>>featureChecksumShift),int64(cfg.Checksum)},
+		{"Doublewrite",boolInt(sb.features&featureDoublewrite!=0),boolInt(cfg.Doublewrite)},
+		{"Trailers",boolInt(sb.features&featureTrailers!=0),boolInt(cfg.Trailers)},
+		{"SuperblockBackup",boolInt(sb.features&featureBackup!=0),boolInt(cfg.SuperblockBackup)},
+	}
+	for _,c := range checks {
+		if c.cfg!=0 && c.file!=c.cfg { return &FormatMismatchError{c.field,c.file,c.cfg} }
+	}
+	return nil
+}
+
+/*
+Checks, that the file ends behind the bitmap of its last chunk. A file, that was closed cleanly,
+can't end inside a bitmap, unless its format is not the one in the superblock.
+*/
+func (pa *PageAllocator) checkGeometry() error {
+	n := pa.countChunks()
+	if n==0 { return nil }
+	off := pa.MakeAddress(int64(n-1),-int64(pa.BitmapBlocks))<<pa.BlockSizeLog
+	buf := make([]byte,pa.rawBitmapBytes())
+	k,_ := pa.ReadAt(buf,off)
+	if k<len(buf) { return &FormatMismatchError{"file size",off+int64(k),off+int64(len(buf))} }
+	return nil
+}
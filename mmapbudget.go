@@ -0,0 +1,118 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Mmapping the bitmap would exceed MaxMmapBytes.
+var MMAPBUDGET = errors.New("MMAP_BUDGET")
+
+// Why a bitmap is heap-backed, although the allocator mmaps bitmaps.
+type mapFallback uint8
+
+const (
+	fallbackNone mapFallback = iota
+	// MemmapAt failed, for example because of the limit on mappings.
+	fallbackFailed
+	// Mapping it would exceed MaxMmapBytes.
+	fallbackBudget
+	// Opted out by SetChunkMmap.
+	fallbackOptOut
+)
+
+// Returns the number of bytes mmapped for bitmaps.
+func (pa *PageAllocator) mmappedBytes() (n int64) {
+	for i := range pa.allocators {
+		if pa.allocators[i].mmapped { n += int64(len(pa.allocators[i].buffer)) }
+	}
+	return
+}
+
+/*
+Mmaps the bitmap of b, unless the chunk opted out or MaxMmapBytes is reached, and records
+why it stays heap-backed otherwise. b.buffer is replaced only on success.
+*/
+func (pa *PageAllocator) mapBitmap(b *bitmapBuffer, chunk int64) (err error) {
+	if pa.mmapper==nil || b.mmapped || b.fallback==fallbackOptOut { return }
+	if pa.MaxMmapBytes>0 && pa.mmappedBytes()+int64(pa.bitmapSize)>pa.MaxMmapBytes {
+		b.fallback = fallbackBudget
+		return
+	}
+	buf,err := pa.mmapper.MemmapAt(pa.bitmapSize,b.rawoff)
+	if err==nil && len(buf)<pa.bitmapSize {
+		pa.mmapper.MemUnmap(buf)
+		err = fmt.Errorf("mapped %d of %d bytes",len(buf),pa.bitmapSize)
+	}
+	if err!=nil {
+		b.fallback = fallbackFailed
+		pa.emit(Event{Kind: EventMmapFallback, Chunk: chunk, Err: err})
+		return
+	}
+	b.buffer,b.mmapped,b.fallback = buf,true,fallbackNone
+	if pm,ok := pa.mmapper.(PersistentMapper); ok { b.persistent = pm.IsPersistent(buf) }
+	return
+}
+
+/*
+Opts the chunk's bitmap out of mmap, or back in. Opting out copies the bitmap to the heap
+(after msyncing it, unless DontMsync is set) and unmaps it. Opting in writes the heap copy back
+and mmaps it; this fails, if the allocator doesn't mmap bitmaps (UNSUPPORTED), if mmap fails,
+or if it exceeds MaxMmapBytes (MMAPBUDGET).
+*/
+func (pa *PageAllocator) SetChunkMmap(chunk int64, mmap bool) (err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if chunk<0 || int64(len(pa.allocators))<=chunk { return OUTOFBOUNDS }
+	pa.touch(int(chunk))
+	a := &pa.allocators[chunk]
+	if !mmap {
+		a.fallback = fallbackOptOut
+		if !a.mmapped { return }
+		if !pa.DontMsync {
+			if err = pa.msync(a); err!=nil { return }
+		}
+		heap := append([]byte(nil),a.buffer...)
+		pa.mmapper.MemUnmap(a.buffer)
+		a.buffer,a.mmapped,a.segs,a.persistent = heap,false,nil,false
+		return
+	}
+	if pa.mmapper==nil { return UNSUPPORTED }
+	if a.mmapped { return }
+	a.fallback = fallbackNone
+	if a.dirty {
+		if err = pa.flushChunk(int(chunk)); err!=nil { return }
+	}
+	if err = pa.mapBitmap(a,chunk); err!=nil { return }
+	if a.fallback==fallbackBudget { return MMAPBUDGET }
+	a.shared = false
+	return
+}
+
+// Fills in the mmap accounting of the Stats.
+func (pa *PageAllocator) mmapStats(st *Stats) {
+	for i := range pa.allocators {
+		a := &pa.allocators[i]
+		if a.mmapped {
+			st.MmappedChunks++
+			if a.persistent { st.PersistentChunks++ }
+			st.MmappedBytes += int64(len(a.buffer))
+			continue
+		}
+		switch a.fallback {
+		case fallbackFailed: st.MmapFailed++
+		case fallbackBudget: st.MmapOverBudget++
+		case fallbackOptOut: st.MmapOptedOut++
+		}
+	}
+}
+
+// Sets MaxMmapBytes. Lowering it doesn't unmap bitmaps: it limits the ones mapped later.
+func WithMaxMmapBytes(n int64) Option {
+	if n<0 { return badOption("WithMaxMmapBytes","%d bytes",n) }
+	return Option{"WithMaxMmapBytes",optLive,nil,func(pa *PageAllocator) { pa.MaxMmapBytes = n }}
+}
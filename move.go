@@ -0,0 +1,141 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// Told by MoveBlocks with the allocator locked, after the data was copied and before the old blocks are freed.
+type relocator interface{
+	relocated(from Extent, to int64) error
+}
+
+/*
+Moves the allocated extent [blk,blk+lng) to newly allocated blocks (placed according to the
+Placement, growing the file if grow is set), and frees the old ones like FreeBlocks. The data is copied
+and synced (unless DontFsync is set) before the old blocks are freed. Its owner in the OwnerTable moves
+along, HandleTables of the allocator are updated, and the watchers of WatchRelocations are told.
+MoveBlocks holds the write locks (see LockChunkForWrite) of the old and the new chunk meanwhile.
+
+The extent must be allocated as a whole, with the length it was allocated with.
+Leased blocks (see Lease) are not moved: MoveBlocks fails with LEASED.
+*/
+func (pa *PageAllocator) MoveBlocks(blk, lng int64, grow bool) (to int64, err error) {
+	c,_,_ := pa.BreakAddress(blk)
+	err = pa.withChunksLocked([]int64{c},func(locked []int64) (need int64, err error) {
+		if err = pa.enter(); err!=nil { return -1,err }
+		defer pa.leave(&err)
+		to,need,err = pa.moveBlocks(blk,lng,grow,locked)
+		return
+	})
+	return
+}
+
+/*
+Calls fn with the write locks of the chunks held, which it gets, taken in ascending order.
+If fn needs the lock of another chunk, it undoes its work and returns the chunk; fn is called again
+with that lock held as well. Otherwise it returns -1.
+*/
+func (pa *PageAllocator) withChunksLocked(chunks []int64, fn func(locked []int64) (need int64, err error)) (err error) {
+	for {
+		sort.Slice(chunks,func(i, j int) bool { return chunks[i]<chunks[j] })
+		var unlocks []func()
+		var locked []int64
+		for _,c := range chunks {
+			// A chunk, that doesn't exist, holds nothing to protect; the operation rejects it.
+			unlock,e := pa.LockChunkForWrite(c)
+			if e!=nil { continue }
+			unlocks,locked = append(unlocks,unlock),append(locked,c)
+		}
+		need,e := fn(locked)
+		for i := len(unlocks)-1; i>=0; i-- { unlocks[i]() }
+		if need<0 { return e }
+		// A chunk, that Shrink removed meanwhile, is not added twice.
+		if !hasChunk(chunks,need) { chunks = append(chunks,need) }
+	}
+}
+
+func hasChunk(chunks []int64, c int64) bool {
+	for _,x := range chunks {
+		if x==c { return true }
+	}
+	return false
+}
+
+// Moves the blocks. Returns the chunk, whose write lock is needed, if it is not among the locked ones.
+func (pa *PageAllocator) moveBlocks(blk, lng int64, grow bool, locked []int64) (to, need int64, err error) {
+	need = -1
+	c,pos,err := pa.checkRange(blk,lng)
+	if err!=nil { return }
+	if lng==0 { return blk,-1,nil }
+	if !hasChunk(locked,c) { return 0,c,nil }
+	if err = pa.checkLeases(blk,lng); err!=nil { return }
+	if pa.readOnly(int(c)) { return 0,-1,pa.readOnlyChunk(c) }
+	if n := bitmap.CountInUse(pa.bitmapOf(int(c)),pos,lng); n!=lng {
+		return 0,-1,fmt.Errorf("%w: blocks %d+%d: %d are free",BADRANGE,blk,lng,lng-n)
+	}
+	pa.unlimited = true
+	to,ok,err := pa.allocate(lng,grow,false)
+	pa.unlimited = false
+	if err==nil && !ok { err = EXTHAUSTED }
+	if err!=nil { return }
+	undo := func() { pa.doFree(to,lng) }
+	if tc,_,_ := pa.BreakAddress(to); !hasChunk(locked,tc) {
+		undo()
+		return 0,tc,nil
+	}
+	if err = pa.copyBlocks(blk,to,lng); err!=nil {
+		undo()
+		return
+	}
+	if pa.OwnerTable!=nil {
+		start,r,ok,e := pa.findOwner(c,pos)
+		if e==nil && ok && start==pos {
+			tc,tpos,_ := pa.BreakAddress(to)
+			e = pa.writeOwner(tc,tpos,r)
+		}
+		if err = e; err!=nil {
+			undo()
+			return
+		}
+	}
+	for k,r := range pa.relocators {
+		if err = r.relocated(Extent{blk,lng},to); err==nil { continue }
+		// Tell the ones, that saw the move, to take it back.
+		for _,r := range pa.relocators[:k] { r.relocated(Extent{to,lng},blk) }
+		undo()
+		return
+	}
+	err = pa.free(blk,lng)
+	return
+}
+
+// Copies the data of lng blocks from blk to to, and syncs it.
+func (pa *PageAllocator) copyBlocks(blk, to, lng int64) (err error) {
+	buf := make([]byte,64<<pa.BlockSizeLog)
+	off,dst,end := blk<<pa.BlockSizeLog,to<<pa.BlockSizeLog,(blk+lng)<<pa.BlockSizeLog
+	for off<end {
+		b := buf
+		if int64(len(b))>end-off { b = b[:end-off] }
+		var n int
+		n,err = pa.ReadAt(b,off)
+		if err==io.EOF {
+			// Never written.
+			for i := n; i<len(b); i++ { b[i] = 0 }
+			err = nil
+		}
+		if err!=nil { return }
+		if _,err = pa.WriteAt(b,dst); err!=nil { return }
+		pa.op.written += int64(len(b))
+		off += int64(len(b))
+		dst += int64(len(b))
+	}
+	if !pa.DontFsync { err = pa.Sync() }
+	return
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+/*
+In MultiProcess mode, every mutation runs under the file lock. The superblock holds a change counter,
+that every process increments after modifying the file. If a process finds the counter changed
+when it acquires the lock, it reloads its bitmaps.
+
+The dirty flag is never cleared in this mode, as one process can't tell, whether others still have the file open.
+*/
+
+/*
+Locks the allocator for a mutation. In MultiProcess mode, also acquires the file lock
+and brings the bitmaps up to date, if another process changed them.
+With OpTimeout, the wait for the lock is bounded and the operation gets a deadline.
+*/
+func (pa *PageAllocator) enter() error {
+	if err := pa.lock(); err!=nil { return err }
+	pa.opSeq++
+	pa.startOp()
+	if !pa.MultiProcess { return nil }
+	if err := pa.locker.LockFile(); err!=nil {
+		pa.clearDeadline(&err)
+		pa.mu.Unlock()
+		return err
+	}
+	var sb superblock
+	if _,ok := pa.loadSuperblock(&sb); ok {
+		pa.super.scrubCursor,pa.super.scrubPasses = sb.scrubCursor,sb.scrubPasses
+		pa.super.states = sb.states
+		if sb.changes!=pa.super.changes {
+			pa.super.changes = sb.changes
+			pa.reload()
+		}
+	}
+	pa.changed = false
+	return nil
+}
+
+// Publishes the changes made since enter() and releases the locks.
+func (pa *PageAllocator) leave(err *error) {
+	if r,slow := pa.endOp(*err); slow { defer pa.OnSlowOp(r) }
+	if lng,hit := pa.softLimitHit(); hit { defer pa.OnSoftLimit(lng) }
+	defer pa.mu.Unlock()
+	defer pa.clearDeadline(err)
+	if !pa.MultiProcess { return }
+	if pa.changed {
+		pa.super.changes++
+		if e := pa.writeSuperblock(); *err==nil { *err = e }
+		pa.changed = false
+	} else if pa.superPending {
+		if e := pa.writeSuperblock(); *err==nil { *err = e }
+	}
+	if e := pa.locker.UnlockFile(); *err==nil { *err = e }
+}
+
+// Re-reads all bitmaps and picks up chunks added or removed by other processes.
+func (pa *PageAllocator) reload() {
+	n := pa.countChunks()
+	if n==0 { n = 1 }
+	for i := n; i<len(pa.allocators); i++ {
+		if pa.allocators[i].mmapped { pa.mmapper.MemUnmap(pa.allocators[i].buffer) }
+		pa.allocators[i] = bitmapBuffer{}
+	}
+	if n<len(pa.allocators) { pa.allocators = pa.allocators[:n] }
+	for i := range pa.allocators {
+		a := &pa.allocators[i]
+		if !a.mmapped { a.gen,_ = pa.readBitmap(pa.writable(i),a.rawoff) }
+		a.dirty = false
+		for j := range a.segs { a.segs[j] = 0 }
+		a.index.valid = false
+	}
+	pos := pa.MakeAddress(int64(len(pa.allocators)),-int64(pa.BitmapBlocks))
+	for len(pa.allocators)<n {
+		pa.allocators = append(pa.allocators,pa.getAllocator(pos))
+		pos += pa.ChunkSizeInBlocks()
+	}
+	pa.countUsed()
+	pa.checkWatermarks()
+}
+
+// Sets up the file lock for MultiProcess mode and acquires it for the duration of Create() or Open().
+func (pa *PageAllocator) lockOpen() error {
+	if !pa.MultiProcess { return nil }
+	l,ok := pa.Storage.(FileLocker)
+	if !ok { return UNSUPPORTED }
+	pa.locker = l
+	return l.LockFile()
+}
+
+func (pa *PageAllocator) unlockOpen(err *error) {
+	if !pa.MultiProcess || pa.locker==nil { return }
+	if e := pa.locker.UnlockFile(); *err==nil { *err = e }
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The file could not grow by another chunk, because the device is full.
+var NOSPACE = errors.New("NO_SPACE_TO_GROW")
+
+// Returned, if the Storage ran out of space, while the file grew by a chunk. The growth was rolled back.
+type NoSpaceError struct{
+	// The chunk, that could not be added.
+	Chunk int64
+	// The error of the Storage.
+	Err error
+}
+
+func (e *NoSpaceError) Error() string {
+	return fmt.Sprintf("NO_SPACE_TO_GROW: chunk %d: %v",e.Chunk,e.Err)
+}
+
+func (e *NoSpaceError) Unwrap() error { return e.Err }
+
+func (e *NoSpaceError) Is(target error) bool { return target==NOSPACE }
+
+// Reports, whether err means, that the device is full. A Storage may return NOSPACE itself.
+func isNoSpace(err error) bool {
+	return errors.Is(err,NOSPACE) || isNoSpaceErrno(err)
+}
+
+// Wraps err in a NoSpaceError, if it means, that the device is full.
+func (pa *PageAllocator) noSpace(err error) error {
+	if err==nil || !isNoSpace(err) { return err }
+	var ns *NoSpaceError
+	if errors.As(err,&ns) { return err }
+	return &NoSpaceError{int64(len(pa.allocators)),err}
+}
@@ -0,0 +1,21 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !plan9
+
+package filealloc
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+func isNoSpaceErrno(err error) bool {
+	var en syscall.Errno
+	if !errors.As(err,&en) { return false }
+	// ERROR_HANDLE_DISK_FULL and ERROR_DISK_FULL.
+	if runtime.GOOS=="windows" && (en==39 || en==112) { return true }
+	return en==syscall.ENOSPC || en==syscall.EFBIG
+}
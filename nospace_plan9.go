@@ -0,0 +1,19 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// Plan 9 has no error numbers: the file servers report a full disk by message.
+func isNoSpaceErrno(err error) bool {
+	var es syscall.ErrorString
+	if !errors.As(err,&es) { return false }
+	msg := strings.ToLower(string(es))
+	return strings.Contains(msg,"no space") || strings.Contains(msg,"disk full") || strings.Contains(msg,"file system full")
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"time"
+)
+
+// The file has no valid superblock.
+var NOSUPERBLOCK = errors.New("NOSUPERBLOCK")
+
+/*
+Creates a new allocator in s, which should be empty, and writes a superblock describing cfg.
+cfg, with the opts applied, must pass Validate().
+
+Files created this way are opened with Open().
+*/
+func Create(s Storage, cfg FormatConfig, opts ...Option) (pa *PageAllocator, err error) {
+	if err = checkOptions(opts,optFormat,"Create"); err!=nil { return }
+	pa = &PageAllocator{Storage: s, FormatConfig: cfg}
+	pa.apply(opts)
+	cfg = pa.FormatConfig
+	if err = cfg.Validate(); err!=nil { return nil,err }
+	if err = pa.CheckDurability(); err!=nil { return nil,err }
+	if err = pa.lockExclusive(); err!=nil { return nil,err }
+	defer pa.unlockExclusiveOn(&err)
+	pa.super = superblock{
+		blockSizeLog: cfg.BlockSizeLog,
+		bitmapBlocks: cfg.BitmapBlocks,
+		prefixBlocks: cfg.PrefixBlocks,
+		encoding: uint8(cfg.BitmapEncoding),
+		features: cfg.features(),
+		flags: flagDirty,
+		created: time.Now().UnixNano(),
+	}
+	if cfg.Reproducible {
+		pa.super.id,pa.super.created = pa.repro.id,pa.repro.created
+	} else if pa.super.id,err = newFileID(); err!=nil {
+		return nil,err
+	}
+	pa.hasSuper = true
+	if err = pa.lockOpen(); err!=nil { return nil,err }
+	defer pa.unlockOpen(&err)
+	if cfg.Reproducible {
+		if err = pa.zeroData(0,int64(cfg.PrefixBlocks)); err!=nil { return nil,err }
+	}
+	if err = pa.writeSuperblock(); err!=nil { return nil,err }
+	pa.Init()
+	return
+}
+
+func (pa *PageAllocator) readSuperblock() bool {
+	backup,ok := pa.loadSuperblock(&pa.super)
+	if backup { pa.recovery.SuperblockFromBackup = true }
+	return ok
+}
+
+/*
+Opens an allocator created with Create().
+
+If the file was not closed cleanly, it is repaired first. See RecoveryReport().
+
+The format is taken from the superblock. The format fields, that cfg sets (non-zero or true),
+must match it, or Open fails with a *FormatMismatchError; so does a file, that was closed cleanly,
+but ends inside the bitmap of its last chunk. opts must not change the format.
+
+If the file was closed cleanly with a Summary, and it is passed again (see WithSummary), Open reads
+no bitmaps: it takes the free blocks of the chunks from the summary, and loads their bitmaps, when
+they are first used.
+*/
+func Open(s Storage, cfg FormatConfig, opts ...Option) (pa *PageAllocator, err error) {
+	if err = checkOptions(opts,optOpen,"Open"); err!=nil { return }
+	pa = &PageAllocator{Storage: s, FormatConfig: cfg}
+	pa.apply(opts)
+	cfg = pa.FormatConfig
+	if err = pa.lockExclusive(); err!=nil { return nil,err }
+	defer pa.unlockExclusiveOn(&err)
+	if !pa.readSuperblock() { return nil,NOSUPERBLOCK }
+	pa.hasSuper = true
+	if err = pa.super.checkConfig(&cfg); err!=nil { return nil,err }
+	pa.super.format(&cfg)
+	if err = cfg.Validate(); err!=nil { return nil,err }
+	pa.FormatConfig = cfg
+	if err = pa.CheckDurability(); err!=nil { return nil,err }
+	if err = pa.lockOpen(); err!=nil { return nil,err }
+	defer pa.unlockOpen(&err)
+	if cfg.MultiProcess && !pa.readSuperblock() { return nil,NOSUPERBLOCK }
+	switch {
+	case pa.super.flags&flagDirty!=0:
+		if err = pa.recover(); err!=nil { return nil,err }
+	case pa.readSummary():
+		// The bitmaps are loaded, when their chunks are first used.
+	default:
+		if err = pa.checkGeometry(); err!=nil { return nil,err }
+	}
+	pa.super.flags |= flagDirty
+	if err = pa.writeSuperblock(); err!=nil { return nil,err }
+	pa.Init()
+	return
+}
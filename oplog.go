@@ -0,0 +1,216 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// An Op, that can't be decoded or applied.
+var BADOP = errors.New("BAD_OP")
+
+// The kind of an Op.
+type OpKind uint8
+
+const (
+	// Lng blocks from Start were allocated.
+	OpKindAlloc OpKind = iota+1
+	
+	// Lng blocks from Start were freed.
+	OpKindFree
+	
+	// The chunk Chunk was added to the file.
+	OpKindGrow
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpKindAlloc: return "alloc"
+	case OpKindFree: return "free"
+	case OpKindGrow: return "grow"
+	}
+	return fmt.Sprintf("OpKind(%d)",uint8(k))
+}
+
+/*
+A mutation of the allocation state, in the form shared by replication, tests and logs:
+Record hands them out as they happen, Apply re-executes them on another PageAllocator.
+
+The extent of an allocation is the one handed to the caller, without its redzones.
+*/
+type Op struct{
+	Kind  OpKind
+	Extent
+	Chunk int64
+}
+
+/*
+Encoding of an Op (see AppendOp):
+	version
+	kind
+	uvarint, start block (OpKindGrow: chunk index)
+	uvarint, number of blocks (OpKindGrow: 0)
+
+Decoders accept every version up to opVersion.
+*/
+const opVersion = 1
+
+// Appends the encoding of op to b.
+func AppendOp(b []byte, op Op) []byte {
+	b = append(b,opVersion,byte(op.Kind))
+	if op.Kind==OpKindGrow { return binary.AppendUvarint(binary.AppendUvarint(b,uint64(op.Chunk)),0) }
+	return binary.AppendUvarint(binary.AppendUvarint(b,uint64(op.Start)),uint64(op.Len))
+}
+
+// Decodes the Op at the start of b. Returns the number of bytes read.
+func DecodeOp(b []byte) (op Op, n int, err error) {
+	if len(b)<2 { return op,0,BADOP }
+	if b[0]==0 || b[0]>opVersion { return op,0,fmt.Errorf("%w: version %d",BADOP,b[0]) }
+	op.Kind,n = OpKind(b[1]),2
+	x,k := binary.Uvarint(b[n:])
+	if k<=0 { return Op{},0,BADOP }
+	n += k
+	y,k := binary.Uvarint(b[n:])
+	if k<=0 { return Op{},0,BADOP }
+	n += k
+	switch op.Kind {
+	case OpKindAlloc,OpKindFree: op.Start,op.Len = int64(x),int64(y)
+	case OpKindGrow: op.Chunk = int64(x)
+	default: return Op{},0,fmt.Errorf("%w: kind %d",BADOP,b[1])
+	}
+	return
+}
+
+// Decodes a sequence of Ops appended with AppendOp.
+func DecodeOps(b []byte) (ops []Op, err error) {
+	for len(b)>0 {
+		op,n,err := DecodeOp(b)
+		if err!=nil { return ops,err }
+		ops = append(ops,op)
+		b = b[n:]
+	}
+	return
+}
+
+func (op Op) MarshalBinary() ([]byte, error) { return AppendOp(nil,op),nil }
+
+func (op *Op) UnmarshalBinary(b []byte) (err error) {
+	var n int
+	if *op,n,err = DecodeOp(b); err==nil && n!=len(b) { err = BADOP }
+	return
+}
+
+// The operation of an audit record.
+func (r *AuditRecord) Operation() Op {
+	if r.Op==AuditFree { return Op{Kind: OpKindFree, Extent: r.Extent} }
+	return Op{Kind: OpKindAlloc, Extent: r.Extent}
+}
+
+type opRecorder struct{
+	fn func(Op)
+}
+
+/*
+Calls fn with every Op from now on, until stop is called. fn is called in order, with the
+allocator locked: it must not call the allocator. Only allocations, frees and growth are
+recorded; ImportChunk, MoveBlocks's copies and other changes of the bitmaps as a whole are not.
+*/
+func (pa *PageAllocator) Record(fn func(Op)) (stop func()) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	r := &opRecorder{fn}
+	pa.recorders = append(pa.recorders,r)
+	return func() {
+		pa.mu.Lock()
+		defer pa.mu.Unlock()
+		for i,o := range pa.recorders {
+			if o!=r { continue }
+			pa.recorders = append(pa.recorders[:i],pa.recorders[i+1:]...)
+			return
+		}
+	}
+}
+
+func (pa *PageAllocator) record(op Op) {
+	pa.countHeat(op)
+	for _,r := range pa.recorders { r.fn(op) }
+}
+
+/*
+Applies the ops in order, with the bitmaps written back once at the end. Allocations take
+exactly the recorded blocks, which must be free; frees go through the quarantine like FreeBlocks,
+and fail with LEASED like it.
+Stops at the first op, that fails, and returns the number of ops applied.
+
+Applied to a PageAllocator of the same FormatConfig, that holds the state the ops were
+recorded on, the ops reproduce the recorded state.
+*/
+func (pa *PageAllocator) Apply(ops []Op) (n int, err error) {
+	if err = pa.enter(); err!=nil { return }
+	pa.batching = true
+	for _,op := range ops {
+		if err = pa.applyOp(op); err!=nil { break }
+		n++
+	}
+	w,e := pa.commitBatch()
+	if err==nil { err = e }
+	pa.leave(&err)
+	notify(w,err)
+	return
+}
+
+func (pa *PageAllocator) applyOp(op Op) (err error) {
+	switch op.Kind {
+	case OpKindAlloc:
+		if op.Len==0 { return }
+		return pa.claim(op.Start,op.Len)
+	case OpKindFree:
+		if _,_,err = pa.checkRange(op.Start,op.Len); err!=nil || op.Len==0 { return }
+		if err = pa.checkLeases(op.Start,op.Len); err!=nil { return }
+		if pa.quarantineOn() {
+			pa.quarantine(op.Start,op.Len)
+			return
+		}
+		_,_,err = pa.applyFree(op.Start,op.Len)
+		return
+	case OpKindGrow:
+		if op.Chunk<0 { return fmt.Errorf("%w: chunk %d",BADOP,op.Chunk) }
+		for err==nil && int64(len(pa.allocators))<=op.Chunk { err = pa.appendAllocator() }
+		return
+	}
+	return fmt.Errorf("%w: kind %d",BADOP,op.Kind)
+}
+
+// Allocates exactly the blocks [blk,blk+lng), with their redzones.
+func (pa *PageAllocator) claim(blk, lng int64) (err error) {
+	pa.opClass(OpAllocate)
+	raw,rlng := blk,lng
+	if pa.Redzones { raw,rlng = blk-1,lng+2 }
+	c,pos,err := pa.checkRange(raw,rlng)
+	if err!=nil { return }
+	i := int(c)
+	if pa.readOnly(i) { return pa.readOnlyChunk(c) }
+	pa.touch(i)
+	a := &pa.allocators[i]
+	if bitmap.CountInUse(a.buffer,pos,rlng)!=0 { return fmt.Errorf("%w: blocks %d+%d are in use",BADOP,blk,lng) }
+	bitmap.WriteInUse(pa.writable(i),pos,rlng)
+	pa.usedBlocks.Add(rlng)
+	pa.checkWatermarks()
+	pa.markDirty(i,pos,rlng)
+	if a.index.valid { a.index.allocated(pos,rlng,pa.runIndexSize()) }
+	if pa.Redzones {
+		if err = pa.poison(raw,lng); err!=nil { return }
+	}
+	if err = pa.audit(AuditAllocate,blk,lng,pa.owner); err!=nil {
+		pa.applyFreeRaw(raw,rlng)
+		return
+	}
+	pa.traceAllocate(lng,false,blk,true)
+	pa.record(Op{Kind: OpKindAlloc, Extent: Extent{blk,lng}})
+	return pa.commitChunk(i,false)
+}
@@ -0,0 +1,188 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"fmt"
+	"time"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// When an Option can be applied.
+type optionKind uint8
+
+const (
+	// Changes the format: only Create accepts it.
+	optFormat optionKind = iota
+	// Fixed while the file is open: Create and Open accept it.
+	optOpen
+	// Reconfigure accepts it as well.
+	optLive
+)
+
+/*
+A setting for Create, Open and Reconfigure.
+Options, that change the format (like Format or WithTrailers), are only accepted by Create;
+options, that can't change while the file is open (like WithoutMmap), are rejected by Reconfigure.
+*/
+type Option struct{
+	name string
+	kind optionKind
+	// The arguments are invalid.
+	err  error
+	set  func(pa *PageAllocator)
+}
+
+func (o Option) String() string { return o.name }
+
+func badOption(name string, format string, args ...interface{}) Option {
+	return Option{name: name, err: fmt.Errorf("%w: %s: "+format,append([]interface{}{BADCONFIG,name},args...)...)}
+}
+
+// The block size (1<<blockSizeLog), and the size of the bitmaps and the file header in blocks.
+func Format(blockSizeLog, bitmapBlocks, prefixBlocks uint8) Option {
+	return Option{"Format",optFormat,nil,func(pa *PageAllocator) {
+		pa.BlockSizeLog,pa.BitmapBlocks,pa.PrefixBlocks = blockSizeLog,bitmapBlocks,prefixBlocks
+	}}
+}
+
+// Sets Doublewrite.
+func WithDoublewrite() Option {
+	return Option{"WithDoublewrite",optFormat,nil,func(pa *PageAllocator) { pa.Doublewrite = true }}
+}
+
+// Sets Trailers.
+func WithTrailers() Option {
+	return Option{"WithTrailers",optFormat,nil,func(pa *PageAllocator) { pa.Trailers = true }}
+}
+
+// Sets SuperblockBackup.
+func WithSuperblockBackup() Option {
+	return Option{"WithSuperblockBackup",optFormat,nil,func(pa *PageAllocator) { pa.SuperblockBackup = true }}
+}
+
+// Sets the BitmapEncoding.
+func WithBitmapEncoding(e bitmap.Encoding) Option {
+	return Option{"WithBitmapEncoding",optFormat,nil,func(pa *PageAllocator) { pa.BitmapEncoding = e }}
+}
+
+// Sets the Checksum.
+func WithChecksum(c Checksum) Option {
+	if !c.Valid() { return badOption("WithChecksum","unknown algorithm %d",uint8(c)) }
+	return Option{"WithChecksum",optFormat,nil,func(pa *PageAllocator) { pa.Checksum = c }}
+}
+
+// Sets DontUseMmap.
+func WithoutMmap() Option {
+	return Option{"WithoutMmap",optOpen,nil,func(pa *PageAllocator) { pa.DontUseMmap = true }}
+}
+
+// Sets Salvage.
+func WithSalvage() Option {
+	return Option{"WithSalvage",optOpen,nil,func(pa *PageAllocator) { pa.Salvage = true }}
+}
+
+// Sets the SyncPolicy and the CommitInterval. Switching to SyncEachOp writes back the deferred modifications.
+func WithSyncPolicy(p SyncPolicy, interval time.Duration) Option {
+	if p>SyncOnFlush { return badOption("WithSyncPolicy","unknown policy %d",p) }
+	return Option{"WithSyncPolicy",optLive,nil,func(pa *PageAllocator) { pa.SyncPolicy,pa.CommitInterval = p,interval }}
+}
+
+// Whether mmapped bitmaps are msynced and heap-backed ones are fsynced (clears DontMsync and DontFsync).
+func WithSync(msync, fsync bool) Option {
+	return Option{"WithSync",optLive,nil,func(pa *PageAllocator) { pa.DontMsync,pa.DontFsync = !msync,!fsync }}
+}
+
+// Sets HighWatermark and LowWatermark.
+func WithWatermarks(high, low float64) Option {
+	if high<0 || high>1 || low<0 || low>1 { return badOption("WithWatermarks","%g and %g are not fractions",high,low) }
+	return Option{"WithWatermarks",optLive,nil,func(pa *PageAllocator) { pa.HighWatermark,pa.LowWatermark = high,low }}
+}
+
+// Sets the Placement. Changing it restarts the adaption of PlaceAuto.
+func WithPlacement(p Placement) Option {
+	if p>PlaceAuto { return badOption("WithPlacement","unknown placement %d",p) }
+	return Option{"WithPlacement",optLive,nil,func(pa *PageAllocator) { pa.Placement = p }}
+}
+
+// Sets MaxChunks. Existing chunks beyond it are kept.
+func WithMaxChunks(n int) Option {
+	if n<0 { return badOption("WithMaxChunks","%d chunks",n) }
+	return Option{"WithMaxChunks",optLive,nil,func(pa *PageAllocator) { pa.MaxChunks = n }}
+}
+
+// Sets the ScrubRate in bitmap bytes per second.
+func WithScrubRate(rate int64) Option {
+	if rate<0 { return badOption("WithScrubRate","%d bytes per second",rate) }
+	return Option{"WithScrubRate",optLive,nil,func(pa *PageAllocator) { pa.ScrubRate = rate }}
+}
+
+// Sets the OpTimeout.
+func WithOpTimeout(d time.Duration) Option {
+	return Option{"WithOpTimeout",optLive,nil,func(pa *PageAllocator) {
+		pa.OpTimeout = d
+		pa.opTimeout.Store(int64(d))
+	}}
+}
+
+// Sets QuarantineFlushes and QuarantineTime. Shortening them takes effect on the next Flush().
+func WithQuarantine(flushes int, d time.Duration) Option {
+	return Option{"WithQuarantine",optLive,nil,func(pa *PageAllocator) { pa.QuarantineFlushes,pa.QuarantineTime = flushes,d }}
+}
+
+// Sets the Maintenance policy and OnCompact.
+func WithMaintenance(p MaintenancePolicy, compact func(pa *PageAllocator) error) Option {
+	return Option{"WithMaintenance",optLive,nil,func(pa *PageAllocator) { pa.Maintenance,pa.OnCompact = p,compact }}
+}
+
+// Sets SlowOpThreshold and OnSlowOp.
+func WithSlowOps(threshold time.Duration, fn func(r SlowOp)) Option {
+	return Option{"WithSlowOps",optLive,nil,func(pa *PageAllocator) { pa.SlowOpThreshold,pa.OnSlowOp = threshold,fn }}
+}
+
+// Checks, that the options are valid and of kind min or later.
+func checkOptions(opts []Option, min optionKind, what string) error {
+	for _,o := range opts {
+		if o.err!=nil { return o.err }
+		if o.set==nil { return fmt.Errorf("%w: zero Option",BADCONFIG) }
+		if o.kind<min { return fmt.Errorf("%w: %s can't be applied by %s",BADCONFIG,o.name,what) }
+	}
+	return nil
+}
+
+func (pa *PageAllocator) apply(opts []Option) {
+	for _,o := range opts { o.set(pa) }
+}
+
+/*
+Changes runtime options of a live allocator. Options, that affect the format or can't change
+while the file is open, are rejected with BADCONFIG, as are invalid ones. If the result fails
+CheckDurability, nothing is changed.
+
+The options are applied together, between two operations.
+*/
+func (pa *PageAllocator) Reconfigure(opts ...Option) (err error) {
+	if err = checkOptions(opts,optLive,"Reconfigure"); err!=nil { return }
+	if err = pa.enter(); err!=nil { return }
+	var w []commitWaiter
+	defer func() { notify(w,err) }()
+	defer pa.leave(&err)
+	
+	// Try the options on the settings, that the durability depends on.
+	probe := &PageAllocator{Storage: pa.Storage, FormatConfig: pa.FormatConfig, SyncPolicy: pa.SyncPolicy}
+	probe.mmapper,probe.bitmapSize = pa.mmapper,pa.bitmapSize
+	probe.apply(opts)
+	if err = probe.CheckDurability(); err!=nil { return }
+	
+	placement := pa.Placement
+	pa.apply(opts)
+	if pa.Placement!=placement { pa.adapt = adaptState{} }
+	pa.checkWatermarks()
+	if pa.syncEachOp() {
+		pa.commit.stop()
+		w,err = pa.flushDirty()
+	}
+	return
+}
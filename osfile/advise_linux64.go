@@ -0,0 +1,18 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build linux && (amd64 || arm64 || riscv64 || ppc64le)
+
+package osfile
+
+import "syscall"
+
+const fadvWillNeed = 3
+
+// Issues posix_fadvise(POSIX_FADV_WILLNEED). Implements filealloc.ReadAdviser.
+func (f *File) WillNeed(off, size int64) error {
+	_,_,e := syscall.Syscall6(syscall.SYS_FADVISE64,f.Fd(),uintptr(off),uintptr(size),fadvWillNeed,0,0)
+	if e!=0 { return e }
+	return nil
+}
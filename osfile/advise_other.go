@@ -0,0 +1,12 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !(linux && (amd64 || arm64 || riscv64 || ppc64le))
+
+package osfile
+
+import "github.com/byte-mug/filealloc"
+
+// Read-ahead hints are not supported on this platform.
+func (f *File) WillNeed(off, size int64) error { return filealloc.UNSUPPORTED }
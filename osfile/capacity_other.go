@@ -0,0 +1,12 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !linux && !darwin && !freebsd
+
+package osfile
+
+import "github.com/byte-mug/filealloc"
+
+// The free space of the file system is not known on this platform.
+func (f *File) Capacity() (int64, error) { return 0,filealloc.UNSUPPORTED }
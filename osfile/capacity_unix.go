@@ -0,0 +1,18 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build linux || darwin || freebsd
+
+package osfile
+
+import "syscall"
+
+// Returns the size, the file can grow to: its current size plus the space available on the file system.
+func (f *File) Capacity() (int64, error) {
+	fi,err := f.Stat()
+	if err!=nil { return 0,err }
+	var st syscall.Statfs_t
+	if err = syscall.Fstatfs(int(f.Fd()),&st); err!=nil { return 0,err }
+	return fi.Size()+int64(st.Bavail)*int64(st.Bsize),nil
+}
@@ -0,0 +1,14 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !unix && !windows
+
+package osfile
+
+import "github.com/byte-mug/filealloc"
+
+// Exclusive opening is not supported on this platform.
+func (f *File) TryLockExclusive() error { return filealloc.UNSUPPORTED }
+
+func (f *File) UnlockExclusive() error { return filealloc.UNSUPPORTED }
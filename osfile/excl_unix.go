@@ -0,0 +1,30 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build unix
+
+package osfile
+
+import (
+	"fmt"
+	"syscall"
+	"github.com/byte-mug/filealloc"
+)
+
+/*
+Acquires an exclusive flock(2) on the file without blocking. Implements filealloc.ExclusiveLocker.
+As it is the same lock as LockFile's, it can't be combined with MultiProcess mode.
+*/
+func (f *File) TryLockExclusive() error {
+	for {
+		err := syscall.Flock(int(f.Fd()),syscall.LOCK_EX|syscall.LOCK_NB)
+		if err==syscall.EWOULDBLOCK { return fmt.Errorf("%w: %s",filealloc.LOCKED,f.Name()) }
+		if err!=syscall.EINTR { return err }
+	}
+}
+
+// Releases the flock(2).
+func (f *File) UnlockExclusive() error {
+	return syscall.Flock(int(f.Fd()),syscall.LOCK_UN)
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package osfile
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+	"github.com/byte-mug/filealloc"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// The locked byte lies far beyond the end of the file, as LockFileEx locks are mandatory.
+func lockOverlapped() *syscall.Overlapped {
+	return &syscall.Overlapped{Offset: 0xffffffff, OffsetHigh: 0x7fffffff}
+}
+
+// Acquires an exclusive LockFileEx lock without blocking. Implements filealloc.ExclusiveLocker.
+func (f *File) TryLockExclusive() error {
+	r,_,e := procLockFileEx.Call(f.Fd(),lockfileExclusiveLock|lockfileFailImmediately,0,1,0,uintptr(unsafe.Pointer(lockOverlapped())))
+	if r!=0 { return nil }
+	if e==errorLockViolation { return fmt.Errorf("%w: %s",filealloc.LOCKED,f.Name()) }
+	return e
+}
+
+// Releases the LockFileEx lock.
+func (f *File) UnlockExclusive() error {
+	r,_,e := procUnlockFileEx.Call(f.Fd(),0,1,0,uintptr(unsafe.Pointer(lockOverlapped())))
+	if r!=0 { return nil }
+	return e
+}
@@ -0,0 +1,30 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+/*
+Decorates *os.File with the optional Storage capabilities of filealloc, that need OS-specific system calls.
+*/
+package osfile
+
+import "os"
+
+// A *os.File, that implements the optional Storage interfaces of filealloc.
+type File struct{
+	*os.File
+	// The file was marked sparse (windows).
+	sparse bool
+}
+
+// Wraps an open file.
+func Wrap(f *os.File) *File { return &File{File: f} }
+
+// Opens a file, like os.OpenFile.
+func Open(name string, flag int, perm os.FileMode) (*File, error) {
+	f,err := os.OpenFile(name,flag,perm)
+	if err!=nil { return nil,err }
+	return &File{File: f},nil
+}
+
+// Returns the underlying file.
+func (f *File) OsFile() *os.File { return f.File }
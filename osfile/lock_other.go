@@ -0,0 +1,14 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !unix
+
+package osfile
+
+import "github.com/byte-mug/filealloc"
+
+// File locking is not supported on this platform.
+func (f *File) LockFile() error { return filealloc.UNSUPPORTED }
+
+func (f *File) UnlockFile() error { return filealloc.UNSUPPORTED }
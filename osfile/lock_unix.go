@@ -0,0 +1,22 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build unix
+
+package osfile
+
+import "syscall"
+
+// Acquires an exclusive flock(2) on the file. Implements filealloc.FileLocker.
+func (f *File) LockFile() error {
+	for {
+		err := syscall.Flock(int(f.Fd()),syscall.LOCK_EX)
+		if err!=syscall.EINTR { return err }
+	}
+}
+
+// Releases the flock(2).
+func (f *File) UnlockFile() error {
+	return syscall.Flock(int(f.Fd()),syscall.LOCK_UN)
+}
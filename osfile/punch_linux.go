@@ -0,0 +1,27 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package osfile
+
+import (
+	"syscall"
+	"github.com/byte-mug/filealloc"
+)
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// Deallocates the range with fallocate(2). Implements filealloc.HolePuncher.
+func (f *File) PunchHole(off, size int64) error {
+	for {
+		err := syscall.Fallocate(int(f.Fd()),fallocPunchHole|fallocKeepSize,off,size)
+		switch err {
+		case syscall.EINTR: continue
+		case syscall.EOPNOTSUPP, syscall.ENOSYS: return filealloc.UNSUPPORTED
+		}
+		return err
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !linux && !windows
+
+package osfile
+
+import "github.com/byte-mug/filealloc"
+
+// Hole punching is not supported on this platform.
+func (f *File) PunchHole(off, size int64) error { return filealloc.UNSUPPORTED }
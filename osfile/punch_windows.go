@@ -0,0 +1,40 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package osfile
+
+import (
+	"syscall"
+	"unsafe"
+	"github.com/byte-mug/filealloc"
+)
+
+const (
+	fsctlSetSparse   = 0x000900c4
+	fsctlSetZeroData = 0x000980c8
+	
+	errorInvalidFunction syscall.Errno = 1
+)
+
+// FILE_ZERO_DATA_INFORMATION
+type zeroDataInformation struct{
+	FileOffset, BeyondFinalZero int64
+}
+
+/*
+Deallocates the range with FSCTL_SET_ZERO_DATA. Implements filealloc.HolePuncher.
+
+The file is marked sparse first. If that fails, the range is still zeroed, but stays allocated.
+*/
+func (f *File) PunchHole(off, size int64) error {
+	var n uint32
+	h := syscall.Handle(f.Fd())
+	if !f.sparse {
+		f.sparse = syscall.DeviceIoControl(h,fsctlSetSparse,nil,0,nil,0,&n,nil)==nil
+	}
+	zd := zeroDataInformation{off,off+size}
+	err := syscall.DeviceIoControl(h,fsctlSetZeroData,(*byte)(unsafe.Pointer(&zd)),uint32(unsafe.Sizeof(zd)),nil,0,&n,nil)
+	if err==errorInvalidFunction { return filealloc.UNSUPPORTED }
+	return err
+}
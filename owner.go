@@ -0,0 +1,209 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+var NOOWNERTABLE = errors.New("NO_OWNER_TABLE")
+var NOTOWNED = errors.New("NOT_OWNED")
+
+// Identifies the owner of an extent. Either a small integer or an 8-byte label (see Label).
+type OwnerTag uint64
+
+// Packs the first 8 bytes of s into an OwnerTag.
+func Label(s string) OwnerTag {
+	var b [8]byte
+	copy(b[:],s)
+	return OwnerTag(binary.BigEndian.Uint64(b[:]))
+}
+
+// Returns the label, if the tag is made of printable characters, the number otherwise.
+func (t OwnerTag) String() string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],uint64(t))
+	n := 8
+	for n>0 && b[n-1]==0 { n-- }
+	if n==0 { return "0" }
+	for _,c := range b[:n] {
+		if c<0x20 || c>0x7e { return strconv.FormatUint(uint64(t),10) }
+	}
+	return string(b[:n])
+}
+
+/*
+Layout of the OwnerTable: one 32-byte slot for each data block (little endian),
+	length of the extent starting at this block (0 = none)
+	owner tag
+	expiry, in unix nanoseconds (0 = none)
+	(reserved)
+
+Only the first block of an extent has a slot filled in. Slots of free blocks are zero.
+The table is not fsynced: after a crash, it may miss recent allocations.
+*/
+const ownerSlot = 32
+const ownerBatch = 256
+
+type ownerRecord struct{
+	Len     int64
+	Tag     OwnerTag
+	Expires int64
+}
+
+func (r *ownerRecord) decode(b []byte) {
+	r.Len = int64(binary.LittleEndian.Uint64(b))
+	r.Tag = OwnerTag(binary.LittleEndian.Uint64(b[8:]))
+	r.Expires = int64(binary.LittleEndian.Uint64(b[16:]))
+}
+func (r *ownerRecord) encode(b []byte) {
+	binary.LittleEndian.PutUint64(b,uint64(r.Len))
+	binary.LittleEndian.PutUint64(b[8:],uint64(r.Tag))
+	binary.LittleEndian.PutUint64(b[16:],uint64(r.Expires))
+	binary.LittleEndian.PutUint64(b[24:],0)
+}
+
+func (pa *PageAllocator) ownerOffset(chunk, pos int64) int64 {
+	return (chunk*pa.RunSizeInBlocks()+pos)*ownerSlot
+}
+
+// Reads the slots of the blocks [pos,pos+len(buf)/ownerSlot) of the chunk. Missing slots read as zero.
+func (pa *PageAllocator) readOwners(chunk, pos int64, buf []byte) (err error) {
+	n,err := pa.OwnerTable.ReadAt(buf,pa.ownerOffset(chunk,pos))
+	for i := n; i<len(buf); i++ { buf[i] = 0 }
+	if err==io.EOF { err = nil }
+	return
+}
+
+func (pa *PageAllocator) writeOwner(chunk, pos int64, r ownerRecord) (err error) {
+	var b [ownerSlot]byte
+	r.encode(b[:])
+	_,err = pa.OwnerTable.WriteAt(b[:],pa.ownerOffset(chunk,pos))
+	return
+}
+
+// Finds the record of the extent covering the block. pos is the block's position in the chunk.
+func (pa *PageAllocator) findOwner(chunk, pos int64) (start int64, r ownerRecord, ok bool, err error) {
+	bm := pa.bitmapOf(int(chunk))
+	buf := make([]byte,ownerBatch*ownerSlot)
+	for end := pos+1; end>0; {
+		from := end-ownerBatch
+		if from<0 { from = 0 }
+		b := buf[:(end-from)*ownerSlot]
+		if err = pa.readOwners(chunk,from,b); err!=nil { return }
+		for j := end-1; j>=from; j-- {
+			if isFree(bm,j,1) { return }
+			r.decode(b[(j-from)*ownerSlot:])
+			if r.Len==0 { continue }
+			return j,r,j+r.Len>pos,nil
+		}
+		end = from
+	}
+	return
+}
+
+// Clears the slots of the blocks [pos,pos+lng) of the chunk and trims the extent overlapping its start.
+func (pa *PageAllocator) clearOwners(chunk, pos, lng int64) (err error) {
+	start,r,ok,err := pa.findOwner(chunk,pos)
+	if err!=nil { return }
+	if ok && start<pos {
+		rest := r
+		r.Len = pos-start
+		if err = pa.writeOwner(chunk,start,r); err!=nil { return }
+		if rest.Len = start+rest.Len-pos-lng; rest.Len>0 {
+			return pa.writeOwner(chunk,pos+lng,rest)
+		}
+	} else if ok && r.Len>lng {
+		r.Len -= lng
+		if err = pa.writeOwner(chunk,pos+lng,r); err!=nil { return }
+	}
+	buf := make([]byte,ownerBatch*ownerSlot)
+	for from := pos; from<pos+lng; from += ownerBatch {
+		n := pos+lng-from
+		if n>ownerBatch { n = ownerBatch }
+		b := buf[:n*ownerSlot]
+		if err = pa.readOwners(chunk,from,b); err!=nil { return }
+		zero := true
+		for _,c := range b {
+			if c!=0 { zero = false; break }
+		}
+		if zero { continue }
+		for j := range b { b[j] = 0 }
+		if _,err = pa.OwnerTable.WriteAt(b,pa.ownerOffset(chunk,from)); err!=nil { return }
+	}
+	return
+}
+
+func (pa *PageAllocator) allocateRecorded(lng int64, grow bool, r ownerRecord) (blk int64, ok bool, err error) {
+	if pa.OwnerTable==nil { err = NOOWNERTABLE; return }
+	if lng>pa.RunSizeInBlocks() { err = EXCEEDMAX; return }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	pa.owner = r.Tag
+	blk,ok,err = pa.allocate(lng,grow,false)
+	pa.owner = 0
+	if !ok { return }
+	c,pos,_ := pa.BreakAddress(blk)
+	r.Len = lng
+	if err = pa.writeOwner(c,pos,r); err!=nil {
+		pa.doFree(blk,lng)
+		blk,ok = 0,false
+	}
+	return
+}
+
+// Allocates a series of contiguous blocks, like AllocateBlocks, and records tag as their owner in the OwnerTable.
+func (pa *PageAllocator) AllocateOwned(lng int64, grow bool, tag OwnerTag) (blk int64, ok bool, err error) {
+	return pa.allocateRecorded(lng,grow,ownerRecord{Tag: tag})
+}
+
+// Returns the extent containing blk and its owner. Returns NOTOWNED, if blk was not allocated with an owner.
+func (pa *PageAllocator) OwnerOf(blk int64) (e Extent, tag OwnerTag, err error) {
+	if pa.OwnerTable==nil { err = NOOWNERTABLE; return }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	c,pos,ok := pa.BreakAddress(blk)
+	if !ok || c>=int64(len(pa.allocators)) || pos>=pa.RunSizeInBlocks() { err = OUTOFBOUNDS; return }
+	start,r,ok,err := pa.findOwner(c,pos)
+	if err!=nil { return }
+	if !ok { err = NOTOWNED; return }
+	return Extent{pa.MakeAddress(c,start),r.Len},r.Tag,nil
+}
+
+// Returns all extents owned by tag, in address order.
+func (pa *PageAllocator) ExtentsOwnedBy(tag OwnerTag) (l []Extent, err error) {
+	if pa.OwnerTable==nil { err = NOOWNERTABLE; return }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	err = pa.forEachOwner(func(c, pos int64, r ownerRecord) bool {
+		if r.Tag==tag { l = append(l,Extent{pa.MakeAddress(c,pos),r.Len}) }
+		return true
+	})
+	return
+}
+
+// Calls fn for every record in the OwnerTable, in address order, until it returns false.
+func (pa *PageAllocator) forEachOwner(fn func(c, pos int64, r ownerRecord) bool) (err error) {
+	buf := make([]byte,ownerBatch*ownerSlot)
+	max := pa.RunSizeInBlocks()
+	var r ownerRecord
+	for c := range pa.allocators {
+		for from := int64(0); from<max; from += ownerBatch {
+			n := max-from
+			if n>ownerBatch { n = ownerBatch }
+			b := buf[:n*ownerSlot]
+			if err = pa.readOwners(int64(c),from,b); err!=nil { return }
+			for j := int64(0); j<n; j++ {
+				r.decode(b[j*ownerSlot:])
+				if r.Len==0 { continue }
+				if !fn(int64(c),from+j,r) { return }
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// The Storage lacks an optional capability, the operation needs.
+var UNSUPPORTED = errors.New("UNSUPPORTED")
+
+// Where allocations are placed.
+type Placement uint8
+
+const (
+	// The first chunk with enough space. Within a chunk, the free-run index (if any) picks the best fitting run.
+	PlaceDefault Placement = iota
+	
+	// Always the lowest free position, to keep the tail of the file empty, so that Shrink() can reclaim it.
+	PlaceLowest
+	
+	// Start with the chunk of the previous allocation, wrapping around. Skips the full chunks
+	// at the start of the file, that first-fit probes again and again.
+	PlaceNextFit
+	
+	// The smallest free run, that fits, across all chunks. Scans the bitmaps, but keeps large runs intact.
+	PlaceBestFit
+	
+	// Switch between PlaceDefault, PlaceNextFit and PlaceBestFit at runtime, based on the probed
+	// chunks and the allocations failing for fragmentation. Changes emit EventPlacement.
+	// See EffectivePlacement.
+	PlaceAuto
+)
+
+// Describes the end of the file, with regards to truncation.
+type TailUsage struct{
+	// Chunks at the end of the file without allocated blocks. Shrink() can remove them.
+	// The first chunk is never counted.
+	EmptyChunks int
+	
+	// The last allocated block, or -1 if there is none.
+	LastUsedBlock int64
+	
+	// Allocated blocks in the last non-empty chunk, that must move, before it can be removed.
+	BlockingBlocks int64
+}
+
+func isZero(bm []byte) bool {
+	for _,c := range bm {
+		if c!=0 { return false }
+	}
+	return true
+}
+
+// Reports, how much of the end of the file is free.
+func (pa *PageAllocator) TailUsage() TailUsage {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	return pa.tailUsage()
+}
+
+func (pa *PageAllocator) tailUsage() (tu TailUsage) {
+	tu.LastUsedBlock = -1
+	i := len(pa.allocators)-1
+	for ; i>0 && isZero(pa.bitmapOf(i)); i-- { tu.EmptyChunks++ }
+	if i<0 { return }
+	bitmap.ForEachUsedRun(pa.bitmapOf(i),func(pos, lng int64) bool {
+		tu.LastUsedBlock = pa.MakeAddress(int64(i),pos+lng-1)
+		tu.BlockingBlocks += lng
+		return true
+	})
+	if i==0 { tu.BlockingBlocks = 0 }
+	return
+}
+
+// Removes the empty chunks at the end of the file and truncates it. The Storage must be a Truncater.
+func (pa *PageAllocator) Shrink() (removed int, err error) {
+	t,ok := pa.Storage.(Truncater)
+	if !ok { return 0,UNSUPPORTED }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	n := pa.tailUsage().EmptyChunks
+	if n==0 { return }
+	keep := len(pa.allocators)-n
+	if err = t.Truncate(pa.allocators[keep].rawoff); err!=nil { return }
+	for i := keep; i<len(pa.allocators); i++ {
+		if pa.allocators[i].mmapped { pa.mmapper.MemUnmap(pa.allocators[i].buffer) }
+		pa.allocators[i] = bitmapBuffer{}
+	}
+	pa.allocators = pa.allocators[:keep]
+	pa.changed = true
+	pa.emit(Event{Kind: EventShrink, Chunk: int64(keep)})
+	pa.checkWatermarks()
+	pa.spaceFreed()
+	// A chunk, that is added later, must not inherit them. Should this fail, Init drops them.
+	if pa.dropChunkStates(keep) && pa.hasSuper {
+		if err = pa.writeSuperblock(); err!=nil { return }
+	}
+	return n,nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"sync"
+)
+
+// The PagePool was closed.
+var POOLCLOSED = errors.New("POOL_CLOSED")
+
+/*
+Allocates n extents of lng contiguous blocks each, growing the file if needed and allowed.
+The bitmaps are written back once for the whole batch, according to the SyncPolicy.
+Either all n extents are allocated, or none.
+*/
+func (pa *PageAllocator) AllocateBatch(lng int64, n int, grow bool) (blks []int64, err error) {
+	if lng>pa.RunSizeInBlocks() { return nil,EXCEEDMAX }
+	if err = pa.enter(); err!=nil { return }
+	pa.batching = true
+	blks = make([]int64,0,n)
+	for len(blks)<n {
+		blk,ok,e := pa.allocate(lng,grow,false)
+		if e==nil && !ok { e = EXTHAUSTED }
+		if e!=nil {
+			for _,b := range blks { pa.applyFree(b,lng) }
+			blks,err = nil,e
+			break
+		}
+		blks = append(blks,blk)
+	}
+	w,e := pa.commitBatch()
+	if err==nil { err = e }
+	pa.leave(&err)
+	notify(w,err)
+	return
+}
+
+/*
+Frees extents of lng blocks each, like FreeBlocks, but writes the bitmaps back once for the whole batch.
+All ranges are checked, before any is freed.
+*/
+func (pa *PageAllocator) FreeBatch(blks []int64, lng int64) (err error) {
+	if err = pa.enter(); err!=nil { return }
+	for _,b := range blks {
+		if _,_,err = pa.checkRange(b,lng); err==nil { err = pa.checkLeases(b,lng) }
+		if err!=nil {
+			pa.leave(&err)
+			return
+		}
+	}
+	if lng==0 {
+		pa.leave(&err)
+		return
+	}
+	pa.batching = true
+	for _,b := range blks {
+		if pa.quarantineOn() {
+			pa.quarantine(b,lng)
+		} else if _,_,e := pa.applyFree(b,lng); err==nil {
+			err = e
+		}
+	}
+	w,e := pa.commitBatch()
+	if err==nil { err = e }
+	pa.leave(&err)
+	notify(w,err)
+	return
+}
+
+// Ends a batch: writes the modified bitmaps back or defers them, according to the SyncPolicy.
+// Bitmaps in persistent memory are flushed right away.
+// Returns the waiters to notify.
+func (pa *PageAllocator) commitBatch() (w []commitWaiter, err error) {
+	pa.batching = false
+	if pa.syncEachOp() { return pa.flushDirty() }
+	var dirty []int
+	for i := range pa.allocators {
+		if a := &pa.allocators[i]; a.dirty && a.persistent && !pa.DontMsync { dirty = append(dirty,i) }
+	}
+	if len(dirty)>0 {
+		if err = pa.flushChunks(dirty); err!=nil { return }
+	}
+	if pa.policy()==SyncGroupCommit {
+		for i := range pa.allocators {
+			if a := &pa.allocators[i]; a.dirty { a.urgent = true }
+		}
+		pa.scheduleCommit()
+	}
+	return
+}
+
+/*
+A pool of pages, extents of a fixed number of blocks, for users with a single page size, like B-trees.
+
+The pool allocates pages from the PageAllocator in batches and keeps the returned ones on an
+in-memory freelist, so that most Get and Put calls don't touch the bitmaps at all.
+Pages on the freelist remain allocated in the file: if the process crashes, they leak.
+Close() returns them.
+*/
+type PagePool struct{
+	pa     *PageAllocator
+	blocks int64
+	batch  int
+	mu     sync.Mutex
+	free   []int64
+	closed bool
+}
+
+/*
+Creates a pool of pages of the given number of blocks, that are allocated batch pages at a time.
+Once the freelist holds more than two batches, a batch is returned to the allocator.
+*/
+func (pa *PageAllocator) NewPagePool(blocks int64, batch int) *PagePool {
+	if batch<1 { batch = 1 }
+	return &PagePool{pa: pa, blocks: blocks, batch: batch}
+}
+
+// Returns the number of blocks per page.
+func (p *PagePool) PageBlocks() int64 { return p.blocks }
+
+// Takes a page from the freelist, refilling it from the allocator, if empty.
+func (p *PagePool) Get() (blk int64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed { return 0,POOLCLOSED }
+	if len(p.free)==0 {
+		if p.free,err = p.pa.AllocateBatch(p.blocks,p.batch,true); err!=nil { return }
+		// Hand out the lowest page first.
+		for i,j := 0,len(p.free)-1; i<j; i,j = i+1,j-1 { p.free[i],p.free[j] = p.free[j],p.free[i] }
+	}
+	blk = p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	return
+}
+
+// Puts a page back on the freelist.
+func (p *PagePool) Put(blk int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed { return POOLCLOSED }
+	p.free = append(p.free,blk)
+	if len(p.free)<=2*p.batch { return nil }
+	n := len(p.free)-p.batch
+	err := p.pa.FreeBatch(p.free[n:],p.blocks)
+	p.free = p.free[:n]
+	return err
+}
+
+// Returns the number of pages on the freelist.
+func (p *PagePool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.free)
+}
+
+// Returns the pages on the freelist to the allocator. Pages handed out by Get remain allocated.
+func (p *PagePool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed { return POOLCLOSED }
+	p.closed = true
+	err := p.pa.FreeBatch(p.free,p.blocks)
+	p.free = nil
+	return err
+}
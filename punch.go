@@ -0,0 +1,31 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+const zeroBuffer = 1<<16
+
+// Punches a hole over the data of the blocks [blk,blk+lng). Reports, whether it succeeded.
+func (pa *PageAllocator) punchHole(blk, lng int64) bool {
+	hp,ok := pa.Storage.(HolePuncher)
+	if !ok || pa.noPunch { return false }
+	err := hp.PunchHole(blk<<pa.BlockSizeLog,lng<<pa.BlockSizeLog)
+	if err==UNSUPPORTED { pa.noPunch = true }
+	return err==nil
+}
+
+// Zeroes the data of the blocks [blk,blk+lng).
+func (pa *PageAllocator) zeroData(blk, lng int64) (err error) {
+	if pa.punchHole(blk,lng) { return }
+	off,size := blk<<pa.BlockSizeLog,lng<<pa.BlockSizeLog
+	buf := make([]byte,zeroBuffer)
+	if size<zeroBuffer { buf = buf[:size] }
+	for size>0 {
+		if int64(len(buf))>size { buf = buf[:size] }
+		if _,err = pa.WriteAt(buf,off); err!=nil { return }
+		off += int64(len(buf))
+		size -= int64(len(buf))
+	}
+	return
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import "time"
+
+type quarantined struct{
+	Extent
+	flush uint64
+	at    time.Time
+}
+
+func (pa *PageAllocator) quarantineOn() bool { return pa.QuarantineFlushes>0 || pa.quarantineTime()>0 }
+
+// QuarantineTime, or 0 under Deterministic, so that the release depends on the number of flushes only.
+func (pa *PageAllocator) quarantineTime() time.Duration {
+	if pa.Deterministic { return 0 }
+	return pa.QuarantineTime
+}
+
+// Puts an extent freed by FreeBlocks into quarantine.
+func (pa *PageAllocator) quarantine(blk, lng int64) {
+	q := quarantined{Extent: Extent{blk,lng}, flush: pa.flushes}
+	if pa.quarantineTime()>0 { q.at = time.Now() }
+	pa.quarantined = append(pa.quarantined,q)
+}
+
+// Frees the extents, whose quarantine is over, or all of them. Called by flush().
+func (pa *PageAllocator) releaseQuarantine(all bool) (err error) {
+	now,d := time.Now(),pa.quarantineTime()
+	rest := pa.quarantined[:0]
+	for _,q := range pa.quarantined {
+		if !all && (pa.flushes-q.flush<uint64(pa.QuarantineFlushes) || now.Sub(q.at)<d) {
+			rest = append(rest,q)
+			continue
+		}
+		if _,_,e := pa.applyFree(q.Start,q.Len); err==nil { err = e }
+	}
+	for i := len(rest); i<len(pa.quarantined); i++ { pa.quarantined[i] = quarantined{} }
+	pa.quarantined = rest
+	return
+}
+
+/*
+Returns the number of extents and blocks in quarantine: freed by FreeBlocks,
+but not yet available for allocation (see QuarantineFlushes and QuarantineTime).
+*/
+func (pa *PageAllocator) QuarantineDepth() (extents int, blocks int64) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	for _,q := range pa.quarantined { blocks += q.Len }
+	return len(pa.quarantined),blocks
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A block range outside the data region of the chunks.
+var BADRANGE = errors.New("BAD_RANGE")
+
+// Where a RangeError's range went astray.
+type RangeFault uint8
+
+const (
+	// The length is negative.
+	FaultLength RangeFault = iota+1
+	
+	// The range starts in the prefix blocks.
+	FaultPrefix
+	
+	// The range starts in the bitmap of a chunk.
+	FaultBitmap
+	
+	// The range extends into the next chunk.
+	FaultChunkBoundary
+	
+	// The chunk doesn't exist. Matches OUTOFBOUNDS as well.
+	FaultBeyondEnd
+)
+
+var faultNames = [...]string{"","negative length","prefix blocks","bitmap","chunk boundary","beyond the last chunk"}
+
+func (f RangeFault) String() string {
+	if int(f)<len(faultNames) { return faultNames[f] }
+	return "unknown"
+}
+
+/*
+Describes a rejected block range. It matches BADRANGE with errors.Is.
+
+If the package is built with the filealloc_debug tag, range checks panic with a *RangeError instead.
+*/
+type RangeError struct{
+	Blk, Len int64
+	Fault    RangeFault
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("BAD_RANGE: blocks %d+%d: %v",e.Blk,e.Len,e.Fault)
+}
+
+func (e *RangeError) Is(target error) bool {
+	return target==BADRANGE || (target==OUTOFBOUNDS && e.Fault==FaultBeyondEnd)
+}
+
+// Checks, that [blk,blk+lng) lies within the data region of an existing chunk. pa.mu must be held.
+func (pa *PageAllocator) checkRange(blk, lng int64) (chunk, pos int64, err error) {
+	return pa.FormatConfig.checkRangeIn(blk,lng,len(pa.allocators))
+}
+
+// Checks, that [blk,blk+lng) lies within the data region of one of the first n chunks.
+func (f *FormatConfig) checkRangeIn(blk, lng int64, n int) (chunk, pos int64, err error) {
+	fault := RangeFault(0)
+	c,pos,ok := f.BreakAddress(blk)
+	switch {
+	case lng<0: fault = FaultLength
+	case blk<int64(f.PrefixBlocks): fault = FaultPrefix
+	case !ok: fault = FaultBitmap
+	case c>=int64(n): fault = FaultBeyondEnd
+	case lng>f.RunSizeInBlocks()-pos: fault = FaultChunkBoundary
+	default: return c,pos,nil
+	}
+	re := &RangeError{blk,lng,fault}
+	if debugRanges { panic(re) }
+	return 0,0,re
+}
+
+// Checks the range of the blocks holding len(p) bytes from blk on.
+func (pa *PageAllocator) checkIO(blk int64, n int) (err error) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	_,_,err = pa.checkRange(blk,pa.BlocksFor(int64(n)))
+	return
+}
+
+// Reads len(p) bytes from the data blocks starting at blk. The range must lie within one chunk's data region.
+func (pa *PageAllocator) ReadBlock(blk int64, p []byte) (err error) {
+	if err = pa.checkIO(blk,len(p)); err!=nil { return }
+	off,err := pa.BlockOffset(blk)
+	if err!=nil { return }
+	_,err = pa.ReadAt(p,off)
+	return
+}
+
+// Writes p to the data blocks starting at blk. The range must lie within one chunk's data region.
+func (pa *PageAllocator) WriteBlock(blk int64, p []byte) (err error) {
+	if err = pa.checkIO(blk,len(p)); err!=nil { return }
+	off,err := pa.BlockOffset(blk)
+	if err!=nil { return }
+	_,err = pa.WriteAt(p,off)
+	return
+}
@@ -0,0 +1,28 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+/*
+Optional interface of a Storage, that takes hints on ranges, that will be read soon,
+like posix_fadvise(POSIX_FADV_WILLNEED). See the osfile package for an implementation.
+*/
+type ReadAdviser interface{
+	WillNeed(off, size int64) error
+}
+
+/*
+Hints the Storage to read ahead, if the allocation [blk,blk+lng) continues the previous one:
+the extent and the following ReadAheadOnAllocate blocks of the chunk.
+*/
+func (pa *PageAllocator) readAhead(blk, lng int64) {
+	seq := blk==pa.streamEnd
+	pa.streamEnd = blk+lng
+	ra,ok := pa.Storage.(ReadAdviser)
+	if !ok || !seq { return }
+	_,pos,_ := pa.BreakAddress(blk)
+	n := lng+pa.ReadAheadOnAllocate
+	if max := pa.RunSizeInBlocks()-pos; n>max { n = max }
+	ra.WillNeed(blk<<pa.BlockSizeLog,n<<pa.BlockSizeLog)
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import "github.com/byte-mug/filealloc/bitmap"
+
+// State flags in the superblock.
+const (
+	// Set while the file is open.
+	flagDirty uint32 = 1<<iota
+)
+
+// Describes what Open() did to repair a file, that was not closed cleanly.
+type RecoveryReport struct{
+	// The file was not closed cleanly. If false, no recovery was attempted.
+	Dirty bool
+	
+	// A bitmap was restored from the doublewrite area.
+	DoublewriteReplayed bool
+	DoublewriteChunk int64
+	
+	// Chunks with an incomplete bitmap, whose missing part was marked as used (see FormatConfig.Reconstruct).
+	Reconstructed []int64
+	
+	// Addresses of bitmap blocks with a broken trailer (see FormatConfig.Trailers).
+	// They were marked as entirely used.
+	TornBitmapBlocks []int64
+	
+	// Chunks, whose bitmap was lost, in Salvage mode. They are ChunkSalvaged.
+	Salvaged []int64
+	
+	// The superblock was broken and was restored from its copy (see SuperblockBackup).
+	SuperblockFromBackup bool
+	
+	// The LeaseTable was damaged. The leases are gone.
+	LeasesLost bool
+}
+
+// Returns the report of the recovery done by Open().
+func (pa *PageAllocator) RecoveryReport() RecoveryReport { return pa.recovery }
+
+func (pa *PageAllocator) recover() (err error) {
+	rr := &pa.recovery
+	rr.Dirty = true
+	if pa.Doublewrite {
+		var ok bool
+		rr.DoublewriteChunk,_,ok = pa.readDoublewrite()
+		if ok {
+			err = pa.replayDoublewrite()
+			if err==nil {
+				rr.DoublewriteReplayed = true
+			} else if !pa.Salvage {
+				return
+			}
+			// In Salvage mode, Open goes on, salvageBitmap checks the bitmap, when the chunk is loaded.
+			err = nil
+		}
+	}
+	if pa.Reconstruct { err = pa.reconstruct() }
+	return
+}
+
+// Marks the missing part of incomplete bitmaps as used.
+func (pa *PageAllocator) reconstruct() (err error) {
+	size := int(pa.BitmapBlocks)<<pa.BlockSizeLog
+	buf := make([]byte,size)
+	for chunk := int64(0); ; chunk++ {
+		off := pa.MakeAddress(chunk,-int64(pa.BitmapBlocks))<<pa.BlockSizeLog
+		n,_ := pa.ReadAt(buf,off)
+		if n<=0 { return }
+		if n==size { continue }
+		used := byte(0xff)
+		if pa.BitmapEncoding&bitmap.Invert!=0 { used = 0 }
+		for j := n; j<size; j++ { buf[j] = used }
+		if _,err = pa.WriteAt(buf[n:],off+int64(n)); err!=nil { return }
+		if err = pa.Sync(); err!=nil { return }
+		pa.recovery.Reconstructed = append(pa.recovery.Reconstructed,chunk)
+	}
+}
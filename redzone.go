@@ -0,0 +1,54 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// A redzone was overwritten.
+var REDZONE = errors.New("REDZONE")
+
+var redzonePattern = []byte("!REDZONE")
+
+// Reports an overwritten redzone. It matches REDZONE with errors.Is.
+type RedzoneError struct{
+	// The extent, as allocated by the caller.
+	Extent
+	
+	// The damaged redzone block: Extent.Start-1 or Extent.End().
+	Blk int64
+}
+
+func (e *RedzoneError) Error() string {
+	return fmt.Sprintf("REDZONE: block %d next to extent %d+%d was overwritten",e.Blk,e.Start,e.Len)
+}
+
+func (e *RedzoneError) Is(target error) bool { return target==REDZONE }
+
+func (pa *PageAllocator) redzoneBlock() []byte {
+	return bytes.Repeat(redzonePattern,pa.BlockSize()/len(redzonePattern))
+}
+
+// Writes the redzones of the extent allocated at blk+1.
+func (pa *PageAllocator) poison(blk, lng int64) (err error) {
+	b := pa.redzoneBlock()
+	if _,err = pa.WriteAt(b,blk<<pa.BlockSizeLog); err!=nil { return }
+	_,err = pa.WriteAt(b,(blk+lng+1)<<pa.BlockSizeLog)
+	return
+}
+
+// Checks the redzones of the extent [blk,blk+lng).
+func (pa *PageAllocator) checkRedzones(blk, lng int64) error {
+	want := pa.redzoneBlock()
+	got := make([]byte,len(want))
+	for _,z := range [2]int64{blk-1,blk+lng} {
+		pa.ReadAt(got,z<<pa.BlockSizeLog)
+		if !bytes.Equal(got,want) { return &RedzoneError{Extent{blk,lng},z} }
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc_test
+
+import (
+	"errors"
+	"testing"
+	"github.com/byte-mug/filealloc"
+	"github.com/byte-mug/filealloc/crashtest"
+)
+
+func TestRedzoneFree(t *testing.T) {
+	pa,err := filealloc.Create(crashtest.NewMemFile(nil),filealloc.NewFormatConfig(9))
+	if err!=nil { t.Fatal(err) }
+	pa.Redzones = true
+	data := make([]byte,10*pa.BlockSize())
+	alloc := func() int64 {
+		blk,ok,err := pa.AllocateBlocks(10,true)
+		if !ok || err!=nil { t.Fatal(ok,err) }
+		if err = pa.WriteBlock(blk,data); err!=nil { t.Fatal(err) }
+		return blk
+	}
+	a,b := alloc(),alloc()
+	used := pa.UsedBlocks()
+	if used!=24 { t.Fatal(used) }
+	
+	// A part of an allocation: its neighbours, that are still in use, stay allocated.
+	for _,e := range []filealloc.Extent{{Start: a+2, Len: 3},{Start: a, Len: 5},{Start: a+5, Len: 5}}{
+		if err = pa.FreeBlocks(e.Start,e.Len); !errors.Is(err,filealloc.REDZONE) { t.Fatal(e,err) }
+		if pa.UsedBlocks()!=used { t.Fatal(e,pa.UsedBlocks()) }
+	}
+	
+	// A damaged redzone is reported, and nothing is freed.
+	if err = pa.WriteBlock(b+10,data[:pa.BlockSize()]); err!=nil { t.Fatal(err) }
+	var rz *filealloc.RedzoneError
+	if err = pa.FreeBlocks(b,10); !errors.As(err,&rz) || rz.Blk!=b+10 { t.Fatal(err) }
+	if pa.UsedBlocks()!=used { t.Fatal(pa.UsedBlocks()) }
+	
+	// A whole allocation is freed with its redzones.
+	if err = pa.FreeBlocks(a,10); err!=nil { t.Fatal(err) }
+	if pa.UsedBlocks()!=used-12 { t.Fatal(pa.UsedBlocks()) }
+	
+	// Under quarantine, the check is done by FreeBlocks.
+	pa.QuarantineFlushes = 1
+	if err = pa.FreeBlocks(b,10); !errors.Is(err,filealloc.REDZONE) { t.Fatal(err) }
+	if n,_ := pa.QuarantineDepth(); n!=0 { t.Fatal(n) }
+}
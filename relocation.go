@@ -0,0 +1,49 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+// A move of an extent by MoveBlocks: the blocks of From are at To now.
+type Relocation struct{
+	From Extent
+	To   int64
+}
+
+type relocationWatcher struct{
+	fn      func(r Relocation) error
+	extents func() []Extent
+}
+
+func (w *relocationWatcher) relocated(from Extent, to int64) error { return w.fn(Relocation{from,to}) }
+
+func (w *relocationWatcher) movableExtents() []Extent {
+	if w.extents==nil { return nil }
+	return w.extents()
+}
+
+/*
+Calls fn with every move of an extent by MoveBlocks or the compactor, so that callers, that store
+block numbers, can follow it. fn is called after the data was copied and synced, and before the old
+blocks are freed: the move only completes, once fn returned nil. If fn fails, the move is undone and
+fails with its error; the watchers and HandleTables, that were told already, are told the reverse move.
+fn is called with the allocator locked, so it must not call the allocator.
+
+The compactor only moves the extents, that are followed: if extents is set, it returns the extents,
+that the caller stores, and the compactor may move them. Watching ends, when stop is called.
+*/
+func (pa *PageAllocator) WatchRelocations(fn func(r Relocation) error, extents func() []Extent) (stop func()) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	w := &relocationWatcher{fn,extents}
+	pa.relocators = append(pa.relocators,w)
+	return func() {
+		pa.mu.Lock()
+		defer pa.mu.Unlock()
+		for i,r := range pa.relocators {
+			if r!=relocator(w) { continue }
+			pa.relocators = append(pa.relocators[:i],pa.relocators[i+1:]...)
+			return
+		}
+	}
+}
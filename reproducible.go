@@ -0,0 +1,59 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"time"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// The identity, that Create records for a Reproducible file.
+type reproducibleIdentity struct{
+	id      FileID
+	created int64
+}
+
+/*
+Sets Reproducible. Create records id and created instead of a random FileID and the current time.
+A zero created time is recorded as zero.
+*/
+func WithReproducible(id FileID, created time.Time) Option {
+	return Option{"WithReproducible",optFormat,nil,func(pa *PageAllocator) {
+		pa.Reproducible = true
+		pa.repro.id = id
+		pa.repro.created = 0
+		if !created.IsZero() { pa.repro.created = created.UnixNano() }
+	}}
+}
+
+/*
+Prepares a Reproducible file for shipping: frees the quarantined extents and the pending
+frees, that no reader can observe, writes back all bitmaps, and zeroes the data of all free
+blocks (punching holes, where the Storage can). If the Storage is a Truncater, the file is
+sized to the end of the last chunk, so that data written past the allocated blocks doesn't
+show in its size. Call it last, before Close.
+*/
+func (pa *PageAllocator) Canonicalize() (err error) {
+	if err = pa.enter(); err!=nil { return }
+	err = pa.releaseQuarantine(true)
+	w,e := pa.flush()
+	if err==nil { err = e }
+	for i := range pa.allocators {
+		if err!=nil { break }
+		if pa.allocators[i].salvaged { continue }
+		bitmap.ForEachFreeRun(pa.bitmapOf(i),func(pos, lng int64) bool {
+			err = pa.zeroData(pa.MakeAddress(int64(i),pos),lng)
+			return err==nil
+		})
+	}
+	if t,ok := pa.Storage.(Truncater); ok && err==nil && len(pa.allocators)>0 {
+		var end int64
+		if end,err = pa.chunkEnd(int64(len(pa.allocators)-1)); err==nil { err = t.Truncate(end) }
+	}
+	if err==nil && !pa.DontFsync { err = pa.Sync() }
+	pa.leave(&err)
+	notify(w,err)
+	return
+}
@@ -0,0 +1,37 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+// Returns the number of blocks held back by ReservedFraction.
+func (pa *PageAllocator) reservedBlocks() int64 {
+	if pa.ReservedFraction<=0 { return 0 }
+	return int64(float64(int64(len(pa.allocators))*pa.RunSizeInBlocks())*pa.ReservedFraction)
+}
+
+// Reports, whether allocating lng blocks would eat into the reserve, which only privileged allocations may.
+func (pa *PageAllocator) intoReserve(lng int64) bool {
+	if pa.privileged || pa.ReservedFraction<=0 { return false }
+	total := int64(len(pa.allocators))*pa.RunSizeInBlocks()
+	return pa.usedBlocks.Load()+lng>total-pa.reservedBlocks()
+}
+
+/*
+Allocates contiguous blocks like AllocateBlocks, but may use the blocks held back by ReservedFraction.
+Meant for metadata, that must not fail, when the file is nearly full.
+*/
+func (pa *PageAllocator) AllocatePrivileged(lng int64, grow bool) (blk int64, ok bool, err error) {
+	if lng>pa.RunSizeInBlocks() { return 0,false,EXCEEDMAX }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	pa.privileged = true
+	defer func() { pa.privileged = false }()
+	return pa.allocate(lng,grow,false)
+}
+
+// Sets ReservedFraction.
+func WithReserve(fraction float64) Option {
+	if fraction<0 || fraction>=1 { return badOption("WithReserve","%g is not a fraction",fraction) }
+	return Option{"WithReserve",optLive,nil,func(pa *PageAllocator) { pa.ReservedFraction = fraction }}
+}
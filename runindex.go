@@ -0,0 +1,123 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+const defaultRunIndexSize = 8
+
+/*
+In-memory index of the largest free runs of a chunk.
+
+No free run, that is not listed in runs, is longer than floor.
+*/
+type runIndex struct{
+	valid bool
+	floor int64
+	runs  []bitmap.Extent
+}
+
+func (ri *runIndex) compute(bm []byte, k int) {
+	ri.runs = bitmap.LargestFreeRuns(bm,k)
+	ri.floor = 0
+	if len(ri.runs)==k { ri.floor = ri.runs[k-1].Len }
+	ri.valid = true
+}
+
+// Finds a position for lng blocks. If scan is true, the index can't tell and the bitmap must be scanned.
+func (ri *runIndex) find(lng int64) (pos int64, ok, scan bool) {
+	best := -1
+	for i,r := range ri.runs {
+		if r.Len>=lng { best = i }
+	}
+	if best>=0 { return ri.runs[best].Pos, true, false }
+	return 0, false, ri.floor>=lng
+}
+
+// Records the allocation of [pos,pos+lng) and keeps at most k runs.
+func (ri *runIndex) allocated(pos, lng int64, k int) {
+	for i,r := range ri.runs {
+		if r.Pos>pos || r.Pos+r.Len<pos+lng { continue }
+		ri.runs = append(ri.runs[:i],ri.runs[i+1:]...)
+		ri.insert(bitmap.Extent{Pos:r.Pos,Len:pos-r.Pos},k)
+		ri.insert(bitmap.Extent{Pos:pos+lng,Len:r.Pos+r.Len-pos-lng},k)
+		return
+	}
+}
+
+func (ri *runIndex) insert(e bitmap.Extent, k int) {
+	if e.Len<=0 { return }
+	i := len(ri.runs)
+	for i>0 && ri.runs[i-1].Len<e.Len { i-- }
+	ri.runs = append(ri.runs,bitmap.Extent{})
+	copy(ri.runs[i+1:],ri.runs[i:])
+	ri.runs[i] = e
+	if len(ri.runs)>k {
+		if l := ri.runs[k].Len; l>ri.floor { ri.floor = l }
+		ri.runs = ri.runs[:k]
+	}
+}
+
+/*
+On-disk record layout (little endian):
+	crc32 of the rest of the record
+	crc32 of the bitmap the record was derived from
+	number of runs
+	(padding)
+	floor
+	runs, as pairs of (pos,len)
+*/
+const runIndexHeader = 24
+
+func (pa *PageAllocator) runIndexSize() int {
+	if pa.RunIndexSize>0 { return pa.RunIndexSize }
+	return defaultRunIndexSize
+}
+func (pa *PageAllocator) runIndexRecord() int { return runIndexHeader + 16*pa.runIndexSize() }
+
+func (pa *PageAllocator) loadRunIndex(i int) {
+	a := &pa.allocators[i]
+	k := pa.runIndexSize()
+	rec := make([]byte,pa.runIndexRecord())
+	n,_ := pa.RunIndex.ReadAt(rec,int64(i)*int64(len(rec)))
+	a.index.valid = false
+	if n==len(rec) &&
+		binary.LittleEndian.Uint32(rec)==crc32.ChecksumIEEE(rec[4:]) &&
+		binary.LittleEndian.Uint32(rec[4:])==crc32.ChecksumIEEE(a.buffer) {
+		cnt := int(binary.LittleEndian.Uint32(rec[8:]))
+		if cnt<=k {
+			a.index.floor = int64(binary.LittleEndian.Uint64(rec[16:]))
+			a.index.runs = make([]bitmap.Extent,cnt)
+			for j := range a.index.runs {
+				o := runIndexHeader+16*j
+				a.index.runs[j].Pos = int64(binary.LittleEndian.Uint64(rec[o:]))
+				a.index.runs[j].Len = int64(binary.LittleEndian.Uint64(rec[o+8:]))
+			}
+			a.index.valid = true
+		}
+	}
+	if !a.index.valid { a.index.compute(a.buffer,k) }
+}
+
+func (pa *PageAllocator) storeRunIndex(i int) (err error) {
+	a := &pa.allocators[i]
+	if !a.index.valid { a.index.compute(a.buffer,pa.runIndexSize()) }
+	rec := make([]byte,pa.runIndexRecord())
+	binary.LittleEndian.PutUint32(rec[4:],crc32.ChecksumIEEE(a.buffer))
+	binary.LittleEndian.PutUint32(rec[8:],uint32(len(a.index.runs)))
+	binary.LittleEndian.PutUint64(rec[16:],uint64(a.index.floor))
+	for j,r := range a.index.runs {
+		o := runIndexHeader+16*j
+		binary.LittleEndian.PutUint64(rec[o:],uint64(r.Pos))
+		binary.LittleEndian.PutUint64(rec[o+8:],uint64(r.Len))
+	}
+	binary.LittleEndian.PutUint32(rec,crc32.ChecksumIEEE(rec[4:]))
+	_,err = pa.RunIndex.WriteAt(rec,int64(i)*int64(len(rec)))
+	return
+}
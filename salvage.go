@@ -0,0 +1,35 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The blocks belong to a chunk, whose bitmap was lost (see FormatConfig.Salvage), or that is sealed (see SealChunk).
+var READONLYCHUNK = errors.New("READ_ONLY_CHUNK")
+
+/*
+Reads the bitmap of a chunk in Salvage mode. If it can't be read completely, or one of its
+blocks fails the checksum of its trailer, the whole chunk is taken as used and made read-only:
+nothing in it is handed out or freed, and its bitmap is never written back.
+*/
+func (pa *PageAllocator) salvageBitmap(b *bitmapBuffer, chunk int64) {
+	torn,gen,err := pa.decodeBitmap(b.buffer,b.rawoff)
+	pa.recovery.TornBitmapBlocks = append(pa.recovery.TornBitmapBlocks,torn...)
+	if err==nil && len(torn)==0 {
+		b.gen = gen
+		return
+	}
+	for j := range b.buffer { b.buffer[j] = 0xff }
+	b.salvaged = true
+	pa.recovery.Salvaged = append(pa.recovery.Salvaged,chunk)
+}
+
+func (pa *PageAllocator) readOnlyChunk(c int64) error {
+	if pa.chunkState(int(c))==ChunkSealed { return fmt.Errorf("%w: chunk %d is sealed",READONLYCHUNK,c) }
+	return fmt.Errorf("%w: chunk %d",READONLYCHUNK,c)
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"sort"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// A free run of a chunk, that AllocateScatter may use.
+type scatterRun struct{
+	i int
+	bitmap.Extent
+}
+
+/*
+Allocates lng blocks, contiguous if the existing chunks allow it. Otherwise the blocks are gathered
+from at most maxFragments free runs, the largest first, with the last one fitting best. Only if
+that fails too, the file grows (if grow is set). maxFragments of 1 (or less) asks for contiguous blocks.
+
+Returns the extents in the order they were picked. lng may exceed RunSizeInBlocks, if the fragments hold it.
+Every extent is freed on its own, like one allocated by AllocateBlocks.
+*/
+func (pa *PageAllocator) AllocateScatter(lng int64, maxFragments int, grow bool) (l []Extent, err error) {
+	if maxFragments<1 { maxFragments = 1 }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	pa.opClass(OpAllocate)
+	switch {
+	case lng<0: return nil,&RangeError{0,lng,FaultLength}
+	case lng==0: return
+	}
+	if err = pa.checkLimits(lng); err!=nil { return }
+	pa.unlimited = true
+	defer func() { pa.unlimited = false }()
+	for {
+		if lng<=pa.RunSizeInBlocks() {
+			blk,ok,err := pa.allocate(lng,false,false)
+			if ok { return []Extent{{blk,lng}},err }
+			if !errors.Is(err,EXTHAUSTED) && err!=EXCEEDMAX { return nil,err }
+		}
+		if maxFragments>1 {
+			var ok bool
+			if l,ok,err = pa.scatter(lng,maxFragments); ok || err!=nil { return }
+		}
+		if !grow { return nil,pa.exhausted(lng) }
+		if err = pa.expired(); err!=nil { return }
+		if err = pa.appendAllocator(); err!=nil { return }
+	}
+}
+
+// Picks at most max free runs, that hold lng blocks, and allocates them.
+func (pa *PageAllocator) scatter(lng int64, max int) (l []Extent, ok bool, err error) {
+	rz := int64(0)
+	if pa.Redzones { rz = 2 }
+	if pa.intoReserve(lng) { return }
+	var runs []scatterRun
+	for i := range pa.allocators {
+		pa.op.chunks++
+		if !pa.chunkState(i).allocatable() { continue }
+		if a := &pa.allocators[i]; a.lazy && a.sum.largest<=rz { continue }
+		for _,e := range bitmap.LargestFreeRuns(pa.bitmapOf(i),max) {
+			if e.Len>rz && pa.accepts(i,e.Pos,e.Len) { runs = append(runs,scatterRun{i,e}) }
+		}
+	}
+	sort.SliceStable(runs,func(a, b int) bool { return runs[a].Len>runs[b].Len })
+	if len(runs)>max { runs = runs[:max] }
+	k,sum := 0,int64(0)
+	for k<len(runs) && sum<lng {
+		sum += runs[k].Len-rz
+		k++
+	}
+	if sum<lng { return }
+	// Let the last fragment take the smallest run, that holds the rest.
+	need := lng-(sum-(runs[k-1].Len-rz))
+	for j := len(runs)-1; j>=k; j-- {
+		if runs[j].Len-rz>=need {
+			runs[k-1],runs[j] = runs[j],runs[k-1]
+			break
+		}
+	}
+	
+	touched := make(map[int]bool)
+	committed := false
+	defer func() {
+		if err==nil || committed { return }
+		for _,e := range l { pa.freeRaw(e.Start-rz/2,e.Len+rz) }
+		l = nil
+	}()
+	for _,r := range runs[:k] {
+		take := r.Len-rz
+		if take>lng { take = lng }
+		lng -= take
+		bitmap.WriteInUse(pa.writable(r.i),r.Pos,take+rz)
+		pa.usedBlocks.Add(take+rz)
+		pa.markDirty(r.i,r.Pos,take+rz)
+		if a := &pa.allocators[r.i]; a.index.valid { a.index.allocated(r.Pos,take+rz,pa.runIndexSize()) }
+		touched[r.i] = true
+		blk := pa.MakeAddress(int64(r.i),r.Pos)
+		l = append(l,Extent{blk+rz/2,take})
+		if rz>0 {
+			if err = pa.poison(blk,take); err!=nil { return }
+		}
+		if pa.ZeroOnAllocate {
+			if err = pa.zeroData(blk+rz/2,take); err!=nil { return }
+		}
+	}
+	pa.checkWatermarks()
+	for _,e := range l {
+		if err = pa.audit(AuditAllocate,e.Start,e.Len,pa.owner); err!=nil { return }
+	}
+	for _,e := range l {
+		pa.traceAllocate(e.Len,false,e.Start,true)
+		pa.record(Op{Kind: OpKindAlloc, Extent: e})
+	}
+	committed = true
+	for i := range touched {
+		if e := pa.commitChunk(i,false); err==nil { err = e }
+	}
+	return l,true,err
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"fmt"
+	"io"
+	"time"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// Progress of an incremental scrub.
+type ScrubReport struct{
+	// Chunks checked by this call.
+	Checked int
+	
+	// The next chunk to check, and the number of completed passes over the file.
+	Cursor int64
+	Passes uint64
+	
+	// Problems found, at most one per chunk. They match INCONSISTENT or CONCURRENTMODIFICATION with errors.Is.
+	Problems []error
+	
+	// The chunks checked, in order.
+	Chunks []ChunkCheck
+}
+
+// The outcome of checking a chunk.
+type ChunkCheck struct{
+	Chunk int64
+	// The problem found, if any.
+	Problem error
+	// The bitmap was read back from the file, rather than checked in memory only.
+	Read bool
+}
+
+/*
+Checks the next n chunks: their bitmaps are read back from the file and compared with
+the allocator's, torn blocks are reported (see Trailers), and the free-run index is verified.
+Chunks with modifications, that are not written back yet, are only checked in memory.
+
+The cursor wraps around at the end of the file. It is stored in the superblock, if there is one,
+so that scrubbing resumes where it stopped after the file was reopened. It is written along with
+the next write-back of bitmaps, or by Flush() or Close(): after a crash, scrubbing may repeat some chunks.
+If ScrubRate is set, Scrub sleeps to read no more than ScrubRate bitmap bytes per second.
+The allocator is not locked between chunks.
+*/
+func (pa *PageAllocator) Scrub(n int) (r ScrubReport, err error) {
+	start := time.Now()
+	for r.Checked<n {
+		var c ChunkCheck
+		if err = pa.enter(); err!=nil { return }
+		i := pa.advanceScrub()
+		c.Chunk,c.Read = int64(i),pa.allocators[i].readBack()
+		c.Problem,err = pa.scrubChunk(i)
+		r.Cursor,r.Passes = int64(pa.super.scrubCursor),pa.super.scrubPasses
+		// Reconfigure may change it, once the allocator is unlocked.
+		rate := pa.ScrubRate
+		pa.leave(&err)
+		if err!=nil { return }
+		r.add(c)
+		if rate>0 {
+			due := time.Duration(int64(r.Checked)*int64(pa.rawBitmapBytes())*int64(time.Second)/rate)
+			if d := due-time.Since(start); d>0 { time.Sleep(d) }
+		}
+	}
+	return
+}
+
+func (r *ScrubReport) add(c ChunkCheck) {
+	r.Chunks = append(r.Chunks,c)
+	if c.Problem!=nil { r.Problems = append(r.Problems,c.Problem) }
+	r.Checked++
+}
+
+// Returns the chunk at the cursor and advances it.
+func (pa *PageAllocator) advanceScrub() int {
+	sb := &pa.super
+	if sb.scrubCursor>=uint64(len(pa.allocators)) {
+		sb.scrubCursor = 0
+		sb.scrubPasses++
+	}
+	sb.scrubCursor++
+	pa.deferSuperblock()
+	return int(sb.scrubCursor-1)
+}
+
+// Whether the scrubber compares the bitmap with the file. Salvaged bitmaps differ by design.
+func (a *bitmapBuffer) readBack() bool { return !a.dirty && !a.salvaged }
+
+func (pa *PageAllocator) scrubChunk(i int) (problem, err error) {
+	pa.touch(i)
+	a := &pa.allocators[i]
+	if a.salvaged { return }
+	if !a.dirty {
+		disk := make([]byte,pa.bitmapSize)
+		torn,gen,err := pa.decodeBitmap(disk,a.rawoff)
+		if problem,err = checkDisk(i,disk,a.buffer,torn,gen,a.gen,err); problem!=nil || err!=nil { return problem,err }
+	}
+	return verifyChunk(i,a.buffer,&a.index,pa.bitmapSize),nil
+}
+
+// Compares a bitmap read from the file, with the torn blocks and the generation found, with the allocator's.
+func checkDisk(i int, disk, mem []byte, torn []int64, gen, want uint64, rerr error) (problem, err error) {
+	if rerr!=nil && rerr!=io.EOF { return nil,rerr }
+	switch {
+	case len(torn)>0: return fmt.Errorf("%w: chunk %d: torn bitmap blocks %v",INCONSISTENT,i,torn),nil
+	case rerr!=nil: return fmt.Errorf("%w: chunk %d: bitmap is truncated",INCONSISTENT,i),nil
+	case gen!=want: return fmt.Errorf("%w: chunk %d: generation %d in the file, %d expected",CONCURRENTMODIFICATION,i,gen,want),nil
+	case !bitmap.Equal(disk,mem):
+		d := bitmap.Diff(disk,mem)
+		return fmt.Errorf("%w: chunk %d: bitmap differs from the file in %d ranges, first %d+%d",INCONSISTENT,i,len(d),d[0].Pos,d[0].Len),nil
+	}
+	return
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"sync"
+	"time"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// Shares ScrubRate among the workers of ScrubParallel.
+type scrubPacer struct{
+	mu    sync.Mutex
+	start time.Time
+	bytes int64
+	rate  int64
+}
+
+// Accounts n bytes to read and sleeps until they are due.
+func (p *scrubPacer) wait(n int64) {
+	if p.rate<=0 { return }
+	p.mu.Lock()
+	p.bytes += n
+	due := time.Duration(p.bytes*int64(time.Second)/p.rate)
+	p.mu.Unlock()
+	if d := due-time.Since(p.start); d>0 { time.Sleep(d) }
+}
+
+/*
+Checks the next n chunks like Scrub, with up to workers chunks at once. The bitmaps are read back
+from the file without locking the allocator; only a mismatch is checked again with it locked, to tell
+a concurrent write-back from a problem. ScrubRate bounds the reads of all workers together.
+
+The report lists the chunks in the order of the cursor.
+*/
+func (pa *PageAllocator) ScrubParallel(n, workers int) (r ScrubReport, err error) {
+	if workers<1 { workers = 1 }
+	if err = pa.enter(); err!=nil { return }
+	if n>len(pa.allocators) { n = len(pa.allocators) }
+	chunks := make([]int,n)
+	for k := range chunks { chunks[k] = pa.advanceScrub() }
+	r.Cursor,r.Passes = int64(pa.super.scrubCursor),pa.super.scrubPasses
+	rate := pa.ScrubRate
+	pa.leave(&err)
+	if err!=nil { return }
+	
+	checks := make([]ChunkCheck,n)
+	errs := make([]error,n)
+	pacer := &scrubPacer{start: time.Now(), rate: rate}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w<workers && w<n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range next { checks[k],errs[k] = pa.scrubConcurrently(chunks[k],pacer) }
+		}()
+	}
+	for k := range chunks { next <- k }
+	close(next)
+	wg.Wait()
+	for k,c := range checks {
+		if err = errs[k]; err!=nil { return }
+		r.add(c)
+	}
+	return
+}
+
+// Checks chunk i from a copy of its state, taken with the allocator locked.
+func (pa *PageAllocator) scrubConcurrently(i int, pacer *scrubPacer) (c ChunkCheck, err error) {
+	c.Chunk = int64(i)
+	if err = pa.enter(); err!=nil { return }
+	if i>=len(pa.allocators) {
+		// Removed in the meantime.
+		pa.leave(&err)
+		return
+	}
+	pa.touch(i)
+	a := &pa.allocators[i]
+	mem := append([]byte(nil),a.buffer...)
+	index := a.index
+	index.runs = append([]bitmap.Extent(nil),index.runs...)
+	gen,rawoff := a.gen,a.rawoff
+	c.Read = a.readBack()
+	pa.leave(&err)
+	if err!=nil { return }
+	
+	if c.Read {
+		pacer.wait(int64(pa.rawBitmapBytes()))
+		disk := make([]byte,pa.bitmapSize)
+		torn,dgen,rerr := pa.decodeBitmap(disk,rawoff)
+		if c.Problem,err = checkDisk(i,disk,mem,torn,dgen,gen,rerr); err!=nil { return }
+		if c.Problem!=nil {
+			if err = pa.enter(); err!=nil { return }
+			c.Problem = nil
+			if i<len(pa.allocators) {
+				c.Read = pa.allocators[i].readBack()
+				c.Problem,err = pa.scrubChunk(i)
+			}
+			pa.leave(&err)
+			return
+		}
+	}
+	c.Problem = verifyChunk(i,mem,&index,pa.bitmapSize)
+	return
+}
+
+/*
+Checks the chunks like Verify, with up to workers chunks at once, and reports on each of them.
+err is the problem of the lowest chunk, if any.
+*/
+func (s *Snapshot) VerifyParallel(workers int) (l []ChunkCheck, err error) {
+	if workers<1 { workers = 1 }
+	size := s.cfg.bitmapBytes()
+	l = make([]ChunkCheck,len(s.bitmaps))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w<workers && w<len(l); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next { l[i] = ChunkCheck{int64(i),verifyChunk(i,s.bitmaps[i],&s.indices[i],size),false} }
+		}()
+	}
+	for i := range l { next <- i }
+	close(next)
+	wg.Wait()
+	for _,c := range l {
+		if c.Problem!=nil { return l,c.Problem }
+	}
+	return
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"fmt"
+)
+
+/*
+Makes the chunk immutable, for regions of the file, that never change again: it takes neither
+allocations nor frees (they fail with READONLYCHUNK), and the search for free blocks skips it
+without scanning. Its bitmap is written back and dropped from memory (except in MultiProcess mode).
+Operations, that read the bitmaps, like Scrub or StateSnapshot, load it again, until the chunk is
+sealed once more.
+
+The chunk must have no frees pending in FreeDeferred or in quarantine. Sealing sets the ChunkSealed
+state and emits EventChunkState; in files with a superblock, it is persisted like the states
+of SetChunkStatus (and fails with STATESFULL likewise), and Open leaves the bitmap on disk.
+UnsealChunk reverses it.
+*/
+func (pa *PageAllocator) SealChunk(chunk int64) (err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if chunk<0 || int64(len(pa.allocators))<=chunk { return OUTOFBOUNDS }
+	i := int(chunk)
+	if pa.allocators[i].salvaged { return pa.readOnlyChunk(chunk) }
+	if pa.chunkState(i)==ChunkSealed {
+		pa.drop(i)
+		return
+	}
+	if err = pa.freesPending(chunk); err!=nil { return }
+	if a := &pa.allocators[i]; a.dirty || a.urgent {
+		if err = pa.flushChunk(i); err!=nil { return }
+	}
+	if err = pa.changeChunkState(i,ChunkSealed); err!=nil { return }
+	pa.drop(i)
+	return
+}
+
+// Makes a sealed chunk mutable again. Its bitmap is loaded, when the chunk is used.
+func (pa *PageAllocator) UnsealChunk(chunk int64) (err error) {
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	if chunk<0 || int64(len(pa.allocators))<=chunk { return OUTOFBOUNDS }
+	if pa.chunkState(int(chunk))!=ChunkSealed { return fmt.Errorf("%w: chunk %d is not sealed",BADOP,chunk) }
+	return pa.changeChunkState(int(chunk),ChunkHealthy)
+}
+
+// Fails with BADOP, if frees in the chunk wait in FreeDeferred or in quarantine.
+func (pa *PageAllocator) freesPending(chunk int64) error {
+	var l []Extent
+	for _,p := range pa.pending { l = append(l,p.Extent) }
+	for _,q := range pa.quarantined { l = append(l,q.Extent) }
+	for _,e := range l {
+		if c,_,_ := pa.BreakAddress(e.Start); c==chunk { return fmt.Errorf("%w: chunk %d has frees pending",BADOP,chunk) }
+	}
+	return nil
+}
+
+// Whether the chunk takes no frees: it is salvaged or sealed.
+func (pa *PageAllocator) readOnly(i int) bool {
+	return pa.allocators[i].salvaged || pa.chunkState(i)==ChunkSealed
+}
+
+/*
+Drops the bitmap of a chunk, that is written back, from memory. It is counted by its summary
+like a chunk, that Open left on disk, and touch loads it again.
+*/
+func (pa *PageAllocator) drop(i int) {
+	a := &pa.allocators[i]
+	// In MultiProcess mode, other processes may change it meanwhile.
+	if a.lazy || a.dirty || a.urgent || a.salvaged || pa.MultiProcess { return }
+	sum := pa.chunkSummary(i)
+	if a.mmapped { pa.mmapper.MemUnmap(a.buffer) }
+	*a = bitmapBuffer{rawoff: a.rawoff, lazy: true, sum: sum}
+	pa.lazy.chunks++
+}
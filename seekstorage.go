@@ -0,0 +1,59 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"io"
+	"sync"
+)
+
+/*
+Adapts a file handle, that only supports seeking I/O, to a Storage.
+A mutex serializes the calls, so that each one seeks and transfers undisturbed.
+
+Sync, Close and Truncate are passed on, if the handle has them. Otherwise Sync and Close
+do nothing, and Truncate fails with UNSUPPORTED.
+*/
+type SeekStorage struct{
+	mu  sync.Mutex
+	rws io.ReadWriteSeeker
+}
+
+func NewSeekStorage(rws io.ReadWriteSeeker) *SeekStorage { return &SeekStorage{rws: rws} }
+
+func (s *SeekStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _,err = s.rws.Seek(off,io.SeekStart); err!=nil { return }
+	n,err = io.ReadFull(s.rws,p)
+	if err==io.ErrUnexpectedEOF { err = io.EOF }
+	return
+}
+
+func (s *SeekStorage) WriteAt(p []byte, off int64) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _,err = s.rws.Seek(off,io.SeekStart); err!=nil { return }
+	return s.rws.Write(p)
+}
+
+func (s *SeekStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f,ok := s.rws.(interface{ Sync() error }); ok { return f.Sync() }
+	return nil
+}
+
+func (s *SeekStorage) Close() error {
+	if c,ok := s.rws.(io.Closer); ok { return c.Close() }
+	return nil
+}
+
+func (s *SeekStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t,ok := s.rws.(Truncater); ok { return t.Truncate(size) }
+	return UNSUPPORTED
+}
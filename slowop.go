@@ -0,0 +1,91 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"time"
+)
+
+// The kind of an operation, for latency tracking.
+type OpClass uint8
+
+const (
+	OpOther OpClass = iota
+	OpAllocate
+	OpFree
+	OpFlush
+	numOpClasses
+)
+
+var opClassNames = [...]string{"other","allocate","free","flush"}
+
+func (c OpClass) String() string {
+	if int(c)<len(opClassNames) { return opClassNames[c] }
+	return "unknown"
+}
+
+// An operation, that took SlowOpThreshold or longer. Passed to OnSlowOp.
+type SlowOp struct{
+	Class    OpClass
+	Start    time.Time
+	Duration time.Duration
+	// Chunks, whose bitmap or index was searched.
+	ChunksScanned int64
+	// Bitmap bytes written to the Storage, including the doublewrite area.
+	BytesWritten int64
+	// Chunks added to the file.
+	Grew int
+	Err  error
+}
+
+// Latency statistics of a class of operations, while SlowOpThreshold is set.
+type LatencyStats struct{
+	Count, Slow int64
+	Total, Max  time.Duration
+}
+
+// The operation in progress.
+type opStats struct{
+	class   OpClass
+	start   time.Time
+	chunks  int64
+	written int64
+	grew    int
+}
+
+// Classifies the operation in progress, unless it already is.
+func (pa *PageAllocator) opClass(c OpClass) {
+	if pa.op.class==OpOther { pa.op.class = c }
+}
+
+// Returns the latency statistics of a class of operations.
+func (pa *PageAllocator) Latency(c OpClass) LatencyStats {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if c>=numOpClasses { return LatencyStats{} }
+	return pa.latency[c]
+}
+
+func (pa *PageAllocator) startOp() {
+	if pa.SlowOpThreshold<=0 { return }
+	pa.op = opStats{start: time.Now()}
+}
+
+// Accounts the operation in progress. Returns a report, if it was slow and OnSlowOp is set.
+func (pa *PageAllocator) endOp(err error) (r SlowOp, slow bool) {
+	if pa.SlowOpThreshold<=0 || pa.op.start.IsZero() { return }
+	d := time.Since(pa.op.start)
+	l := &pa.latency[pa.op.class]
+	l.Count++
+	l.Total += d
+	if d>l.Max { l.Max = d }
+	if d>=pa.SlowOpThreshold {
+		l.Slow++
+		r = SlowOp{pa.op.class,pa.op.start,d,pa.op.chunks,pa.op.written,pa.op.grew,err}
+		slow = pa.OnSlowOp!=nil
+	}
+	pa.op = opStats{}
+	return
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+// The allocator's internal state contradicts itself.
+var INCONSISTENT = errors.New("INCONSISTENT")
+
+// Block usage statistics.
+type Stats struct{
+	Chunks int
+	TotalBlocks, UsedBlocks, FreeBlocks int64
+	LargestFreeRun int64
+	// Over ForecastWindow. Zero in the Stats of a Snapshot.
+	Forecast Forecast
+	
+	// Blocks held back by ReservedFraction, and the free blocks, that ordinary allocations may use.
+	// In the Stats of a Snapshot, nothing is reserved.
+	ReservedBlocks, AvailableBlocks int64
+	
+	// Chunks with mmapped bitmaps, and their bytes. Zero in the Stats of a Snapshot.
+	MmappedChunks int
+	MmappedBytes int64
+	// Of the mmapped chunks, those in persistent memory (see PersistentMapper).
+	PersistentChunks int
+	// Heap-backed chunks, although the allocator mmaps bitmaps: because mmap failed,
+	// because of MaxMmapBytes, or by SetChunkMmap.
+	MmapFailed, MmapOverBudget, MmapOptedOut int
+	
+	// The size limits (see SoftLimitBlocks), and the allocations, that exceeded them.
+	// Zero in the Stats of a Snapshot.
+	SoftLimitBlocks, HardLimitBlocks int64
+	SoftLimitHits, HardLimitHits int64
+	
+	// Chunks, whose bitmaps are not loaded yet: they are counted by the Summary.
+	// Zero in the Stats of a Snapshot.
+	LazyChunks int
+	
+	// Nil, unless HeatmapWindow is set. Nil in the Stats of a Snapshot.
+	Heatmap *Heatmap `json:",omitempty"`
+}
+
+/*
+An immutable view of the allocation state, as of the time it was taken.
+Unlike the allocator itself, a Snapshot is safe for concurrent use.
+*/
+type Snapshot struct{
+	cfg     FormatConfig
+	bitmaps [][]byte
+	indices []runIndex
+}
+
+/*
+Takes a snapshot of the allocation state.
+
+Heap-backed bitmaps are shared copy-on-write: the allocator copies them before it modifies them the next time.
+Mmapped bitmaps are copied immediately.
+*/
+func (pa *PageAllocator) StateSnapshot() *Snapshot {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	s := &Snapshot{
+		cfg: pa.FormatConfig,
+		bitmaps: make([][]byte,len(pa.allocators)),
+		indices: make([]runIndex,len(pa.allocators)),
+	}
+	pa.loadAll()
+	for i := range pa.allocators {
+		a := &pa.allocators[i]
+		if a.mmapped {
+			s.bitmaps[i] = append([]byte(nil),a.buffer...)
+		} else {
+			s.bitmaps[i] = a.buffer
+			a.shared = true
+		}
+		s.indices[i] = a.index
+		s.indices[i].runs = append([]bitmap.Extent(nil),a.index.runs...)
+	}
+	return s
+}
+
+// Returns the chunk's bitmap for modification, un-sharing it from snapshots.
+func (pa *PageAllocator) writable(i int) []byte {
+	pa.touch(i)
+	a := &pa.allocators[i]
+	if a.shared {
+		a.buffer = append([]byte(nil),a.buffer...)
+		a.shared = false
+	}
+	return a.buffer
+}
+
+func computeStats(bitmaps [][]byte) (st Stats) {
+	st.Chunks = len(bitmaps)
+	for _,bm := range bitmaps {
+		st.TotalBlocks += int64(len(bm))<<3
+		bitmap.ForEachFreeRun(bm,func(pos, lng int64) bool {
+			st.FreeBlocks += lng
+			if lng>st.LargestFreeRun { st.LargestFreeRun = lng }
+			return true
+		})
+	}
+	st.UsedBlocks = st.TotalBlocks-st.FreeBlocks
+	st.AvailableBlocks = st.FreeBlocks
+	return
+}
+
+// Returns the block usage statistics.
+func (pa *PageAllocator) Stats() Stats {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	st := pa.stats()
+	st.Forecast = pa.forecast(pa.forecastWindow())
+	return st
+}
+
+func (pa *PageAllocator) stats() Stats {
+	bitmaps := make([][]byte,0,len(pa.allocators))
+	for i := range pa.allocators {
+		if !pa.allocators[i].lazy { bitmaps = append(bitmaps,pa.allocators[i].buffer) }
+	}
+	st := computeStats(bitmaps)
+	pa.lazyStats(&st)
+	pa.mmapStats(&st)
+	st.ReservedBlocks = pa.reservedBlocks()
+	pa.limitStats(&st)
+	st.Heatmap = pa.heatmap()
+	if st.AvailableBlocks = st.FreeBlocks-st.ReservedBlocks; st.AvailableBlocks<0 { st.AvailableBlocks = 0 }
+	return st
+}
+
+// Returns the block usage statistics of the snapshot.
+func (s *Snapshot) Stats() Stats { return computeStats(s.bitmaps) }
+
+// Calls fn for every run of allocated blocks, in ascending order. Stops, if fn returns false.
+func (s *Snapshot) Iterate(fn func(e Extent) bool) {
+	for i,bm := range s.bitmaps {
+		cont := true
+		bitmap.ForEachUsedRun(bm,func(pos, lng int64) bool {
+			cont = fn(Extent{s.cfg.MakeAddress(int64(i),pos),lng})
+			return cont
+		})
+		if !cont { return }
+	}
+}
+
+/*
+Checks the snapshot for internal consistency: the size of each bitmap
+and, where present, the free-run index against its bitmap.
+*/
+func (s *Snapshot) Verify() error {
+	size := s.cfg.bitmapBytes()
+	for i,bm := range s.bitmaps {
+		if err := verifyChunk(i,bm,&s.indices[i],size); err!=nil { return err }
+	}
+	return nil
+}
+
+func verifyChunk(i int, bm []byte, ri *runIndex, size int) error {
+	if len(bm)!=size { return fmt.Errorf("%w: chunk %d: bitmap is %d bytes, want %d",INCONSISTENT,i,len(bm),size) }
+	if !ri.valid { return nil }
+	for _,r := range ri.runs {
+		if r.Pos<0 || r.Pos+r.Len>int64(len(bm))<<3 || !isFree(bm,r.Pos,r.Len) {
+			return fmt.Errorf("%w: chunk %d: indexed run %d+%d is not free",INCONSISTENT,i,r.Pos,r.Len)
+		}
+	}
+	var bad error
+	bitmap.ForEachFreeRun(bm,func(pos, lng int64) bool {
+		if lng<=ri.floor { return true }
+		for _,r := range ri.runs {
+			if r.Pos>=pos && r.Pos+r.Len<=pos+lng { return true }
+		}
+		bad = fmt.Errorf("%w: chunk %d: free run %d+%d is missing from the index",INCONSISTENT,i,pos,lng)
+		return false
+	})
+	return bad
+}
+
+func isFree(bm []byte, pos, lng int64) bool {
+	for j := pos; j<pos+lng; j++ {
+		if bm[j>>3]&byte(0x80>>uint(j&7))!=0 { return false }
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+/*
+Returns a SHA-256 hash of the allocation state: the number of chunks and their bitmaps.
+Two allocators with the same format and the same allocated blocks have the same hash.
+After Open with a Summary, the hash recorded there is returned, until a bitmap changes.
+*/
+func (pa *PageAllocator) StateHash() (sum [32]byte) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if pa.summaryHash() { return pa.lazy.hash }
+	pa.loadAll()
+	return pa.stateHash()
+}
+
+func (pa *PageAllocator) stateHash() (sum [32]byte) {
+	h := sha256.New()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:],uint64(len(pa.allocators)))
+	h.Write(b[:])
+	for i := range pa.allocators { h.Write(pa.allocators[i].buffer) }
+	h.Sum(sum[:0])
+	return
+}
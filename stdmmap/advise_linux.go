@@ -0,0 +1,15 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build linux
+
+package stdmmap
+
+import "syscall"
+
+// Issues madvise(MADV_WILLNEED). Implements filealloc.MemAdviser.
+func (f *file) MemWillNeed(mm []byte) error {
+	if len(mm)==0 { return nil }
+	return syscall.Madvise(mm,syscall.MADV_WILLNEED)
+}
@@ -0,0 +1,12 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !linux
+
+package stdmmap
+
+import "github.com/byte-mug/filealloc"
+
+// Paging hints are not supported on this platform.
+func (f *file) MemWillNeed(mm []byte) error { return filealloc.UNSUPPORTED }
@@ -0,0 +1,14 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !(linux || darwin || freebsd || openbsd || dragonfly || windows)
+
+package stdmmap
+
+import "github.com/blevesearch/mmap-go"
+
+// No ranged msync: flush the whole mapping.
+func (f *file) flushRange(mm []byte, addr, lng uintptr) error {
+	return mmap.MMap(mm).Flush()
+}
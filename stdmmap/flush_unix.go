@@ -0,0 +1,15 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build linux || darwin || freebsd || openbsd || dragonfly
+
+package stdmmap
+
+import "syscall"
+
+func (f *file) flushRange(mm []byte, addr, lng uintptr) error {
+	_,_,e := syscall.Syscall(syscall.SYS_MSYNC,addr,lng,syscall.MS_SYNC)
+	if e!=0 { return e }
+	return nil
+}
@@ -0,0 +1,13 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package stdmmap
+
+import "syscall"
+
+// Like mmap-go's Flush: write the view back, then flush the file's buffers.
+func (f *file) flushRange(mm []byte, addr, lng uintptr) error {
+	if err := syscall.FlushViewOfFile(addr,lng); err!=nil { return err }
+	return syscall.FlushFileBuffers(syscall.Handle(f.f.Fd()))
+}
@@ -7,6 +7,7 @@ package stdmmap
 
 import (
 	"os"
+	"unsafe"
 	"github.com/blevesearch/mmap-go"
 	"github.com/byte-mug/filealloc"
 )
@@ -15,6 +16,7 @@ import (
 
 func WrapOsFile(s filealloc.Storage) filealloc.MemMapper {
 	fobj,_ := s.(*os.File)
+	if w,ok := s.(interface{ OsFile() *os.File }); ok { fobj = w.OsFile() }
 	if fobj==nil { return nil }
 	return &file{fobj}
 }
@@ -32,6 +34,17 @@ func (f *file) FlushMap(mm []byte) error {
 	buf := mmap.MMap(mm)
 	return buf.Flush()
 }
+
+// Implements filealloc.RangeFlusher. The range is widened to page boundaries,
+// which lie inside the mapping, as mappings start on one.
+func (f *file) FlushRange(mm []byte, off, lng int) error {
+	if lng<=0 { return nil }
+	_ = mm[off:off+lng]
+	addr := uintptr(unsafe.Pointer(&mm[off]))
+	base := addr&^uintptr(os.Getpagesize()-1)
+	return f.flushRange(mm,base,addr+uintptr(lng)-base)
+}
+
 func (f *file) MemUnmap(mm []byte) {
 	buf := mmap.MMap(mm)
 	buf.Unmap()
@@ -0,0 +1,181 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+const summaryMagic = "FASUMRY1"
+
+/*
+Layout of the summary (little endian):
+	0  magic
+	8  file id
+	24 change counter of the superblock, that was written clean after the summary
+	32 number of chunks
+	40 used blocks
+	48 1, if the state hash follows
+	56 StateHash
+	88 for each chunk: its free blocks and its largest free run
+	   crc32 of the preceding bytes
+*/
+const (
+	summaryHeader = 88
+	summaryRecord = 16
+)
+
+// What the summary tells about a chunk, whose bitmap is not loaded.
+type chunkSummary struct{
+	free, largest int64
+}
+
+type lazyState struct{
+	// Read by Open, for Init.
+	pending []chunkSummary
+	// Chunks, whose bitmaps are not loaded.
+	chunks int
+	// The StateHash of the summary, while no bitmap changed, and the number of chunks it covers.
+	hash      [32]byte
+	hashValid bool
+	hashN     int
+}
+
+// Sets Summary.
+func WithSummary(s Storage) Option {
+	return Option{"WithSummary",optOpen,nil,func(pa *PageAllocator) { pa.Summary = s }}
+}
+
+/*
+Reads the summary, if it belongs to the superblock, and checks it against the file size:
+the last chunk must be complete and be followed by none. Called by Open for a clean file.
+*/
+func (pa *PageAllocator) readSummary() bool {
+	if pa.Summary==nil || pa.MultiProcess || pa.Salvage { return false }
+	hdr := make([]byte,summaryHeader)
+	if n,_ := pa.Summary.ReadAt(hdr,0); n<len(hdr) || string(hdr[:8])!=summaryMagic { return false }
+	if !bytes.Equal(hdr[8:24],pa.super.id[:]) || binary.LittleEndian.Uint64(hdr[24:])!=pa.super.changes { return false }
+	n := binary.LittleEndian.Uint64(hdr[32:])
+	if n==0 || n>uint64(1)<<32 { return false }
+	b := make([]byte,summaryHeader+int(n)*summaryRecord+4)
+	if k,_ := pa.Summary.ReadAt(b,0); k<len(b) { return false }
+	if binary.LittleEndian.Uint32(b[len(b)-4:])!=crc32.ChecksumIEEE(b[:len(b)-4]) { return false }
+	
+	sums := make([]chunkSummary,n)
+	run,used := pa.RunSizeInBlocks(),int64(0)
+	for i := range sums {
+		o := summaryHeader+i*summaryRecord
+		s := chunkSummary{int64(binary.LittleEndian.Uint64(b[o:])),int64(binary.LittleEndian.Uint64(b[o+8:]))}
+		if s.free<0 || s.free>run || s.largest<0 || s.largest>s.free { return false }
+		sums[i],used = s,used+run-s.free
+	}
+	if used!=int64(binary.LittleEndian.Uint64(b[40:])) { return false }
+	
+	raw := make([]byte,pa.rawBitmapBytes())
+	if k,_ := pa.ReadAt(raw,pa.MakeAddress(int64(n-1),-int64(pa.BitmapBlocks))<<pa.BlockSizeLog); k<len(raw) { return false }
+	if k,_ := pa.ReadAt(raw[:1],pa.MakeAddress(int64(n),-int64(pa.BitmapBlocks))<<pa.BlockSizeLog); k>0 { return false }
+	
+	pa.lazy = lazyState{pending: sums}
+	if b[48]==1 {
+		copy(pa.lazy.hash[:],b[56:88])
+		pa.lazy.hashValid,pa.lazy.hashN = true,len(sums)
+	}
+	return true
+}
+
+/*
+Writes the summary for the change counter of the superblock, that Close is about to write,
+and syncs it. The state hash is recorded, if it is known without loading the bitmaps.
+*/
+func (pa *PageAllocator) writeSummary() (err error) {
+	b := make([]byte,summaryHeader+len(pa.allocators)*summaryRecord+4)
+	copy(b,summaryMagic)
+	copy(b[8:24],pa.super.id[:])
+	binary.LittleEndian.PutUint64(b[24:],pa.super.changes)
+	binary.LittleEndian.PutUint64(b[32:],uint64(len(pa.allocators)))
+	run,used := pa.RunSizeInBlocks(),int64(0)
+	for i := range pa.allocators {
+		s := pa.chunkSummary(i)
+		o := summaryHeader+i*summaryRecord
+		binary.LittleEndian.PutUint64(b[o:],uint64(s.free))
+		binary.LittleEndian.PutUint64(b[o+8:],uint64(s.largest))
+		used += run-s.free
+	}
+	binary.LittleEndian.PutUint64(b[40:],uint64(used))
+	switch {
+	case pa.summaryHash():
+		b[48] = 1
+		copy(b[56:88],pa.lazy.hash[:])
+	case pa.lazy.chunks==0:
+		b[48] = 1
+		h := pa.stateHash()
+		copy(b[56:88],h[:])
+	}
+	binary.LittleEndian.PutUint32(b[len(b)-4:],crc32.ChecksumIEEE(b[:len(b)-4]))
+	if _,err = pa.Summary.WriteAt(b,0); err!=nil { return }
+	return pa.Summary.Sync()
+}
+
+func (pa *PageAllocator) chunkSummary(i int) (s chunkSummary) {
+	a := &pa.allocators[i]
+	if a.lazy { return a.sum }
+	bitmap.ForEachFreeRun(a.buffer,func(pos, lng int64) bool {
+		s.free += lng
+		if lng>s.largest { s.largest = lng }
+		return true
+	})
+	return
+}
+
+// Reports, whether the StateHash of the summary still holds.
+func (pa *PageAllocator) summaryHash() bool {
+	return pa.lazy.hashValid && pa.lazy.hashN==len(pa.allocators)
+}
+
+// Loads the bitmap of a chunk, that Open left to the summary.
+func (pa *PageAllocator) touch(i int) {
+	a := &pa.allocators[i]
+	if !a.lazy { return }
+	expect := pa.RunSizeInBlocks()-a.sum.free
+	*a = pa.getAllocator(a.rawoff>>pa.BlockSizeLog)
+	pa.lazy.chunks--
+	if pa.RunIndex!=nil { pa.loadRunIndex(i) }
+	// Should the bitmap disagree with the summary, it wins.
+	if used := bitmap.CountInUse(a.buffer,0,int64(len(a.buffer))<<3); used!=expect {
+		pa.usedBlocks.Add(used-expect)
+		pa.lazy.hashValid = false
+	}
+}
+
+// Returns the chunk's bitmap, loading it first, if need be.
+func (pa *PageAllocator) bitmapOf(i int) []byte {
+	pa.touch(i)
+	return pa.allocators[i].buffer
+}
+
+// Loads the bitmaps of all chunks.
+func (pa *PageAllocator) loadAll() {
+	for i := 0; pa.lazy.chunks>0 && i<len(pa.allocators); i++ { pa.touch(i) }
+}
+
+// Adds the chunks, whose bitmaps are not loaded, to the Stats.
+func (pa *PageAllocator) lazyStats(st *Stats) {
+	st.LazyChunks = pa.lazy.chunks
+	if pa.lazy.chunks==0 { return }
+	run := pa.RunSizeInBlocks()
+	for i := range pa.allocators {
+		a := &pa.allocators[i]
+		if !a.lazy { continue }
+		st.Chunks++
+		st.TotalBlocks += run
+		st.FreeBlocks += a.sum.free
+		if a.sum.largest>st.LargestFreeRun { st.LargestFreeRun = a.sum.largest }
+	}
+	st.UsedBlocks = st.TotalBlocks-st.FreeBlocks
+	st.AvailableBlocks = st.FreeBlocks
+}
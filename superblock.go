@@ -0,0 +1,188 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"github.com/byte-mug/filealloc/bitmap"
+)
+
+/*
+The superblock occupies the first 512 bytes of the first prefix block (little endian):
+	0   magic
+	8   version
+	12  BlockSizeLog, BitmapBlocks, PrefixBlocks, BitmapEncoding
+	16  feature flags
+	20  state flags
+	24  change counter
+	32  scrub cursor: the next chunk to scrub
+	40  completed scrub passes
+	48  file id
+	64  creation time, in unix nanoseconds
+	72  number of chunks, that are not healthy
+	80  their index and ChunkState, 8 bytes each (see SetChunkStatus)
+	508 checksum of the preceding bytes, CRC32 for files without a Checksum
+*/
+const superblockSize = 512
+
+const superblockVersion = 1
+
+const (
+	chunkStatesOff = 80
+	maxChunkStates = (superblockSize-4-chunkStatesOff)/8
+)
+
+var superblockMagic = [8]byte{'F','I','L','E','A','L','O','C'}
+
+// Format features.
+const (
+	featureDoublewrite uint32 = 1<<iota
+	featureTrailers
+	featureBackup
+	
+	// The Checksum, in 4 bits.
+	featureChecksumShift = 8
+	featureChecksumMask uint32 = 0xf<<featureChecksumShift
+)
+
+type superblock struct{
+	blockSizeLog, bitmapBlocks, prefixBlocks uint8
+	encoding uint8
+	features uint32
+	flags    uint32
+	changes  uint64
+	scrubCursor, scrubPasses uint64
+	id       FileID
+	created  int64
+	states   []chunkState
+}
+
+func (sb *superblock) encode() []byte {
+	b := make([]byte,superblockSize)
+	copy(b,superblockMagic[:])
+	binary.LittleEndian.PutUint32(b[8:],superblockVersion)
+	b[12] = sb.blockSizeLog
+	b[13] = sb.bitmapBlocks
+	b[14] = sb.prefixBlocks
+	b[15] = sb.encoding
+	binary.LittleEndian.PutUint32(b[16:],sb.features)
+	binary.LittleEndian.PutUint32(b[20:],sb.flags)
+	binary.LittleEndian.PutUint64(b[24:],sb.changes)
+	binary.LittleEndian.PutUint64(b[32:],sb.scrubCursor)
+	binary.LittleEndian.PutUint64(b[40:],sb.scrubPasses)
+	copy(b[48:],sb.id[:])
+	binary.LittleEndian.PutUint64(b[64:],uint64(sb.created))
+	binary.LittleEndian.PutUint32(b[72:],uint32(len(sb.states)))
+	for i,s := range sb.states {
+		binary.LittleEndian.PutUint32(b[chunkStatesOff+8*i:],s.chunk)
+		b[chunkStatesOff+8*i+4] = uint8(s.state)
+	}
+	binary.LittleEndian.PutUint32(b[superblockSize-4:],sb.checksum().Sum(b[:superblockSize-4]))
+	return b
+}
+
+func (sb *superblock) decode(b []byte) bool {
+	if len(b)<superblockSize { return false }
+	if string(b[:8])!=string(superblockMagic[:]) { return false }
+	sb.features = binary.LittleEndian.Uint32(b[16:])
+	if binary.LittleEndian.Uint32(b[superblockSize-4:])!=sb.checksum().Sum(b[:superblockSize-4]) { return false }
+	if binary.LittleEndian.Uint32(b[8:])!=superblockVersion { return false }
+	sb.blockSizeLog = b[12]
+	sb.bitmapBlocks = b[13]
+	sb.prefixBlocks = b[14]
+	sb.encoding = b[15]
+	sb.flags = binary.LittleEndian.Uint32(b[20:])
+	sb.changes = binary.LittleEndian.Uint64(b[24:])
+	sb.scrubCursor = binary.LittleEndian.Uint64(b[32:])
+	sb.scrubPasses = binary.LittleEndian.Uint64(b[40:])
+	copy(sb.id[:],b[48:])
+	sb.created = int64(binary.LittleEndian.Uint64(b[64:]))
+	n := binary.LittleEndian.Uint32(b[72:])
+	if n>maxChunkStates { return false }
+	sb.states = make([]chunkState,n)
+	for i := range sb.states {
+		sb.states[i] = chunkState{binary.LittleEndian.Uint32(b[chunkStatesOff+8*i:]),ChunkState(b[chunkStatesOff+8*i+4])}
+	}
+	return true
+}
+
+// Sets the format fields of cfg to those recorded in the superblock.
+func (sb *superblock) format(cfg *FormatConfig) {
+	cfg.BlockSizeLog = sb.blockSizeLog
+	cfg.BitmapBlocks = sb.bitmapBlocks
+	cfg.PrefixBlocks = sb.prefixBlocks
+	cfg.Doublewrite = sb.features&featureDoublewrite!=0
+	cfg.Trailers = sb.features&featureTrailers!=0
+	cfg.SuperblockBackup = sb.features&featureBackup!=0
+	cfg.Checksum = Checksum((sb.features&featureChecksumMask)>>featureChecksumShift)
+	cfg.BitmapEncoding = bitmap.Encoding(sb.encoding)
+}
+
+func (f *FormatConfig) features() (ft uint32) {
+	if f.Doublewrite { ft |= featureDoublewrite }
+	if f.Trailers { ft |= featureTrailers }
+	if f.SuperblockBackup { ft |= featureBackup }
+	ft |= uint32(f.Checksum)<<featureChecksumShift
+	return
+}
+
+// The checksum of the superblock itself. It covers the feature word, so an unknown algorithm fails it.
+func (sb *superblock) checksum() Checksum {
+	return Checksum((sb.features&featureChecksumMask)>>featureChecksumShift).super()
+}
+
+// Number of prefix blocks, the allocator itself uses for its metadata.
+func (f *FormatConfig) metaBlocks() int {
+	n := 1
+	if f.SuperblockBackup { n++ }
+	if f.Doublewrite { n += 1+int(f.BitmapBlocks) }
+	return n
+}
+
+/*
+With SuperblockBackup, a copy of the superblock occupies the second prefix block. It is written
+after the first one is synced, so that a torn write leaves one of them intact.
+Open() falls back to the copy, if the first one is broken, and finds it without knowing the block
+size: the copy at 1<<n bytes must have a BlockSizeLog of n.
+*/
+func (pa *PageAllocator) writeSuperblock() (err error) {
+	b := pa.super.encode()
+	_,err = pa.WriteAt(b,0)
+	if err==nil { err = pa.Sync() }
+	if err==nil { pa.superPending = false }
+	if err!=nil || pa.super.features&featureBackup==0 { return }
+	_,err = pa.WriteAt(b,int64(1)<<pa.super.blockSizeLog)
+	if err==nil { err = pa.Sync() }
+	return
+}
+
+/*
+Records an update of the superblock, that may wait: the scrub cursor, for instance. Rather than
+written on its own, the superblock is written after the bitmaps by the next write-back, so that
+it never gets ahead of them, and repeated updates cost one write. Under SyncGroupCommit, that
+is the next group commit; Flush() and Close() write it in any case. Updates, that must be durable
+right away, like the chunk states, call writeSuperblock, which takes the waiting ones along.
+*/
+func (pa *PageAllocator) deferSuperblock() {
+	if !pa.hasSuper { return }
+	pa.superPending = true
+	if pa.policy()==SyncGroupCommit { pa.scheduleCommit() }
+}
+
+// Reads the superblock, or its copy, if the superblock is broken.
+func (pa *PageAllocator) loadSuperblock(sb *superblock) (backup, ok bool) {
+	buf := make([]byte,superblockSize)
+	pa.ReadAt(buf,0)
+	if sb.decode(buf) { return false,true }
+	for log := minBlockSizeLog; log<=maxBlockSizeLog; log++ {
+		if n,_ := pa.ReadAt(buf,int64(1)<<log); n<len(buf) { break }
+		var c superblock
+		if c.decode(buf) && int(c.blockSizeLog)==log && c.features&featureBackup!=0 {
+			*sb = c
+			return true,true
+		}
+	}
+	return
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import "time"
+
+// Tag of extents allocated with AllocateTemp.
+const TempOwner OwnerTag = OwnerTag('t'<<56|'e'<<48|'m'<<40|'p'<<32)
+
+// Number of expired extents SweepExpired frees per write-back.
+const sweepBatch = 64
+
+/*
+Allocates a series of contiguous blocks, like AllocateBlocks, that expire after ttl.
+The expiry is recorded in the OwnerTable. Expired extents are freed by SweepExpired,
+so extents whose owner crashed don't leak.
+*/
+func (pa *PageAllocator) AllocateTemp(lng int64, ttl time.Duration) (blk int64, ok bool, err error) {
+	return pa.allocateRecorded(lng,true,ownerRecord{Tag: TempOwner, Expires: time.Now().Add(ttl).UnixNano()})
+}
+
+// Extends the expiry of the temporary extent starting at blk to ttl from now.
+func (pa *PageAllocator) RenewTemp(blk int64, ttl time.Duration) (err error) {
+	if pa.OwnerTable==nil { return NOOWNERTABLE }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	c,pos,ok := pa.BreakAddress(blk)
+	if !ok || c>=int64(len(pa.allocators)) || pos>=pa.RunSizeInBlocks() { return OUTOFBOUNDS }
+	start,r,ok,err := pa.findOwner(c,pos)
+	if err!=nil { return }
+	if !ok || start!=pos || r.Expires==0 { return NOTOWNED }
+	r.Expires = time.Now().Add(ttl).UnixNano()
+	return pa.writeOwner(c,pos,r)
+}
+
+/*
+Frees all extents, whose expiry is before now. Returns the number of freed extents.
+
+The OwnerTable is scanned in full; the frees are written back in batches.
+Leased extents (see Lease) are left to a later sweep, after the lease ended.
+*/
+func (pa *PageAllocator) SweepExpired(now time.Time) (n int, err error) {
+	if pa.OwnerTable==nil { return 0,NOOWNERTABLE }
+	if err = pa.enter(); err!=nil { return }
+	defer pa.leave(&err)
+	t := now.UnixNano()
+	var expired []Extent
+	err = pa.forEachOwner(func(c, pos int64, r ownerRecord) bool {
+		if r.Expires!=0 && r.Expires<t { expired = append(expired,Extent{pa.MakeAddress(c,pos),r.Len}) }
+		return true
+	})
+	if err!=nil { return }
+	k := 0
+	for _,e := range expired {
+		if pa.checkLeases(e.Start,e.Len)==nil { expired[k],k = e,k+1 }
+	}
+	expired = expired[:k]
+	var dirty []int
+	for _,e := range expired {
+		i,ok,e2 := pa.applyFree(e.Start,e.Len)
+		if e2!=nil { return n,e2 }
+		if ok && (len(dirty)==0 || dirty[len(dirty)-1]!=i) { dirty = append(dirty,i) }
+		n++
+		if n%sweepBatch==0 || n==len(expired) {
+			for _,i := range dirty {
+				if err = pa.commitChunk(i,false); err!=nil { return }
+			}
+			dirty = dirty[:0]
+		}
+	}
+	return
+}
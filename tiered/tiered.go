@@ -0,0 +1,259 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+/*
+Chunk-level tiering between a fast and a slow Storage, like NVMe and HDD.
+
+A Storage places each chunk of an allocator file, its bitmap and its data blocks, on one of the
+tiers, and routes reads and writes accordingly. The allocator sees one file: the addresses don't
+change, when a chunk moves. The prefix blocks stay on the fast tier; new chunks start there.
+Rebalance moves the chunks, that the Heatmap of the allocator shows busy, to the fast tier and the
+others to the slow one.
+
+Both tiers hold the chunks at the same offsets, as sparse files. Which tier holds a chunk, is
+recorded in an append-only log, that is synced before the old copy is dropped, so that a crash
+during a move leaves the chunk on its old tier.
+*/
+package tiered
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+	"github.com/byte-mug/filealloc"
+)
+
+// Rebalance was called for an allocator without HeatmapWindow.
+var NOHEATMAP = errors.New("NO_HEATMAP")
+
+// A tier of storage.
+type Tier uint8
+
+const (
+	Fast Tier = iota
+	Slow
+)
+
+func (t Tier) String() string {
+	if t==Fast { return "fast" }
+	return "slow"
+}
+
+/*
+Layout of a record of the tier log (little endian):
+	0  chunk
+	8  tier
+	12 crc32 of the preceding bytes
+*/
+const logRecord = 16
+
+const copyBuffer = 1<<20
+
+// A Storage, that spreads the chunks of an allocator file over two tiers. Safe for concurrent use.
+type Storage struct{
+	fast, slow, log filealloc.Storage
+	cfg    filealloc.FormatConfig
+	
+	// Guards tiers and logEnd. Held for writing, while a chunk moves.
+	mu     sync.RWMutex
+	// By chunk. Chunks beyond are on the fast tier.
+	tiers  []Tier
+	logEnd int64
+}
+
+/*
+Creates a tiered Storage from the two tiers and the tier log, and reads the log.
+cfg must have the BlockSizeLog, BitmapBlocks and PrefixBlocks of the allocator file.
+*/
+func New(fast, slow, log filealloc.Storage, cfg filealloc.FormatConfig) (s *Storage, err error) {
+	s = &Storage{fast: fast, slow: slow, log: log, cfg: cfg}
+	var b [logRecord]byte
+	for {
+		if _,err = log.ReadAt(b[:],s.logEnd); err!=nil { break }
+		if binary.LittleEndian.Uint32(b[12:])!=crc32.ChecksumIEEE(b[:12]) { break }
+		s.set(int64(binary.LittleEndian.Uint64(b[:])),Tier(b[8]))
+		s.logEnd += logRecord
+	}
+	// A torn record at the end is overwritten by the next one.
+	if err==io.EOF { err = nil }
+	return
+}
+
+func (s *Storage) set(chunk int64, t Tier) {
+	for int64(len(s.tiers))<=chunk { s.tiers = append(s.tiers,Fast) }
+	s.tiers[chunk] = t
+}
+
+func (s *Storage) tier(chunk int64) Tier {
+	if chunk<0 || chunk>=int64(len(s.tiers)) { return Fast }
+	return s.tiers[chunk]
+}
+
+// Returns the tier of the chunk.
+func (s *Storage) Tier(chunk int64) Tier {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tier(chunk)
+}
+
+func (s *Storage) backend(t Tier) filealloc.Storage {
+	if t==Fast { return s.fast }
+	return s.slow
+}
+
+// Returns the byte range of the chunk.
+func (s *Storage) chunkRange(chunk int64) (off, size int64) {
+	size = s.cfg.ChunkSizeInBlocks()<<s.cfg.BlockSizeLog
+	return int64(s.cfg.PrefixBlocks)<<s.cfg.BlockSizeLog+chunk*size,size
+}
+
+// Returns the chunk at off, or -1 for the prefix blocks, and the bytes up to its end.
+func (s *Storage) locate(off int64) (chunk, left int64) {
+	prefix := int64(s.cfg.PrefixBlocks)<<s.cfg.BlockSizeLog
+	if off<prefix { return -1,prefix-off }
+	size := s.cfg.ChunkSizeInBlocks()<<s.cfg.BlockSizeLog
+	chunk = (off-prefix)/size
+	return chunk,size-(off-prefix)%size
+}
+
+/*
+Splits [off,off+len(p)) at the chunk boundaries and calls fn with the backend of each piece.
+A piece, that ends early with io.EOF, is filled with zeros, unless it is the last one.
+*/
+func (s *Storage) split(p []byte, off int64, fn func(st filealloc.Storage, p []byte, off int64) (int, error)) (n int, err error) {
+	for len(p)>0 {
+		chunk,left := s.locate(off)
+		q := p
+		if int64(len(q))>left { q = q[:left] }
+		t := Fast
+		if chunk>=0 { t = s.tier(chunk) }
+		k,e := fn(s.backend(t),q,off)
+		n += k
+		if e==io.EOF && len(q)<len(p) {
+			for i := k; i<len(q); i++ { q[i] = 0 }
+			n,e = n+len(q)-k,nil
+		}
+		if e!=nil { return n,e }
+		p,off = p[len(q):],off+int64(len(q))
+	}
+	return
+}
+
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.split(p,off,func(st filealloc.Storage, p []byte, off int64) (int, error) { return st.ReadAt(p,off) })
+}
+
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.split(p,off,func(st filealloc.Storage, p []byte, off int64) (int, error) { return st.WriteAt(p,off) })
+}
+
+func (s *Storage) Sync() error {
+	err := s.fast.Sync()
+	if e := s.slow.Sync(); err==nil { err = e }
+	return err
+}
+
+func (s *Storage) Close() error {
+	err := s.fast.Close()
+	if e := s.slow.Close(); err==nil { err = e }
+	if e := s.log.Close(); err==nil { err = e }
+	return err
+}
+
+// Truncates both tiers, so that Shrink works. Returns filealloc.UNSUPPORTED, if neither can.
+func (s *Storage) Truncate(size int64) (err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	err = filealloc.UNSUPPORTED
+	for _,st := range []filealloc.Storage{s.fast,s.slow} {
+		t,ok := st.(filealloc.Truncater)
+		if !ok { continue }
+		if err = t.Truncate(size); err!=nil { return }
+	}
+	return
+}
+
+/*
+Moves the chunk to the tier: copies it, syncs the copy, records the move in the log and syncs
+it, then punches a hole over the old copy, if its tier is a HolePuncher. Reads and writes wait
+for the move.
+*/
+func (s *Storage) Migrate(chunk int64, t Tier) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from := s.tier(chunk)
+	if chunk<0 || from==t { return }
+	src,dst := s.backend(from),s.backend(t)
+	off,size := s.chunkRange(chunk)
+	if err = copyRange(dst,src,off,size); err!=nil { return }
+	if err = dst.Sync(); err!=nil { return }
+	var b [logRecord]byte
+	binary.LittleEndian.PutUint64(b[:],uint64(chunk))
+	b[8] = byte(t)
+	binary.LittleEndian.PutUint32(b[12:],crc32.ChecksumIEEE(b[:12]))
+	if _,err = s.log.WriteAt(b[:],s.logEnd); err!=nil { return }
+	if err = s.log.Sync(); err!=nil { return }
+	s.logEnd += logRecord
+	s.set(chunk,t)
+	if hp,ok := src.(filealloc.HolePuncher); ok { hp.PunchHole(off,size) }
+	return
+}
+
+// Copies [off,off+size) from src to dst. Zeros are punched into dst, where it can, rather than written.
+func copyRange(dst, src filealloc.Storage, off, size int64) error {
+	hp,punch := dst.(filealloc.HolePuncher)
+	buf := make([]byte,copyBuffer)
+	for end := off+size; off<end; off += int64(len(buf)) {
+		if int64(len(buf))>end-off { buf = buf[:end-off] }
+		n,err := src.ReadAt(buf,off)
+		if err==io.EOF {
+			for i := n; i<len(buf); i++ { buf[i] = 0 }
+			err = nil
+		}
+		if err!=nil { return err }
+		if punch && isZero(buf) && hp.PunchHole(off,int64(len(buf)))==nil { continue }
+		if _,err = dst.WriteAt(buf,off); err!=nil { return err }
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _,c := range b {
+		if c!=0 { return false }
+	}
+	return true
+}
+
+/*
+Moves the busiest chunks by the Heatmap of pa, up to fast of them, to the fast tier,
+and all others to the slow one. Chunks without allocations or frees in the window count as idle.
+Returns the number of chunks moved.
+*/
+func (s *Storage) Rebalance(pa *filealloc.PageAllocator, fast int) (moved int, err error) {
+	h := pa.Heatmap()
+	if h==nil { return 0,NOHEATMAP }
+	n := len(h.Allocs)
+	churn := make([]int64,n)
+	order := make([]int64,n)
+	for c := range order {
+		a,f := h.Chunk(int64(c))
+		churn[c],order[c] = a+f,int64(c)
+	}
+	sort.SliceStable(order,func(i, j int) bool { return churn[order[i]]>churn[order[j]] })
+	for rank,c := range order {
+		want := Slow
+		if rank<fast && churn[c]>0 { want = Fast }
+		if s.Tier(c)==want { continue }
+		if err = s.Migrate(c,want); err!=nil { return }
+		moved++
+	}
+	return
+}
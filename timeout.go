@@ -0,0 +1,60 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The operation didn't complete within OpTimeout.
+var TIMEOUT = errors.New("TIMEOUT")
+
+/*
+Optional interface of a Storage, whose calls fail with an error matching os.ErrDeadlineExceeded
+after the deadline, like network files. The zero time clears the deadline.
+*/
+type DeadlineSetter interface{
+	SetDeadline(t time.Time) error
+}
+
+// Longest pause between attempts to acquire the lock.
+const maxLockBackoff = 5*time.Millisecond
+
+// Acquires pa.mu, but gives up with TIMEOUT after OpTimeout. Sets the deadline of the operation.
+func (pa *PageAllocator) lock() error {
+	timeout := time.Duration(pa.opTimeout.Load())
+	if timeout<=0 {
+		pa.mu.Lock()
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for d := 10*time.Microsecond; !pa.mu.TryLock(); {
+		if !time.Now().Before(deadline) { return fmt.Errorf("%w: waiting for the allocator",TIMEOUT) }
+		time.Sleep(d)
+		if d *= 2; d>maxLockBackoff { d = maxLockBackoff }
+	}
+	pa.deadline = deadline
+	if ds,ok := pa.Storage.(DeadlineSetter); ok { ds.SetDeadline(deadline) }
+	return nil
+}
+
+// Clears the deadline and translates the errors of missed ones to TIMEOUT. Must be called before pa.mu is released.
+func (pa *PageAllocator) clearDeadline(err *error) {
+	if pa.deadline.IsZero() { return }
+	pa.deadline = time.Time{}
+	if ds,ok := pa.Storage.(DeadlineSetter); ok { ds.SetDeadline(time.Time{}) }
+	if *err!=nil && !errors.Is(*err,TIMEOUT) && errors.Is(*err,os.ErrDeadlineExceeded) {
+		*err = fmt.Errorf("%w: %v",TIMEOUT,*err)
+	}
+}
+
+// Reports TIMEOUT, if the operation in progress ran past its deadline.
+func (pa *PageAllocator) expired() error {
+	if pa.deadline.IsZero() || time.Now().Before(pa.deadline) { return nil }
+	return TIMEOUT
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+var BADTRACE = errors.New("BADTRACE")
+
+var traceMagic = []byte("FATRACE1")
+
+// The kind of a traced operation.
+type TraceOp uint8
+
+const (
+	TraceAllocate TraceOp = iota+1
+	TraceFree
+)
+
+// An operation recorded by a TraceWriter.
+type TraceEvent struct{
+	Op   TraceOp
+	Len  int64
+	// Allocate: grow was set.
+	Grow bool
+	// Allocate: the allocated block, if OK. Free: the first freed block.
+	Blk  int64
+	OK   bool
+}
+
+/*
+Records the allocations and frees of a PageAllocator (see PageAllocator.Trace).
+
+Each event takes a flag byte and two varints. The writes are buffered; call Flush when done.
+*/
+type TraceWriter struct{
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+	hdr bool
+	buf [1+2*binary.MaxVarintLen64]byte
+}
+
+func NewTraceWriter(w io.Writer) *TraceWriter { return &TraceWriter{w: bufio.NewWriter(w)} }
+
+const (
+	traceGrow = 0x10
+	traceOK   = 0x20
+)
+
+// Appends an event to the trace.
+func (t *TraceWriter) Record(ev TraceEvent) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err!=nil { return t.err }
+	if !t.hdr {
+		t.hdr = true
+		_,t.err = t.w.Write(traceMagic)
+	}
+	b := t.buf[:1]
+	b[0] = byte(ev.Op)
+	if ev.Grow { b[0] |= traceGrow }
+	if ev.OK { b[0] |= traceOK }
+	b = binary.AppendVarint(b,ev.Len)
+	b = binary.AppendVarint(b,ev.Blk)
+	if t.err==nil { _,t.err = t.w.Write(b) }
+	return t.err
+}
+
+// Writes out the buffered events.
+func (t *TraceWriter) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err==nil { t.err = t.w.Flush() }
+	return t.err
+}
+
+// Reads a trace written by a TraceWriter.
+func ReadTrace(r io.Reader) (evs []TraceEvent, err error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte,len(traceMagic))
+	if _,err = io.ReadFull(br,magic); err!=nil {
+		if err==io.EOF { err = nil }
+		return
+	}
+	if string(magic)!=string(traceMagic) { return nil,BADTRACE }
+	for {
+		var f byte
+		var ev TraceEvent
+		if f,err = br.ReadByte(); err!=nil {
+			if err==io.EOF { err = nil }
+			return
+		}
+		ev.Op = TraceOp(f&0x0f)
+		ev.Grow = f&traceGrow!=0
+		ev.OK = f&traceOK!=0
+		if ev.Len,err = binary.ReadVarint(br); err!=nil { return evs,BADTRACE }
+		if ev.Blk,err = binary.ReadVarint(br); err!=nil { return evs,BADTRACE }
+		evs = append(evs,ev)
+	}
+}
+
+// The outcome of Replay.
+type ReplayResult struct{
+	Allocations, Frees int
+	
+	// Allocations, whose success differs from the trace.
+	Diverged int
+	
+	// Allocations placed at another block than in the trace.
+	Moved int
+}
+
+/*
+Re-executes a trace against pa, which should be fresh.
+
+Frees are translated to where the replay placed the freed blocks, so that traces replay
+meaningfully under another Placement or FormatConfig. Frees of blocks, that the replay
+didn't allocate, are skipped.
+*/
+func Replay(pa *PageAllocator, evs []TraceEvent) (r ReplayResult, err error) {
+	moved := make(map[int64]int64)
+	for _,ev := range evs {
+		switch ev.Op {
+		case TraceAllocate:
+			var blk int64
+			var ok bool
+			blk,ok,err = pa.AllocateBlocks(ev.Len,ev.Grow)
+			if errors.Is(err,EXTHAUSTED) { err = nil }
+			if err!=nil { return }
+			r.Allocations++
+			if ok!=ev.OK { r.Diverged++ }
+			if !ok || !ev.OK { continue }
+			if blk!=ev.Blk { r.Moved++ }
+			moved[ev.Blk] = blk
+		case TraceFree:
+			blk,ok := moved[ev.Blk]
+			if !ok { continue }
+			delete(moved,ev.Blk)
+			if err = pa.FreeBlocks(blk,ev.Len); err!=nil { return }
+			r.Frees++
+		default:
+			return r,BADTRACE
+		}
+	}
+	return
+}
+
+func (pa *PageAllocator) traceAllocate(lng int64, grow bool, blk int64, ok bool) {
+	if pa.Trace==nil { return }
+	pa.Trace.Record(TraceEvent{Op: TraceAllocate, Len: lng, Grow: grow, Blk: blk, OK: ok})
+}
+
+func (pa *PageAllocator) traceFree(blk, lng int64) {
+	if pa.Trace==nil { return }
+	pa.Trace.Record(TraceEvent{Op: TraceFree, Len: lng, Blk: blk})
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A chunk's bitmap was written by someone else since it was read (see Trailers).
+var CONCURRENTMODIFICATION = errors.New("CONCURRENT_MODIFICATION")
+
+/*
+With FormatConfig.Trailers, every bitmap block ends in a trailer (little endian):
+	0  generation of the chunk, that the block was written with
+	8  lower 32 bits of the block's address
+	12 checksum of the block up to here (see Checksum)
+A block of zeros is valid. Its bitmap bytes are subject to the BitmapEncoding, like all others.
+
+In memory, the bitmaps are kept packed, without the trailers.
+
+The generation of a chunk counts its write-backs. Every write-back includes the first block,
+so its trailer holds the current generation.
+*/
+const bitmapTrailer = 16
+
+// Number of bitmap bytes in a bitmap block.
+func (f *FormatConfig) bitmapPayload() int {
+	n := 1<<f.BlockSizeLog
+	if f.Trailers { n -= bitmapTrailer }
+	return n
+}
+
+// Size of a chunk's bitmap in memory and on disk.
+func (f *FormatConfig) bitmapBytes() int { return int(f.BitmapBlocks)*f.bitmapPayload() }
+func (f *FormatConfig) rawBitmapBytes() int { return int(f.BitmapBlocks)<<f.BlockSizeLog }
+
+// Fills in the trailer of the raw block at the given address.
+func (pa *PageAllocator) sealBlock(raw []byte, addr int64, seq uint64) {
+	t := raw[len(raw)-bitmapTrailer:]
+	binary.LittleEndian.PutUint64(t,seq)
+	binary.LittleEndian.PutUint32(t[8:],uint32(addr))
+	binary.LittleEndian.PutUint32(t[12:],pa.Checksum.Sum(raw[:len(raw)-4]))
+}
+
+// Checks the trailer of the raw block at the given address.
+func (pa *PageAllocator) checkBlock(raw []byte, addr int64) (seq uint64, ok bool) {
+	if isZero(raw) { return 0,true }
+	t := raw[len(raw)-bitmapTrailer:]
+	if !pa.Checksum.Check(raw[:len(raw)-4],binary.LittleEndian.Uint32(t[12:])) { return }
+	if binary.LittleEndian.Uint32(t[8:])!=uint32(addr) { return }
+	return binary.LittleEndian.Uint64(t),true
+}
+
+// Encodes the bitmap blocks [first,first+n) of the packed bitmap bm, that is stored at rawoff.
+func (pa *PageAllocator) encodeBlocks(bm []byte, rawoff int64, gen uint64, first, n int) []byte {
+	bs,pl := 1<<pa.BlockSizeLog,pa.bitmapPayload()
+	raw := make([]byte,n*bs)
+	for j := 0; j<n; j++ {
+		blk := raw[j*bs:(j+1)*bs]
+		copy(blk,bm[(first+j)*pl:(first+j+1)*pl])
+		pa.BitmapEncoding.Encode(blk[:pl])
+		pa.sealBlock(blk,(rawoff>>pa.BlockSizeLog)+int64(first+j),gen)
+	}
+	return raw
+}
+
+// Returns the on-disk form of the packed bitmap bm, that is stored at rawoff.
+func (pa *PageAllocator) rawBitmap(bm []byte, rawoff int64, gen uint64) []byte {
+	if pa.Trailers { return pa.encodeBlocks(bm,rawoff,gen,0,int(pa.BitmapBlocks)) }
+	if pa.BitmapEncoding==0 { return bm }
+	raw := append([]byte(nil),bm...)
+	pa.BitmapEncoding.Encode(raw)
+	return raw
+}
+
+/*
+Reads the bitmap stored at rawoff into bm.
+
+Blocks with a broken trailer are torn: they are marked as entirely used and
+recorded in the RecoveryReport. ok is false, if a block was torn.
+*/
+func (pa *PageAllocator) readBitmap(bm []byte, rawoff int64) (gen uint64, ok bool) {
+	torn,gen,_ := pa.decodeBitmap(bm,rawoff)
+	pa.recovery.TornBitmapBlocks = append(pa.recovery.TornBitmapBlocks,torn...)
+	return gen,len(torn)==0
+}
+
+// Reads the bitmap stored at rawoff into bm and returns the addresses of the torn blocks and the generation.
+func (pa *PageAllocator) decodeBitmap(bm []byte, rawoff int64) (torn []int64, gen uint64, err error) {
+	if !pa.Trailers {
+		_,err = pa.ReadAt(bm,rawoff)
+		pa.BitmapEncoding.Decode(bm)
+		return
+	}
+	bs,pl := 1<<pa.BlockSizeLog,pa.bitmapPayload()
+	raw := make([]byte,pa.rawBitmapBytes())
+	n,err := pa.ReadAt(raw,rawoff)
+	for j := 0; j<int(pa.BitmapBlocks); j++ {
+		dst := bm[j*pl:(j+1)*pl]
+		if (j+1)*bs>n {
+			for k := range dst { dst[k] = 0 }
+			continue
+		}
+		addr := (rawoff>>pa.BlockSizeLog)+int64(j)
+		seq,good := pa.checkBlock(raw[j*bs:(j+1)*bs],addr)
+		if !good {
+			for k := range dst { dst[k] = 0xff }
+			torn = append(torn,addr)
+			continue
+		}
+		if seq>gen { gen = seq }
+		copy(dst,raw[j*bs:])
+		pa.BitmapEncoding.Decode(dst)
+	}
+	return
+}
+
+/*
+Writes the blocks of the doublewrite copy back in place, whose copy in place is torn or older.
+*/
+func (pa *PageAllocator) replayTrailers(chunk int64, dw []byte) (err error) {
+	bs := 1<<pa.BlockSizeLog
+	off := pa.MakeAddress(chunk,-int64(pa.BitmapBlocks))<<pa.BlockSizeLog
+	cur := make([]byte,bs)
+	for j := 0; j<int(pa.BitmapBlocks); j++ {
+		addr := (off>>pa.BlockSizeLog)+int64(j)
+		src := dw[j*bs:(j+1)*bs]
+		want,ok := pa.checkBlock(src,addr)
+		if !ok { continue }
+		n,_ := pa.ReadAt(cur,off+int64(j*bs))
+		if n==bs {
+			if seq,ok := pa.checkBlock(cur,addr); ok && seq>=want { continue }
+		}
+		if _,err = pa.WriteAt(src,off+int64(j*bs)); err!=nil { return }
+	}
+	return pa.Sync()
+}
+
+// Reads the generation of the chunk from the trailer of its first block.
+func (pa *PageAllocator) diskGeneration(rawoff int64) (gen uint64, ok bool) {
+	raw := make([]byte,1<<pa.BlockSizeLog)
+	if n,_ := pa.ReadAt(raw,rawoff); n<len(raw) { return }
+	return pa.checkBlock(raw,rawoff>>pa.BlockSizeLog)
+}
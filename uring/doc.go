@@ -0,0 +1,14 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+/*
+A filealloc.Storage for Linux, that submits writes and syncs through io_uring.
+
+Besides the Storage methods, File implements filealloc.BatchWriter: a batch of writes
+is submitted with a single system call and completes in any order. The allocator uses it
+to write back the modified blocks of all dirty bitmaps at once.
+
+On other platforms, and on kernels without io_uring, New returns filealloc.UNSUPPORTED.
+*/
+package uring
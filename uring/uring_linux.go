@@ -0,0 +1,231 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package uring
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+	"github.com/byte-mug/filealloc"
+)
+
+const (
+	sysSetup = 425
+	sysEnter = 426
+	
+	enterGetEvents = 1
+	
+	offSqRing = 0
+	offCqRing = 0x8000000
+	offSqes   = 0x10000000
+	
+	opFsync = 3
+	opWrite = 23
+)
+
+// The number of offs and bufs passed to WriteAtBatch differ.
+var errBatch = errors.New("uring: len(bufs) != len(offs)")
+
+type sqOffsets struct{
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr uint64
+}
+type cqOffsets struct{
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr uint64
+}
+type params struct{
+	sqEntries, cqEntries, flags, sqThreadCpu, sqThreadIdle, features, wqFd uint32
+	resv [3]uint32
+	sqOff sqOffsets
+	cqOff cqOffsets
+}
+
+// struct io_uring_sqe
+type sqe struct{
+	opcode uint8
+	flags uint8
+	ioprio uint16
+	fd int32
+	off uint64
+	addr uint64
+	len uint32
+	opFlags uint32
+	userData uint64
+	bufIndex uint16
+	personality uint16
+	spliceFdIn int32
+	addr3 uint64
+	pad uint64
+}
+
+// struct io_uring_cqe
+type cqe struct{
+	userData uint64
+	res int32
+	flags uint32
+}
+
+type ring struct{
+	fd int
+	sq, cq, sqes []byte
+	entries uint32
+	sqTail, sqMask *uint32
+	sqArray unsafe.Pointer
+	cqHead, cqTail, cqMask *uint32
+	cqes unsafe.Pointer
+}
+
+func at32(b []byte, off uint32) *uint32 { return (*uint32)(unsafe.Pointer(&b[off])) }
+
+func newRing(entries uint32) (r *ring, err error) {
+	var p params
+	fd,_,errno := syscall.Syscall(sysSetup,uintptr(entries),uintptr(unsafe.Pointer(&p)),0)
+	if errno!=0 { return nil,errno }
+	r = &ring{fd: int(fd), entries: p.sqEntries}
+	defer func() {
+		if err!=nil { r.close() }
+	}()
+	prot,flags := syscall.PROT_READ|syscall.PROT_WRITE,syscall.MAP_SHARED|syscall.MAP_POPULATE
+	r.sq,err = syscall.Mmap(r.fd,offSqRing,int(p.sqOff.array+p.sqEntries*4),prot,flags)
+	if err!=nil { return }
+	r.cq,err = syscall.Mmap(r.fd,offCqRing,int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(cqe{}))),prot,flags)
+	if err!=nil { return }
+	r.sqes,err = syscall.Mmap(r.fd,offSqes,int(p.sqEntries*uint32(unsafe.Sizeof(sqe{}))),prot,flags)
+	if err!=nil { return }
+	r.sqTail = at32(r.sq,p.sqOff.tail)
+	r.sqMask = at32(r.sq,p.sqOff.ringMask)
+	r.sqArray = unsafe.Pointer(&r.sq[p.sqOff.array])
+	r.cqHead = at32(r.cq,p.cqOff.head)
+	r.cqTail = at32(r.cq,p.cqOff.tail)
+	r.cqMask = at32(r.cq,p.cqOff.ringMask)
+	r.cqes = unsafe.Pointer(&r.cq[p.cqOff.cqes])
+	return
+}
+
+func (r *ring) close() {
+	for _,m := range [][]byte{r.sq,r.cq,r.sqes} {
+		if m!=nil { syscall.Munmap(m) }
+	}
+	syscall.Close(r.fd)
+}
+
+/*
+Submits the entries, and waits for all of them to complete.
+Returns the result of each entry in res, and the first system call error.
+*/
+func (r *ring) run(ents []sqe, res []int32) error {
+	for len(ents)>0 {
+		n := uint32(len(ents))
+		if n>r.entries { n = r.entries }
+		tail := atomic.LoadUint32(r.sqTail)
+		mask := *r.sqMask
+		for i := uint32(0); i<n; i++ {
+			idx := (tail+i)&mask
+			e := ents[i]
+			e.userData = uint64(i)
+			*(*sqe)(unsafe.Pointer(&r.sqes[uintptr(idx)*unsafe.Sizeof(sqe{})])) = e
+			*(*uint32)(unsafe.Add(r.sqArray,uintptr(idx)*4)) = idx
+		}
+		atomic.StoreUint32(r.sqTail,tail+n)
+		
+		submitted,completed := uint32(0),uint32(0)
+		for completed<n {
+			ret,_,errno := syscall.Syscall6(sysEnter,uintptr(r.fd),uintptr(n-submitted),1,enterGetEvents,0,0)
+			if errno==syscall.EINTR { continue }
+			if errno!=0 { return errno }
+			submitted += uint32(ret)
+			head := atomic.LoadUint32(r.cqHead)
+			for ; head!=atomic.LoadUint32(r.cqTail); head++ {
+				c := (*cqe)(unsafe.Add(r.cqes,uintptr(head&*r.cqMask)*unsafe.Sizeof(cqe{})))
+				res[c.userData] = c.res
+				completed++
+			}
+			atomic.StoreUint32(r.cqHead,head)
+		}
+		ents,res = ents[n:],res[n:]
+	}
+	return nil
+}
+
+// A file, whose writes and syncs are submitted through io_uring. Reads use pread(2).
+type File struct{
+	*os.File
+	mu sync.Mutex
+	r  *ring
+}
+
+// Sets up an io_uring with the given number of entries for f.
+func New(f *os.File, entries uint32) (*File, error) {
+	r,err := newRing(entries)
+	if err==syscall.ENOSYS || err==syscall.EPERM { err = filealloc.UNSUPPORTED }
+	if err!=nil { return nil,err }
+	return &File{File: f, r: r},nil
+}
+
+// Returns the underlying file.
+func (f *File) OsFile() *os.File { return f.File }
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.WriteAtBatch([][]byte{p},[]int64{off}); err!=nil { return 0,err }
+	return len(p),nil
+}
+
+/*
+Submits all writes at once and waits for their completion. Implements filealloc.BatchWriter.
+
+The writes may complete in any order; overlapping writes leave the overlap undefined.
+*/
+func (f *File) WriteAtBatch(bufs [][]byte, offs []int64) error {
+	if len(bufs)!=len(offs) { return errBatch }
+	ents := make([]sqe,0,len(bufs))
+	idx := make([]int,0,len(bufs))
+	for i,b := range bufs {
+		if len(b)==0 { continue }
+		ents = append(ents,sqe{opcode: opWrite, fd: int32(f.Fd()), off: uint64(offs[i]), addr: uint64(uintptr(unsafe.Pointer(&b[0]))), len: uint32(len(b))})
+		idx = append(idx,i)
+	}
+	res := make([]int32,len(ents))
+	f.mu.Lock()
+	err := f.r.run(ents,res)
+	f.mu.Unlock()
+	for _,b := range bufs {
+		// The kernel accessed the buffers by address.
+		runtime.KeepAlive(b)
+	}
+	if err!=nil { return err }
+	for j,n := range res {
+		if n<0 { return syscall.Errno(-n) }
+		if b := bufs[idx[j]]; int(n)<len(b) {
+			// Complete short writes synchronously.
+			if _,err = f.File.WriteAt(b[n:],offs[idx[j]]+int64(n)); err!=nil { return err }
+		}
+	}
+	return nil
+}
+
+// Submits an fsync and waits for its completion.
+func (f *File) Sync() error {
+	res := make([]int32,1)
+	f.mu.Lock()
+	err := f.r.run([]sqe{{opcode: opFsync, fd: int32(f.Fd())}},res)
+	f.mu.Unlock()
+	if err!=nil { return err }
+	if res[0]<0 { return syscall.Errno(-res[0]) }
+	return nil
+}
+
+// Tears down the ring and closes the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	f.r.close()
+	f.mu.Unlock()
+	return f.File.Close()
+}
+
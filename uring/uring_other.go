@@ -0,0 +1,20 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+//go:build !linux
+
+package uring
+
+import (
+	"os"
+	"github.com/byte-mug/filealloc"
+)
+
+// A file, whose writes are submitted through io_uring.
+type File struct{
+	*os.File
+}
+
+// io_uring is only available on Linux.
+func New(f *os.File, entries uint32) (*File, error) { return nil,filealloc.UNSUPPORTED }
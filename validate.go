@@ -0,0 +1,51 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// The FormatConfig describes an unusable layout.
+var BADCONFIG = errors.New("BADCONFIG")
+
+const (
+	// log2 of the largest chunk in bytes, so that plenty of chunks fit into an int64 file offset.
+	maxChunkSizeLog = 50
+	
+	minBlockSizeLog = 9
+	// The largest block size, at which a chunk with one bitmap block stays within maxChunkSizeLog.
+	maxBlockSizeLog = (maxChunkSizeLog-5)/2
+)
+
+/*
+Checks, whether the configuration describes a usable layout for Create() and Open().
+
+The returned errors match BADCONFIG with errors.Is.
+*/
+func (f *FormatConfig) Validate() error {
+	if f.BlockSizeLog<minBlockSizeLog || f.BlockSizeLog>maxBlockSizeLog {
+		return fmt.Errorf("%w: BlockSizeLog is %d, must be between %d and %d",BADCONFIG,f.BlockSizeLog,minBlockSizeLog,maxBlockSizeLog)
+	}
+	if f.BitmapBlocks==0 {
+		return fmt.Errorf("%w: BitmapBlocks is 0",BADCONFIG)
+	}
+	if int(f.PrefixBlocks)<f.metaBlocks() {
+		return fmt.Errorf("%w: PrefixBlocks is %d, the superblock, its copy and the doublewrite area need %d",BADCONFIG,f.PrefixBlocks,f.metaBlocks())
+	}
+	if !f.BitmapEncoding.Valid() {
+		return fmt.Errorf("%w: unknown BitmapEncoding %#x",BADCONFIG,uint8(f.BitmapEncoding))
+	}
+	if !f.Checksum.Valid() {
+		return fmt.Errorf("%w: unknown Checksum %d",BADCONFIG,uint8(f.Checksum))
+	}
+	// ChunkSizeInBlocks()<<BlockSizeLog is below BitmapBlocks<<(2*BlockSizeLog+4)
+	if bits.Len8(f.BitmapBlocks)+2*int(f.BlockSizeLog)+4 > maxChunkSizeLog {
+		return fmt.Errorf("%w: a chunk of %d bitmap blocks of 2^%d bytes exceeds 2^%d bytes",BADCONFIG,f.BitmapBlocks,f.BlockSizeLog,maxChunkSizeLog)
+	}
+	return nil
+}
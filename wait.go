@@ -0,0 +1,60 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+Allocates lng blocks like AllocateBlocks, growing the file, if needed. If the blocks are
+exhausted and the file can't grow (because of MaxChunks, or because the device is full),
+it waits for frees or Shrink to make space, until ctx ends.
+
+The waiting calls are served in order: only the first one retries, the others wait behind it,
+even if a later one would fit. AllocateBlocks and the other allocations don't wait in line.
+Returns ctx.Err(), if ctx ends first.
+*/
+func (pa *PageAllocator) AllocateBlocksWait(ctx context.Context, lng int64) (blk int64, err error) {
+	if lng>pa.RunSizeInBlocks() { return 0,EXCEEDMAX }
+	ch := make(chan struct{},1)
+	pa.mu.Lock()
+	pa.spaceWaiters = append(pa.spaceWaiters,ch)
+	if len(pa.spaceWaiters)==1 { ch <- struct{}{} }
+	pa.mu.Unlock()
+	defer pa.stopWaiting(ch)
+	for {
+		select {
+		case <-ctx.Done(): return 0,ctx.Err()
+		case <-ch:
+		}
+		var ok bool
+		blk,ok,err = pa.AllocateBlocks(lng,true)
+		if ok { return }
+		if !errors.Is(err,EXTHAUSTED) && !errors.Is(err,NOSPACE) { return 0,err }
+	}
+}
+
+// Leaves the queue. If the first waiter leaves, the next one retries.
+func (pa *PageAllocator) stopWaiting(ch chan struct{}) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	for i,c := range pa.spaceWaiters {
+		if c!=ch { continue }
+		pa.spaceWaiters = append(pa.spaceWaiters[:i],pa.spaceWaiters[i+1:]...)
+		if i==0 { pa.spaceFreed() }
+		return
+	}
+}
+
+// Wakes the first caller of AllocateBlocksWait, to retry. pa.mu must be held.
+func (pa *PageAllocator) spaceFreed() {
+	if len(pa.spaceWaiters)==0 { return }
+	select {
+	case pa.spaceWaiters[0] <- struct{}{}:
+	default:
+	}
+}
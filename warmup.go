@@ -0,0 +1,82 @@
+// Copyright 2021 Simon Schmidt
+// Licensed under the terms of the
+// CC0 1.0 Universal license.
+
+package filealloc
+
+import (
+	"context"
+	"os"
+	"runtime"
+)
+
+/*
+Optional interface of a MemMapper, that takes hints on mappings, that will be accessed soon,
+like madvise(MADV_WILLNEED). See the stdmmap package for an implementation.
+*/
+type MemAdviser interface{
+	MemWillNeed(mm []byte) error
+}
+
+// Progress of Warmup.
+type WarmupProgress struct{
+	// Chunks warmed up so far, out of Chunks.
+	Done, Chunks int
+	
+	// Bitmap bytes touched or read so far.
+	Bytes int64
+}
+
+/*
+Faults in the pages of the mmapped bitmaps, so that the first allocations after opening the file
+don't wait for them. If the MemMapper is a MemAdviser, all of them are hinted first, so that they
+are read in parallel. With heap set, the bitmap blocks of heap-backed chunks are read into the page
+cache of the Storage (hinted, if it is a ReadAdviser), for their write-backs and for scrubbing.
+
+progress, if not nil, is called after every chunk. The allocator is not locked between chunks.
+Returns ctx.Err(), if ctx ends first.
+*/
+func (pa *PageAllocator) Warmup(ctx context.Context, heap bool, progress func(WarmupProgress)) error {
+	pa.mu.Lock()
+	n := len(pa.allocators)
+	if ma,ok := pa.mmapper.(MemAdviser); ok {
+		for i := range pa.allocators {
+			if a := &pa.allocators[i]; a.mmapped { ma.MemWillNeed(a.buffer) }
+		}
+	}
+	pa.mu.Unlock()
+	
+	p := WarmupProgress{Chunks: n}
+	var raw []byte
+	for i := 0; i<n; i++ {
+		if err := ctx.Err(); err!=nil { return err }
+		pa.mu.Lock()
+		if i>=len(pa.allocators) {
+			// Removed in the meantime.
+			pa.mu.Unlock()
+			break
+		}
+		pa.touch(i)
+		a := &pa.allocators[i]
+		switch {
+		case a.mmapped: p.Bytes += touchPages(a.buffer)
+		case heap:
+			if raw==nil { raw = make([]byte,pa.rawBitmapBytes()) }
+			if ra,ok := pa.Storage.(ReadAdviser); ok { ra.WillNeed(a.rawoff,int64(len(raw))) }
+			if k,_ := pa.ReadAt(raw,a.rawoff); k>0 { p.Bytes += int64(k) }
+		}
+		pa.mu.Unlock()
+		p.Done++
+		if progress!=nil { progress(p) }
+	}
+	return nil
+}
+
+// Reads a byte of every page of b. Returns len(b).
+func touchPages(b []byte) int64 {
+	var x byte
+	ps := os.Getpagesize()
+	for j := 0; j<len(b); j += ps { x ^= b[j] }
+	runtime.KeepAlive(x)
+	return int64(len(b))
+}